@@ -0,0 +1,379 @@
+package diskv
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// batch 在 db 文件中写为一组连续的记录，一次写入:
+// _bat:1a2b3c4d:1[3]\n           开始标记，[] 中为记录的数量
+// _set:1a2b3c4d:5[key]value\n    ...3 条 _set 或 _del 记录
+// _cmt:1a2b3c4d:1[3]\n           提交标记
+// 读取时只有读到提交标记才算提交，没有提交的一组记录整体忽略，见 readBatch
+const (
+	opBatch  = "_bat"
+	opCommit = "_cmt"
+)
+
+// 是否为 batch 的开始或提交标记
+func (r *logRecord) batchMarker() bool {
+	return r.op == opBatch || r.op == opCommit
+}
+
+// Batch 收集多个 key 的写入和删除，Commit 时一起写入，崩溃后要么全部生效，要么全部不生效
+// Commit 之前的操作对 db 不可见；Commit 的过程中并发的读取可能读到一部分 key 的新值，快照中则不会，见 Snapshot
+// Batch 不能并发使用
+type Batch struct {
+	d   *Diskv
+	ops []batchOp
+}
+
+type batchOp struct {
+	op     string // opSet 或 opDel
+	key    string
+	value  []byte
+	expire int64 // 过期时间 (unix 毫秒)，见 SetWithTTL
+}
+
+func (d *Diskv) NewBatch() *Batch {
+	return &Batch{d: d}
+}
+
+func (b *Batch) Set(key string, value []byte) {
+	b.ops = append(b.ops, batchOp{op: opSet, key: key, value: value})
+}
+
+func (b *Batch) SetString(key string, value string) {
+	b.Set(key, []byte(value))
+}
+
+// 同 Diskv.SetWithTTL，过期时间从调用时开始计算，ttl 不大于 0 时 Commit 返回错误
+func (b *Batch) SetWithTTL(key string, value []byte, ttl time.Duration) {
+	b.ops = append(b.ops, batchOp{op: opSet, key: key, value: value, expire: expireAt(ttl)})
+}
+
+func (b *Batch) Del(key string) {
+	b.ops = append(b.ops, batchOp{op: opDel, key: key})
+}
+
+// 收集的操作数量
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// 清空收集的操作，可以继续使用
+func (b *Batch) Reset() {
+	b.ops = nil
+}
+
+// 按顺序应用收集的操作，同一个 key 以最后一个操作为准
+// 成功后清空收集的操作；idx 空间不足时与 Set 一样先同步扩容，直到放得下整个 batch
+func (b *Batch) Commit(ctx context.Context) error {
+	err := b.d.commitBatch(ctx, b.ops, nil)
+	for errors.Is(err, ErrIndexFull) && b.d.opts.MaxLoad >= 0 { // 一次扩容可能放不下整个 batch
+		err = b.d.growIdx(ctx)
+		if err != nil {
+			return fmt.Errorf("grow idx error: %w", err)
+		}
+
+		err = b.d.commitBatch(ctx, b.ops, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	b.Reset()
+	return nil
+}
+
+// 写入 ops，tx 不为 nil 时在锁住 tx 读过的 key 后先检查是否有冲突，见 Tx
+func (d *Diskv) commitBatch(ctx context.Context, ops []batchOp, tx *Tx) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if err := d.checkClosed(); err != nil {
+		return err
+	}
+
+	if len(ops) > 0 {
+		if err := d.checkWritable(); err != nil {
+			return err
+		}
+	}
+
+	encoded := make([]batchOp, len(ops))
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		if err := d.checkExpire(ctx, op.expire); err != nil {
+			return err
+		}
+
+		key, err := d.encodeKey(ctx, op.key)
+		if err != nil {
+			return err
+		}
+		encoded[i] = batchOp{op: op.op, key: key, value: op.value, expire: op.expire}
+		keys[i] = key
+	}
+	ops = encoded
+
+	if tx != nil {
+		for _, r := range tx.reads {
+			keys = append(keys, r.key)
+		}
+	}
+
+	defer d.lockKeys(keys)()
+
+	if tx != nil {
+		err := tx.validate(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	// idx 放不下时不写 db 文件，否则应用到一半时失败
+	err := d.checkBatchRoom(ctx, ops)
+	if err != nil {
+		return err
+	}
+
+	metas, n, err := d.dbstore.writeBatch(ctx, ops, d.idx.checkSlotLen)
+	if err != nil {
+		return err
+	}
+	defer d.dbstore.batchApplied()
+
+	err = d.syncFile(ctx, d.dbstore)
+	if err == nil {
+		d.addStats(n, 0, nil)
+		err = d.applyBatch(ctx, ops, metas)
+	}
+	if err != nil { // 已写入 db 文件，重新打开时由 redoBatches 补齐，见 saveCheckpoint
+		atomic.StoreInt32(&d.unapplied, 1)
+		return err
+	}
+
+	err = d.syncFile(ctx, d.idx)
+	if err != nil {
+		return err
+	}
+
+	d.maybeGrowIdx(ctx)
+	d.maybeCompact()
+
+	return nil
+}
+
+// 把已提交到 db 文件的 batch 应用到 idx，期间不会创建快照
+func (d *Diskv) applyBatch(ctx context.Context, ops []batchOp, metas []*valueMeta) (err error) {
+	d.applyMu.RLock()
+	defer d.applyMu.RUnlock()
+
+	for i, op := range ops {
+		var old *valueMeta
+		live := 0
+
+		if op.op == opSet {
+			old, err = d.idx.replaceValueMeta(ctx, metas[i])
+			live = metas[i].length
+			if err == nil {
+				d.addSortedKey(op.key)
+			}
+		} else {
+			old, err = d.idx.removeValueMeta(ctx, op.key)
+		}
+		d.invalidateCache(op.key)
+		if err != nil { // 已提交到 db 文件，重新打开时由 redoBatches 补齐
+			return fmt.Errorf("apply batch to idx error: %w", err)
+		}
+
+		d.addStats(0, live, old)
+	}
+
+	return nil
+}
+
+// 按顺序应用 ops 的过程中，key 的数量最多时是否超出 idx 的大小
+func (d *Diskv) checkBatchRoom(ctx context.Context, ops []batchOp) error {
+	meta, err := d.idx.getIdxMeta(ctx)
+	if err != nil {
+		return err
+	}
+
+	exists := map[string]bool{}
+	count := d.idx.keyCount()
+	for _, op := range ops {
+		has, ok := exists[op.key]
+		if !ok {
+			_, has, err = d.idx.getValueMeta(ctx, op.key)
+			if err != nil {
+				return err
+			}
+		}
+
+		if op.op == opSet && !has {
+			count++
+		} else if op.op == opDel && has {
+			count--
+		}
+		exists[op.key] = op.op == opSet
+
+		if count > meta.keysLen {
+			return ErrIndexFull
+		}
+	}
+
+	return nil
+}
+
+// 把一组记录一次写入当前 segment，返回每条 _set 记录的位置 (_del 为 nil) 和写入的字节数
+// 写入后需调用 batchApplied，应用到 idx 之前不切换 segment；check 对任一条 _set 返回错误时整组都不写入
+func (d *dbsotre) writeBatch(ctx context.Context, ops []batchOp, check func(meta *valueMeta) error) (metas []*valueMeta, n int, err error) {
+	err = d.runWithFile(ctx, func(ctx context.Context, f *os.File) error {
+		f, size, err := d.rollIfFull(f)
+		if err != nil {
+			return err
+		}
+
+		count := &valueItem{key: strconv.Itoa(len(ops))}
+		data := encodeValueItem(d.version, opBatch, count)
+
+		metas = make([]*valueMeta, len(ops))
+		for i, op := range ops {
+			rec := encodeValueItem(d.version, op.op, &valueItem{key: op.key, value: op.value, expire: op.expire})
+			if op.op == opSet {
+				metas[i] = &valueMeta{key: op.key, seg: d.seg, offset: int(size) + len(data), length: len(rec), expire: op.expire}
+				if check != nil {
+					if err := check(metas[i]); err != nil {
+						return err
+					}
+				}
+			}
+			data = append(data, rec...)
+		}
+		data = append(data, encodeValueItem(d.version, opCommit, count)...)
+
+		n, err = f.Write(data)
+		if err != nil {
+			return err
+		}
+
+		d.applying++
+		return nil
+	})
+
+	return metas, n, err
+}
+
+func (d *dbsotre) batchApplied() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.applying--
+}
+
+// 读取 batch 的一组记录: 开始标记 + n 条记录 + 提交标记
+// 完整时按顺序返回所有记录 (含两个标记)；没有读到提交标记时返回一条覆盖整组的无法解析的记录:
+// 读到文件结尾时为 errIncompleteRecord (写入过程中崩溃)，否则为 errCorruptRecord
+func readBatch(r *bufio.Reader, head *logRecord) ([]*logRecord, error) {
+	offset := int64(head.offset + head.length)
+	broken := func(err error) []*logRecord {
+		return []*logRecord{{offset: head.offset, length: int(offset) - head.offset, err: err}}
+	}
+
+	n, err := strconv.Atoi(head.item.key)
+	if err != nil || n < 0 {
+		return broken(errCorruptRecord), nil
+	}
+
+	recs := []*logRecord{head}
+	for i := 0; i <= n; i++ {
+		rec, err := readLogRecord(r, offset)
+		if err != nil {
+			return nil, err
+		}
+		if rec == nil {
+			return broken(errIncompleteRecord), nil
+		}
+
+		offset += int64(rec.length)
+		if rec.err != nil {
+			return broken(rec.err), nil
+		}
+
+		if i < n && rec.batchMarker() {
+			return broken(errCorruptRecord), nil
+		}
+		if i == n && (rec.op != opCommit || rec.item.key != head.item.key) {
+			return broken(errCorruptRecord), nil
+		}
+
+		recs = append(recs, rec)
+	}
+
+	return recs, nil
+}
+
+// 记录已提交的 batch 涉及的 key 在之后的最后一条记录
+type batchTracker struct {
+	inBatch bool
+	latest  map[string]*logRecord
+}
+
+func newBatchTracker() *batchTracker {
+	return &batchTracker{latest: map[string]*logRecord{}}
+}
+
+// 按顺序传入有效的记录
+func (t *batchTracker) add(rec *logRecord) {
+	switch rec.op {
+	case opBatch:
+		t.inBatch = true
+	case opCommit:
+		t.inBatch = false
+	case opSet, opDel:
+		if _, ok := t.latest[rec.item.key]; ok || t.inBatch {
+			t.latest[rec.item.key] = rec
+		}
+	}
+}
+
+// 写入 idx 的过程中崩溃时，batch 只有一部分 key 写入了 idx，以 db 文件中这些 key 的最后一条记录为准补齐
+// 应用到 idx 之前不会切换 segment，只需检查当前 segment 中的 batch
+func (d *Diskv) redoBatches(ctx context.Context, t *batchTracker) error {
+	for key, rec := range t.latest {
+		meta, ok, err := d.idx.getValueMeta(ctx, key)
+		if err != nil {
+			return fmt.Errorf("get idx of key [%s] error: %s", key, err)
+		}
+
+		switch rec.op {
+		case opSet:
+			if ok && meta.seg == rec.seg && meta.offset == rec.offset {
+				continue
+			}
+			err = d.idx.setValueMeta(ctx, rec.valueMeta())
+		case opDel:
+			if !ok {
+				continue
+			}
+			_, err = d.idx.removeValueMeta(ctx, key)
+		}
+		if err != nil {
+			return fmt.Errorf("redo batch of key [%s] error: %s", key, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,290 @@
+package diskv
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 40, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	if err := db.SetString(ctx, "c", "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	b := db.NewBatch()
+	b.SetString("a", "1")
+	b.SetString("b", "2")
+	b.SetString("a", "1-new") // 同一个 key 以最后一个操作为准
+	b.Del("c")
+	if b.Len() != 4 {
+		t.Fatalf("unexpected batch len: %d", b.Len())
+	}
+
+	// 提交之前不可见
+	if has, err := db.Has(ctx, "a"); err != nil || has {
+		t.Fatalf("a should not be visible before commit: %v %v", has, err)
+	}
+
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 0 {
+		t.Fatal("batch should be reset after commit")
+	}
+
+	check := func(t *testing.T, db *Diskv) {
+		for _, kv := range [][2]string{{"a", "1-new"}, {"b", "2"}} {
+			val, ok, err := db.GetString(ctx, kv[0])
+			if err != nil || !ok || val != kv[1] {
+				t.Fatalf("get %s error: %q %v %v", kv[0], val, ok, err)
+			}
+		}
+		if has, err := db.Has(ctx, "c"); err != nil || has {
+			t.Fatalf("c should be deleted: %v %v", has, err)
+		}
+		if stats := db.Stats(); stats.Keys != 2 {
+			t.Fatalf("unexpected keys: %d", stats.Keys)
+		}
+	}
+	check(t, db)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, db)
+
+	// 开始和提交标记不算作记录
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := RebuildIndex(ctx, &CreateConfig{Dir: dir, MaxLen: 40, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Records != 5 || res.Keys != 2 {
+		t.Fatalf("unexpected rebuild result: %+v", res)
+	}
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, db)
+
+	t.Run("grow", func(t *testing.T) {
+		db, err := CreateDB(ctx, &CreateConfig{Dir: t.TempDir(), MaxLen: 40, KeysLen: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		b := db.NewBatch()
+		for i := 0; i < 10; i++ {
+			b.SetString(fmt.Sprintf("key%d", i), fmt.Sprint(i))
+		}
+		if err := b.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if stats := db.Stats(); stats.Keys != 10 {
+			t.Fatalf("unexpected keys: %d", stats.Keys)
+		}
+	})
+}
+
+// 模拟写入 batch 的过程中崩溃: 没有提交标记的一组记录整体忽略
+func TestBatchIncomplete(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 40, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	if err := db.SetString(ctx, "a", "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	b := db.NewBatch()
+	b.SetString("a", "new")
+	b.SetString("b", "new")
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 截掉提交标记，batch 中的两条记录都是完整的
+	dbFile := filepath.Join(dir, "diskv.db")
+	info, err := os.Stat(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := encodeValueItem(currentFormatVersion, opCommit, &valueItem{key: "2"})
+	if err := os.Truncate(dbFile, info.Size()-int64(len(commit))+3); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	val, ok, err := db.GetString(ctx, "a")
+	if err != nil || !ok || val != "old" {
+		t.Fatalf("a should fall back to old: %q %v %v", val, ok, err)
+	}
+	if has, err := db.Has(ctx, "b"); err != nil || has {
+		t.Fatalf("b should not exist: %v %v", has, err)
+	}
+	if stats := db.Stats(); stats.Keys != 1 {
+		t.Fatalf("unexpected keys: %d", stats.Keys)
+	}
+
+	// 整组被截断，新记录紧接着最后一条有效记录
+	if err := db.SetString(ctx, "c", "1"); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	_, err = scanLog(ctx, db.dbstore.f, 0, func(rec *logRecord) bool {
+		if rec.err != nil {
+			t.Fatalf("unexpected bad record at %d: %s", rec.offset, rec.err)
+		}
+		n++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expect 2 records, got %d", n)
+	}
+}
+
+// 模拟写入 idx 的过程中崩溃: 已提交的 batch 只有一部分写入了 idx，打开时补齐
+func TestBatchRedo(t *testing.T) {
+	ctx := context.Background()
+
+	for _, c := range concurrentConfigs {
+		t.Run(c.name, func(t *testing.T) {
+			config := c.config
+			config.Dir = t.TempDir()
+
+			db, err := CreateDB(ctx, &config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { db.Close() }()
+
+			if err := db.SetString(ctx, "c", "old"); err != nil {
+				t.Fatal(err)
+			}
+
+			b := db.NewBatch()
+			b.SetString("a", "1")
+			b.SetString("b", "2")
+			b.Del("c")
+			if err := b.Commit(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.SetString(ctx, "b", "3"); err != nil { // batch 之后的写入
+				t.Fatal(err)
+			}
+
+			// 撤销 a 的写入和 c 的删除，b 之后又写入过，不能退回 batch 中的值
+			for _, key := range []string{"a", "c"} {
+				ekey, err := db.encodeKey(ctx, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := db.idx.removeValueMeta(ctx, ekey); err != nil {
+					t.Fatal(err)
+				}
+			}
+			atomic.StoreInt32(&db.unapplied, 1) // 崩溃时 batch 没有应用完，关闭时不记录 checkpoint
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err = OpenDB(ctx, config.Dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, kv := range [][2]string{{"a", "1"}, {"b", "3"}} {
+				val, ok, err := db.GetString(ctx, kv[0])
+				if err != nil || !ok || val != kv[1] {
+					t.Fatalf("get %s error: %q %v %v", kv[0], val, ok, err)
+				}
+			}
+			if has, err := db.Has(ctx, "c"); err != nil || has {
+				t.Fatalf("c should be deleted: %v %v", has, err)
+			}
+			if stats := db.Stats(); stats.Keys != 2 {
+				t.Fatalf("unexpected keys: %d", stats.Keys)
+			}
+		})
+	}
+}
+
+// 并发提交的 batch 互相覆盖同一组 key，最终所有 key 必须来自同一个 batch
+func TestBatchConcurrent(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: t.TempDir(), MaxLen: 40, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	keys := []string{"a", "b", "c", "d"}
+	wg := sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < 50; i++ {
+				b := db.NewBatch()
+				for j := range keys {
+					key := keys[(w+j)%len(keys)] // 不同的顺序
+					b.SetString(key, fmt.Sprintf("%d-%d", w, i))
+				}
+				if err := b.Commit(ctx); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	first, _, err := db.GetString(ctx, keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys[1:] {
+		val, _, err := db.GetString(ctx, key)
+		if err != nil || val != first {
+			t.Fatalf("%s: %q %v, expect %q", key, val, err, first)
+		}
+	}
+}
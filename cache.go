@@ -0,0 +1,203 @@
+package diskv
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// 每个缓存项除 key 和 value 外的大致内存占用 (valueMeta、链表节点、map 项)
+const cacheEntryOverhead = 128
+
+// Get/Has 读到的 valueMeta (以及 value) 的 LRU 缓存，按字节数限制大小，见 Options.CacheBytes
+// 写入和删除只让缓存失效，不写入缓存: 并发写同一个 key 时无法确定哪个是最后写入 idx 的
+type cache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	ll       *list.List // 最近使用的在前
+	items    map[string]*list.Element
+
+	// 每次失效时递增，读 idx 前后不一致说明期间有写入，读到的结果可能已过期，不写入缓存
+	seq uint64
+
+	withValue bool // 同时缓存 value
+
+	hits   int64
+	misses int64
+}
+
+type cacheEntry struct {
+	key   string
+	meta  valueMeta
+	value []byte // withValue 时有效
+	size  int64
+}
+
+func newCache(maxBytes int64, withValue bool) *cache {
+	return &cache{
+		maxBytes:  maxBytes,
+		ll:        list.New(),
+		items:     map[string]*list.Element{},
+		withValue: withValue,
+	}
+}
+
+// 读 idx 前调用，用于 add 时判断期间是否有写入
+func (c *cache) begin() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.seq
+}
+
+// 查找 key，value 为缓存中 value 的副本，未缓存 value 时为 nil
+func (c *cache) get(key string) (meta valueMeta, value []byte, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return valueMeta{}, nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	c.hits++
+
+	entry := el.Value.(*cacheEntry)
+	if entry.value != nil {
+		value = append([]byte{}, entry.value...)
+	}
+
+	return entry.meta, value, true
+}
+
+// 加入缓存，seq 为读 idx 前 begin 的返回值，value 为 nil 时只缓存 valueMeta
+func (c *cache) add(seq uint64, key string, meta *valueMeta, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if seq != c.seq {
+		return
+	}
+
+	if c.withValue && value != nil {
+		value = append([]byte{}, value...) // 调用方可能修改 value
+	} else {
+		value = nil
+	}
+
+	entry := &cacheEntry{key: key, meta: *meta, value: value}
+	entry.size = int64(len(key)+len(value)) + cacheEntryOverhead
+	if entry.size > c.maxBytes {
+		return
+	}
+
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+
+	c.items[key] = c.ll.PushFront(entry)
+	c.bytes += entry.size
+
+	for c.bytes > c.maxBytes {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// key 被写入或删除，在写 idx 之后调用
+func (c *cache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// 清空缓存，idx 或 db 文件被替换后调用
+func (c *cache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	c.ll.Init()
+	c.items = map[string]*list.Element{}
+	c.bytes = 0
+}
+
+func (c *cache) removeElement(el *list.Element) {
+	entry := el.Value.(*cacheEntry)
+	c.ll.Remove(el)
+	delete(c.items, entry.key)
+	c.bytes -= entry.size
+}
+
+func (c *cache) stats() (hits, misses, bytes int64, entries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hits, c.misses, c.bytes, len(c.items)
+}
+
+func (d *Diskv) initCache() {
+	if d.opts.CacheBytes > 0 {
+		d.cache = newCache(d.opts.CacheBytes, d.opts.CacheValues)
+	}
+}
+
+// 查找 key 的 valueMeta，withValue 时同时读出 value，开启缓存时先查缓存
+// 已过期的 key 视为不存在，并在后台删除，见 reapLater
+func (d *Diskv) lookup(ctx context.Context, key string, withValue bool) (meta *valueMeta, value []byte, ok bool, err error) {
+	var seq uint64
+	if d.cache != nil {
+		seq = d.cache.begin()
+
+		cached, cachedValue, hit := d.cache.get(key)
+		if hit && cached.expired(timeNow()) {
+			d.reapLater(key)
+			return nil, nil, false, nil
+		}
+		if hit && (cachedValue != nil || !withValue) {
+			return &cached, cachedValue, true, nil
+		}
+		if hit { // 只缓存了 valueMeta
+			meta, ok = &cached, true
+		}
+	}
+
+	if meta == nil {
+		meta, ok, err = d.idx.getValueMeta(ctx, key)
+		if err != nil || !ok {
+			return nil, nil, false, err
+		}
+
+		if meta.expired(timeNow()) {
+			d.reapLater(key)
+			return nil, nil, false, nil
+		}
+	}
+
+	if withValue {
+		val, err := d.dbstore.read(ctx, meta)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		value = val.value
+	}
+
+	if d.cache != nil {
+		d.cache.add(seq, key, meta, value)
+	}
+
+	return meta, value, true, nil
+}
+
+// 在写 idx 之后调用
+func (d *Diskv) invalidateCache(key string) {
+	if d.cache != nil {
+		d.cache.invalidate(key)
+	}
+}
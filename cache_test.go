@@ -0,0 +1,194 @@
+package diskv
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCacheLRU(t *testing.T) {
+	c := newCache(3*(cacheEntryOverhead+2+5), true)
+
+	for i := 0; i < 3; i++ {
+		c.add(c.begin(), fmt.Sprintf("k%d", i), &valueMeta{offset: i}, []byte("value"))
+	}
+	if _, _, ok := c.get("k0"); !ok { // k0 变为最近使用
+		t.Fatal("k0 should be cached")
+	}
+
+	c.add(c.begin(), "k3", &valueMeta{offset: 3}, []byte("value"))
+	if _, _, ok := c.get("k1"); ok {
+		t.Fatal("k1 should be evicted")
+	}
+	for _, key := range []string{"k0", "k2", "k3"} {
+		if _, value, ok := c.get(key); !ok || string(value) != "value" {
+			t.Fatalf("%s should be cached: %q %v", key, value, ok)
+		}
+	}
+
+	hits, misses, bytes, entries := c.stats()
+	if hits != 4 || misses != 1 || entries != 3 || bytes != 3*(cacheEntryOverhead+2+5) {
+		t.Fatalf("unexpected stats: %d %d %d %d", hits, misses, bytes, entries)
+	}
+
+	// 读 idx 期间有写入时，读到的结果不写入缓存
+	seq := c.begin()
+	c.invalidate("k4")
+	c.add(seq, "k4", &valueMeta{offset: 4}, nil)
+	if _, _, ok := c.get("k4"); ok {
+		t.Fatal("stale k4 should not be cached")
+	}
+
+	// 超过上限的项不缓存
+	c.add(c.begin(), "big", &valueMeta{}, make([]byte, 1024))
+	if _, _, ok := c.get("big"); ok {
+		t.Fatal("big should not be cached")
+	}
+}
+
+func TestDiskvCache(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	for _, withValue := range []bool{false, true} {
+		t.Run(fmt.Sprintf("values-%v", withValue), func(t *testing.T) {
+			db, err := CreateDB(ctx, &CreateConfig{Dir: t.TempDir(), MaxLen: 40, KeysLen: 100, Options: Options{CacheBytes: 1 << 20, CacheValues: withValue}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			get := func(key, expect string, has bool) {
+				val, ok, err := db.GetString(ctx, key)
+				if err != nil || ok != has || val != expect {
+					t.Fatalf("get %s error: %q %v %v, expect %q %v", key, val, ok, err, expect, has)
+				}
+			}
+
+			if err := db.SetString(ctx, "a", "1"); err != nil {
+				t.Fatal(err)
+			}
+			get("a", "1", true) // miss
+			get("a", "1", true) // hit
+
+			if err := db.SetString(ctx, "a", "2"); err != nil {
+				t.Fatal(err)
+			}
+			get("a", "2", true) // miss
+			get("a", "2", true) // hit
+
+			if _, err := db.Del(ctx, "a"); err != nil {
+				t.Fatal(err)
+			}
+			get("a", "", false) // miss
+			if has, err := db.Has(ctx, "a"); err != nil || has {
+				t.Fatalf("a should be deleted: %v %v", has, err)
+			}
+
+			stats := db.Stats()
+			if stats.CacheHits != 2 || stats.CacheMisses != 4 || stats.CacheEntries != 0 {
+				t.Fatalf("unexpected cache stats: %+v", stats)
+			}
+		})
+	}
+
+	// 迁移后 value 的位置都变了，缓存需要清空
+	t.Run("migrate", func(t *testing.T) {
+		db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 40, KeysLen: 100, Options: Options{CacheBytes: 1 << 20}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		keys := 20
+		for i := 0; i < keys; i++ {
+			if err := db.SetString(ctx, fmt.Sprintf("key%d", i), "old"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.SetString(ctx, fmt.Sprintf("key%d", i), fmt.Sprint(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		check := func(t *testing.T) {
+			for i := 0; i < keys; i++ {
+				val, ok, err := db.GetString(ctx, fmt.Sprintf("key%d", i))
+				if err != nil || !ok || val != fmt.Sprint(i) {
+					t.Fatalf("get key%d error: %q %v %v", i, val, ok, err)
+				}
+			}
+		}
+		check(t)
+
+		if db.Stats().CacheEntries != keys {
+			t.Fatalf("unexpected cache entries: %d", db.Stats().CacheEntries)
+		}
+
+		if err := db.MigrateValue(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if db.Stats().CacheEntries != 0 {
+			t.Fatal("cache should be cleared after migrate")
+		}
+		check(t)
+
+		if err := db.MigrateValueOnline(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+}
+
+// 并发读写后，缓存中不能留下过期的结果
+func TestDiskvCacheConcurrent(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: t.TempDir(), MaxLen: 40, KeysLen: 100, Options: Options{CacheBytes: 1 << 20, CacheValues: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	keys := 10
+	wg := sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < 300; i++ {
+				key := fmt.Sprintf("key%d", i%keys)
+				var err error
+				switch {
+				case w == 0:
+					err = db.SetString(ctx, key, fmt.Sprint(i))
+				case w == 1 && i%5 == 0:
+					_, err = db.Del(ctx, key)
+				default:
+					_, _, err = db.Get(ctx, key)
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key%d", i)
+		cached, _, cok, err := db.lookup(ctx, key, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, ok, err := db.idx.getValueMeta(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != cok || (ok && (cached.offset != meta.offset || cached.seg != meta.seg)) {
+			t.Fatalf("stale cache of %s: %+v %v, expect %+v %v", key, cached, cok, meta, ok)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package diskv
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+const (
+	MigrateStageCopy    = "copy"    // 复制 idx 中有效的 value 到新的 db 文件
+	MigrateStageCatchUp = "catchup" // 回放复制期间写入的记录
+	MigrateStageSwap    = "swap"    // 切换文件
+	MigrateStageDone    = "done"
+)
+
+type MigrateProgress struct {
+	Stage string
+
+	Keys      int   // 已复制的 key 数量
+	TotalKeys int   // 开始迁移时 key 的数量
+	Bytes     int64 // 已写入新 db 文件的字节数
+}
+
+// 在线迁移 value 文件，效果同 MigrateValue，但迁移过程中不阻塞读写:
+// 1. 记录当前 db 文件的结尾，把 idx 中有效的 value 复制到新的 db 文件
+// 2. 回放复制期间写入旧 db 文件的记录，直到追上
+// 3. 短暂阻塞读写，回放剩余的记录后切换文件
+// ctx 取消时中止迁移并删除临时文件，onProgress 可为空
+func (d *Diskv) MigrateValueOnline(ctx context.Context, onProgress func(p MigrateProgress)) (err error) {
+	d.migrateMu.Lock()
+	defer d.migrateMu.Unlock()
+
+	progress := MigrateProgress{Stage: MigrateStageCopy}
+	report := func() {
+		if onProgress != nil {
+			onProgress(progress)
+		}
+	}
+
+	// 等待进行中的写入完成，保证 end 之前的记录都已经写入 idx
+	d.mu.Lock()
+	if err = d.checkWritable(); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	idxMeta, err := d.idx.getIdxMeta(ctx)
+	if err == nil {
+		progress.TotalKeys = d.idx.keyCount()
+	}
+	end, serr := d.dbstore.end(ctx)
+	d.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("get idx meta error: %s", err)
+	}
+	if serr != nil {
+		return fmt.Errorf("get db file size error: %s", serr)
+	}
+
+	toValueFile := d.dbFileName(d.dir) + ".tmp"
+	toValueIdxFile := d.idxFileName(d.dir) + ".tmp"
+	for _, file := range []string{toValueFile, toValueIdxFile} {
+		err = os.RemoveAll(file)
+		if err != nil {
+			return fmt.Errorf("remove old tmp file error: %s", err)
+		}
+	}
+
+	dbstore, err := d.getOrCreateDBStore(toValueFile)
+	if err != nil {
+		return fmt.Errorf("create db file error: %s", err)
+	}
+	dbstore.version = currentFormatVersion
+
+	toConfig := idxMeta.createConfig()
+	toConfig.Dir = d.dir
+	nidx, err := d.createIdx(ctx, toValueIdxFile, toConfig, currentFormatVersion)
+	if err != nil {
+		dbstore.close()
+		os.RemoveAll(toValueFile)
+		return fmt.Errorf("create idx file error: %s", err)
+	}
+	nidx.store = dbstore
+
+	defer func() {
+		if err != nil {
+			dbstore.close()
+			nidx.f.Close()
+			os.RemoveAll(toValueFile)
+			os.RemoveAll(toValueIdxFile)
+		}
+	}()
+
+	copyValue := func(item *valueItem) error {
+		key, err := convertKey(idxMeta.version, item.key)
+		if err != nil {
+			return err
+		}
+
+		valMeta, err := dbstore.write(ctx, &valueItem{key: key, value: item.value, expire: item.expire})
+		if err != nil {
+			return err
+		}
+		progress.Bytes += int64(valMeta.length)
+
+		return nidx.setValueMeta(ctx, valMeta)
+	}
+
+	report()
+
+	var ferr error
+	d.mu.RLock()
+	err = d.forEachItem(ctx, func(ctx context.Context, item *valueItem) (ok bool) {
+		ferr = ctx.Err()
+		if ferr == nil {
+			ferr = d.checkClosed()
+		}
+		if ferr == nil {
+			ferr = copyValue(item)
+		}
+		if ferr != nil {
+			return false
+		}
+
+		progress.Keys++
+		if progress.Keys%1000 == 0 {
+			report()
+		}
+		return true
+	})
+	d.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("forEach error: %s", err)
+	}
+	if ferr != nil {
+		err = ferr
+		return fmt.Errorf("forEach error in func: %w", err)
+	}
+
+	progress.Stage = MigrateStageCatchUp
+	report()
+
+	err = d.catchUp(ctx, end, func(rec *logRecord) error {
+		switch rec.op {
+		case opSet:
+			return copyValue(rec.item)
+		case opDel:
+			key, err := convertKey(idxMeta.version, rec.item.key)
+			if err != nil {
+				return err
+			}
+
+			_, err = dbstore.del(ctx, key)
+			if err != nil {
+				return err
+			}
+
+			_, err = nidx.delValueMeta(ctx, key)
+			return err
+		}
+		return nil
+	}, func() error {
+		progress.Stage = MigrateStageSwap
+		report()
+
+		err := d.swapFiles(ctx, dbstore, nidx)
+		if err != nil {
+			return fmt.Errorf("swap files error: %s", err)
+		}
+
+		err = d.openDB(ctx, d.dir)
+		if err != nil {
+			return fmt.Errorf("reopen db file error: %s", err)
+		}
+		d.rebuildSortedKeysLater() // 去掉有序 key 文件中已删除的 key
+
+		return d.loadStats(ctx)
+	})
+	if err != nil {
+		return err
+	}
+
+	progress.Stage = MigrateStageDone
+	report()
+
+	return nil
+}
+
+func (d *Diskv) migrateMarkFileName(dir string) string {
+	return filepath.Join(dir, "diskv.migrate")
+}
+
+// 用新的 db 和 idx 文件替换当前的文件
+// 替换前先落盘新文件并写入标记文件，若替换过程中崩溃，打开时由 finishSwap 继续完成替换
+func (d *Diskv) swapFiles(ctx context.Context, dbstore *dbsotre, nidx *idx) error {
+	err := dbstore.sync(ctx)
+	if err == nil {
+		err = nidx.sync(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("sync file error: %s", err)
+	}
+
+	dbstore.close()
+	nidx.f.Close()
+
+	markFile := d.migrateMarkFileName(d.dir)
+	f, err := os.Create(markFile)
+	if err != nil {
+		return fmt.Errorf("create migrate mark file error: %s", err)
+	}
+	err = f.Sync()
+	f.Close()
+	if err == nil {
+		err = syncDir(d.dir)
+	}
+	if err != nil {
+		return fmt.Errorf("sync migrate mark file error: %s", err)
+	}
+
+	err = migrateFile(ctx, dbstore.filePath, d.dbFileName(d.dir), false)
+	if err != nil {
+		return err
+	}
+
+	err = migrateFile(ctx, nidx.filePath, d.idxFileName(d.dir), false)
+	if err != nil {
+		return err
+	}
+
+	// 新的 db 文件只有一个 segment，旧的 segment 已经不再需要
+	err = removeSegments(d.dbFileName(d.dir))
+	if err != nil {
+		return err
+	}
+
+	// 替换和删除落盘之后才能删除标记，否则崩溃后旧的 segment 可能恢复
+	err = syncDir(d.dir)
+	if err != nil {
+		return fmt.Errorf("sync db dir error: %s", err)
+	}
+
+	return os.Remove(markFile)
+}
+
+// 继续完成中断的文件替换
+func (d *Diskv) finishSwap(ctx context.Context, dir string) error {
+	markFile := d.migrateMarkFileName(dir)
+	if _, err := os.Stat(markFile); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, file := range []string{d.dbFileName(dir), d.idxFileName(dir)} {
+		if _, err := os.Stat(file + ".tmp"); err != nil {
+			continue // 已经替换过了
+		}
+
+		err := os.Rename(file+".tmp", file)
+		if err != nil {
+			return fmt.Errorf("rename new file [%s] error: %s", file, err)
+		}
+	}
+
+	err := removeSegments(d.dbFileName(dir))
+	if err != nil {
+		return err
+	}
+
+	err = syncDir(dir)
+	if err != nil {
+		return fmt.Errorf("sync db dir error: %s", err)
+	}
+
+	return os.Remove(markFile)
+}
+
+type Stats struct {
+	Keys    int // 有效的 key 数量
+	KeysLen int // idx 预分配的 key 数量
+
+	LiveBytes    int64   // db 文件中有效记录的字节数
+	TotalBytes   int64   // db 文件的总字节数
+	GarbageBytes int64   // db 文件中无效记录 (被覆盖或删除) 的字节数
+	GarbageRatio float64 // 无效记录的占比
+
+	Segments    int   // db 文件的 segment 数量
+	Compactions int64 // 自动迁移 value 文件的次数
+
+	// 见 Options.CacheBytes，未开启缓存时均为 0
+	CacheHits    int64 // Get/Has 命中缓存的次数
+	CacheMisses  int64 // Get/Has 未命中缓存的次数
+	CacheBytes   int64 // 缓存当前占用的字节数
+	CacheEntries int   // 缓存的 key 数量
+}
+
+func (d *Diskv) Stats() Stats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	stats := Stats{
+		Keys:        d.idx.keyCount(),
+		LiveBytes:   atomic.LoadInt64(&d.liveBytes),
+		TotalBytes:  atomic.LoadInt64(&d.totalBytes),
+		Segments:    len(d.dbstore.segments()),
+		Compactions: atomic.LoadInt64(&d.compactions),
+	}
+
+	if idxMeta, err := d.idx.getIdxMeta(context.Background()); err == nil {
+		stats.KeysLen = idxMeta.keysLen
+	}
+
+	if d.cache != nil {
+		stats.CacheHits, stats.CacheMisses, stats.CacheBytes, stats.CacheEntries = d.cache.stats()
+	}
+
+	stats.GarbageBytes = stats.TotalBytes - stats.LiveBytes
+	if stats.TotalBytes > 0 {
+		stats.GarbageRatio = float64(stats.GarbageBytes) / float64(stats.TotalBytes)
+	}
+
+	return stats
+}
+
+// 根据 idx 重新统计有效记录的字节数
+func (d *Diskv) loadStats(ctx context.Context) error {
+	var live int64
+	err := d.idx.forEachSlot(ctx, func(slot int, valMeta *valueMeta) bool {
+		live += int64(valMeta.length)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	total, err := d.dbstore.size(ctx)
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&d.liveBytes, live)
+	atomic.StoreInt64(&d.totalBytes, total)
+
+	return nil
+}
+
+// 写入 written 字节，其中有效的为 live 字节，old 为被覆盖或删除的记录
+func (d *Diskv) addStats(written int, live int, old *valueMeta) {
+	if old != nil {
+		live -= old.length
+	}
+
+	atomic.AddInt64(&d.totalBytes, int64(written))
+	atomic.AddInt64(&d.liveBytes, int64(live))
+}
+
+// 无效数据超过阈值时，在后台在线迁移 value 文件
+func (d *Diskv) maybeCompact() {
+	if !d.needCompact() {
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&d.compacting, 0, 1) {
+		return
+	}
+
+	d.bg.Add(1)
+	go func() {
+		defer d.bg.Done()
+		defer atomic.StoreInt32(&d.compacting, 0)
+
+		err := d.MigrateValueOnline(context.Background(), nil)
+		if err == nil {
+			atomic.AddInt64(&d.compactions, 1)
+		}
+	}()
+}
+
+func (d *Diskv) needCompact() bool {
+	opts := d.opts
+	if opts.GarbageRatio <= 0 && opts.GarbageBytes <= 0 {
+		return false
+	}
+
+	total := atomic.LoadInt64(&d.totalBytes)
+	garbage := total - atomic.LoadInt64(&d.liveBytes)
+
+	if opts.GarbageBytes > 0 && garbage > opts.GarbageBytes {
+		return true
+	}
+
+	minBytes := opts.MinCompactBytes
+	if minBytes <= 0 {
+		minBytes = DefaultMinCompactBytes
+	}
+
+	return opts.GarbageRatio > 0 && total >= minBytes && float64(garbage) > opts.GarbageRatio*float64(total)
+}
@@ -0,0 +1,299 @@
+package diskv
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestMigrateValueOnline(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 1000, Options: Options{MaxLoad: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 300; i++ {
+			err = db.Set(ctx, fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d-%d", i, round)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	before, err := os.Stat(filepath.Join(dir, "diskv.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 迁移的同时写入和修改
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 300; i++ {
+			if err := db.Set(ctx, fmt.Sprintf("w%d", i), []byte(fmt.Sprintf("w%d", i))); err != nil {
+				t.Error(err)
+				return
+			}
+			if i%3 == 0 {
+				if err := db.Set(ctx, fmt.Sprintf("key%d", i), []byte("updated")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			if i%3 == 1 {
+				if _, err := db.Del(ctx, fmt.Sprintf("key%d", i)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	var stages []string
+	err = db.MigrateValueOnline(ctx, func(p MigrateProgress) {
+		if len(stages) == 0 || stages[len(stages)-1] != p.Stage {
+			stages = append(stages, p.Stage)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if stages[0] != MigrateStageCopy || stages[len(stages)-1] != MigrateStageDone {
+		t.Fatalf("unexpected stages: %v", stages)
+	}
+
+	check := func(t *testing.T, db *Diskv) {
+		for i := 0; i < 300; i++ {
+			val, ok, err := db.GetString(ctx, fmt.Sprintf("key%d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect := fmt.Sprintf("value%d-4", i)
+			if i%3 == 0 {
+				expect = "updated"
+			}
+			if i%3 == 1 {
+				if ok {
+					t.Fatalf("key%d should be deleted: %q", i, val)
+				}
+				continue
+			}
+			if !ok || val != expect {
+				t.Fatalf("get key%d error: %q %v", i, val, ok)
+			}
+
+			val, ok, err = db.GetString(ctx, fmt.Sprintf("w%d", i))
+			if err != nil || !ok || val != fmt.Sprintf("w%d", i) {
+				t.Fatalf("get w%d error: %q %v %v", i, val, ok, err)
+			}
+		}
+	}
+	check(t, db)
+
+	after, err := os.Stat(filepath.Join(dir, "diskv.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Fatalf("db file should be smaller after migrate: %d => %d", before.Size(), after.Size())
+	}
+
+	// 迁移后的 db 文件可以重建出相同的 idx
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(filepath.Join(dir, "diskv.idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenDBWithConfig(ctx, &OpenConfig{Dir: dir, RebuildIdx: true, Options: Options{MaxLoad: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(t, db)
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		err := db.MigrateValueOnline(ctx, nil)
+		if err == nil {
+			t.Fatal("should get canceled error")
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, "diskv.db.tmp")); !os.IsNotExist(err) {
+			t.Fatalf("tmp file should be removed: %v", err)
+		}
+
+		check(t, db)
+	})
+}
+
+func TestFinishSwap(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetString(ctx, "key", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 在新的目录中准备好迁移后的文件
+	ndir := t.TempDir()
+	ndb, err := CreateDB(ctx, &CreateConfig{Dir: ndir, MaxLen: 32, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ndb.SetString(ctx, "key", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ndb.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟 db 文件已经替换，idx 文件还未替换时崩溃
+	for _, name := range []string{"diskv.db", "diskv.idx"} {
+		data, err := os.ReadFile(filepath.Join(ndir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := filepath.Join(dir, name)
+		if name == "diskv.idx" {
+			target += ".tmp"
+		}
+		err = os.WriteFile(target, data, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.WriteFile(filepath.Join(dir, "diskv.migrate"), nil, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	val, ok, err := db.GetString(ctx, "key")
+	if err != nil || !ok || val != "new" {
+		t.Fatalf("get key error: %q %v %v", val, ok, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "diskv.migrate")); !os.IsNotExist(err) {
+		t.Fatalf("migrate mark file should be removed: %v", err)
+	}
+}
+
+func TestStatsAndAutoCompact(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 1000, Options: Options{MaxLoad: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 100; i++ {
+			err = db.Set(ctx, fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d-%d", i, round)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 50; i++ {
+		if _, err = db.Del(ctx, fmt.Sprintf("key%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := db.Stats()
+	info, err := os.Stat(filepath.Join(dir, "diskv.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 50 || stats.KeysLen != 1000 || stats.TotalBytes != info.Size() {
+		t.Fatalf("unexpected stats: %+v, file size %d", stats, info.Size())
+	}
+	if stats.GarbageRatio < 0.8 || stats.Compactions != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开后统计一致
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened := db.Stats(); reopened != stats {
+		t.Fatalf("stats mismatch after reopen: %+v != %+v", reopened, stats)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDBWithConfig(ctx, &OpenConfig{Dir: dir, Options: Options{MaxLoad: -1, GarbageRatio: 0.5, MinCompactBytes: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// 下一次写入触发后台迁移
+	err = db.Set(ctx, "trigger", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.bg.Wait()
+
+	stats = db.Stats()
+	if stats.Compactions != 1 || stats.Keys != 51 || stats.GarbageBytes != 0 {
+		t.Fatalf("unexpected stats after compaction: %+v", stats)
+	}
+
+	for i := 0; i < 100; i++ {
+		val, ok, err := db.Get(ctx, fmt.Sprintf("key%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 50 {
+			if ok {
+				t.Fatalf("key%d should be deleted, got %q", i, val)
+			}
+			continue
+		}
+		if !ok || string(val) != fmt.Sprintf("value%d-3", i) {
+			t.Fatalf("key%d: %q %v", i, val, ok)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package diskv
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// 并发压测的 idx 配置，均需在 -race 下通过
+var concurrentConfigs = []struct {
+	name   string
+	config CreateConfig
+}{
+	{"linear", CreateConfig{MaxLen: 48, KeysLen: 256}},
+	{"robinhood", CreateConfig{MaxLen: 48, KeysLen: 256, Probe: ProbeRobinHood}},
+	{"mmap", CreateConfig{MaxLen: 48, KeysLen: 256, Options: Options{Mmap: true}}},
+	{"hashedkeys", CreateConfig{MaxLen: 48, KeysLen: 256, Probe: ProbeRobinHood, HashedKeys: true}},
+}
+
+// 并发 Set 同一个 key: idx 中的值必须是 db 文件中该 key 的最后一条记录
+func TestConcurrentSetSameKey(t *testing.T) {
+	ctx := context.Background()
+
+	for _, c := range concurrentConfigs {
+		t.Run(c.name, func(t *testing.T) {
+			config := c.config
+			config.Dir = t.TempDir()
+			config.MaxLoad = -1
+
+			db, err := CreateDB(ctx, &config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			keys := []string{"a", "b", "c"}
+			wg := sync.WaitGroup{}
+			for w := 0; w < 8; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+
+					for i := 0; i < 100; i++ {
+						key := keys[(w+i)%len(keys)]
+
+						var err error
+						if i%10 == 9 {
+							_, err = db.Del(ctx, key)
+						} else {
+							err = db.SetString(ctx, key, fmt.Sprintf("%d-%d", w, i))
+						}
+						if err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			// db 文件中每个 key 的最后一条记录
+			last := map[string]*logRecord{}
+			err = db.dbstore.scan(ctx, logPos{}, func(rec *logRecord) bool {
+				if rec.err != nil {
+					t.Fatalf("unexpected record error: %s", rec.err)
+				}
+				last[rec.item.key] = rec
+				return true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, key := range keys {
+				val, ok, err := db.GetString(ctx, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				ekey, err := db.encodeKey(ctx, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rec := last[ekey]
+				if rec.op == opDel {
+					if ok {
+						t.Fatalf("%s should be deleted, got %q", key, val)
+					}
+					continue
+				}
+				if !ok || val != string(rec.item.value) {
+					t.Fatalf("get %s: %q %v, last record is %q", key, val, ok, rec.item.value)
+				}
+			}
+		})
+	}
+}
+
+// 每个 goroutine 读写自己的一组 key，与其他 goroutine 的 key 哈希到同一个位置
+// 其他 goroutine 的插入和删除会移动冲突链，自己的 key 必须一直能读到最后写入的值
+func TestConcurrentStress(t *testing.T) {
+	ctx := context.Background()
+
+	for _, c := range concurrentConfigs {
+		t.Run(c.name, func(t *testing.T) {
+			config := c.config
+			config.Dir = t.TempDir()
+
+			db, err := CreateDB(ctx, &config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { db.Close() }()
+
+			workers := 6
+			colliding := collidingKeys(t, db, workers*4)
+
+			models := make([]map[string]string, workers)
+			wg := sync.WaitGroup{}
+			for w := 0; w < workers; w++ {
+				models[w] = map[string]string{}
+
+				keys := []string{}
+				for i := w; i < len(colliding); i += workers {
+					keys = append(keys, colliding[i])
+				}
+				for i := 0; i < 8; i++ {
+					keys = append(keys, fmt.Sprintf("w%d-%d", w, i))
+				}
+
+				wg.Add(1)
+				go func(w int, keys []string) {
+					defer wg.Done()
+
+					r := rand.New(rand.NewSource(int64(w)))
+					model := models[w]
+					for i := 0; i < 300; i++ {
+						key := keys[r.Intn(len(keys))]
+
+						switch r.Intn(4) {
+						case 0:
+							if _, err := db.Del(ctx, key); err != nil {
+								t.Error(err)
+								return
+							}
+							delete(model, key)
+						case 1:
+							val := fmt.Sprintf("%d-%d", w, i)
+							if err := db.SetString(ctx, key, val); err != nil {
+								t.Error(err)
+								return
+							}
+							model[key] = val
+						default:
+							val, ok, err := db.GetString(ctx, key)
+							if err != nil {
+								t.Error(err)
+								return
+							}
+							expect, has := model[key]
+							if ok != has || val != expect {
+								t.Errorf("get %s: %q %v, expect %q %v", key, val, ok, expect, has)
+								return
+							}
+						}
+					}
+				}(w, keys)
+			}
+			wg.Wait()
+			db.bg.Wait()
+
+			total := 0
+			for _, model := range models {
+				total += len(model)
+				for key, expect := range model {
+					val, ok, err := db.GetString(ctx, key)
+					if err != nil || !ok || val != expect {
+						t.Fatalf("get %s: %q %v %v, expect %q", key, val, ok, err, expect)
+					}
+				}
+			}
+			if stats := db.Stats(); stats.Keys != total {
+				t.Fatalf("unexpected keys: %d, expect %d", stats.Keys, total)
+			}
+			if db.idx.meta.probe == ProbeRobinHood {
+				checkRobinHood(t, db)
+			}
+
+			// 重新打开后与内存中的结果一致
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			db, err = OpenDB(ctx, config.Dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats := db.Stats(); stats.Keys != total {
+				t.Fatalf("unexpected keys after reopen: %d, expect %d", stats.Keys, total)
+			}
+		})
+	}
+}
@@ -8,10 +8,13 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"hash/fnv"
+	"hash/crc32"
 )
 
 type Diskv struct {
@@ -24,8 +27,45 @@ type Diskv struct {
 
 	dbFile  string
 	dbstore *dbsotre
+
+	opts  Options
+	dirty int32         // 有未 fsync 的写入 (SyncPeriodic)
+	done  chan struct{} // 停止后台任务
+
+	migrateMu  sync.Mutex     // 各种迁移不能同时进行
+	growing    int32          // 正在自动扩容 idx
+	compacting int32          // 正在自动迁移 value 文件
+	bg         sync.WaitGroup // 后台任务
+
+	cache *cache // 见 Options.CacheBytes，为 nil 时不缓存
+
+	sorted *sortedKeys // 见 Options.SortedKeys，为 nil 时不维护有序的 key 文件
+
+	keyLocks [keyLockStripes]sync.Mutex // 见 lockKey
+	applyMu  sync.RWMutex               // 应用 batch 时持有读锁，创建快照时持有写锁，快照中不会只有 batch 的一部分
+
+	files uint64 // 打开 idx 和 db 文件的次数，迁移后重新打开时递增，见 Tx
+
+	reapMu   sync.Mutex      // 保护 reapKeys 和 reaping
+	reapKeys map[string]bool // 读到的已过期的 key，等待后台删除，见 reapLater
+	reaping  bool            // 后台正在删除 reapKeys
+
+	closed    int32    // 已关闭，之后的操作均返回 ErrClosed
+	unapplied int32    // 有写入 db 文件但没有应用到 idx 的 batch，关闭时不记录 checkpoint，见 saveCheckpoint
+	lock      *os.File // 目录锁，见 lockDir
+	readOnly  bool     // 只读打开，写操作均返回 ErrReadOnly
+
+	liveBytes   int64 // db 文件中有效记录的字节数
+	totalBytes  int64 // db 文件的总字节数
+	compactions int64 // 自动迁移 value 文件的次数
 }
 
+var (
+	ErrClosed    = errors.New("db is closed")
+	ErrReadOnly  = errors.New("db is read only")
+	ErrIndexFull = errors.New("idx is full") // idx 的所有 slot 都已被占用，见 Options.MaxLoad
+)
+
 var DefaultCreateConfig = CreateConfig{
 	Dir: ".",
 
@@ -36,6 +76,57 @@ var DefaultCreateConfig = CreateConfig{
 	KeysLen: 10000,
 }
 
+const (
+	DefaultSyncInterval    = time.Second
+	DefaultMaxLoad         = 0.75
+	DefaultMinCompactBytes = 1 << 20
+	DefaultTxRetries       = 10
+)
+
+type SyncMode int
+
+const (
+	SyncNone     SyncMode = iota // 不主动 fsync，由操作系统决定落盘时机
+	SyncAlways                   // 每次写入都 fsync，先 db 文件，后 idx 文件
+	SyncPeriodic                 // 每隔 SyncInterval 统一 fsync 一次 (group fsync)
+)
+
+// 运行时的配置，CreateDB 和 OpenDB 时均可指定
+type Options struct {
+	Sync         SyncMode      // 落盘策略
+	SyncInterval time.Duration // SyncPeriodic 的间隔，默认 DefaultSyncInterval
+
+	// idx 的负载 (key 数量 / KeysLen) 超过该值时自动在线扩容，默认 DefaultMaxLoad
+	// 小于 0 时不自动扩容，idx 写满后 Set 新的 key 返回 ErrIndexFull；否则写满时先同步扩容再写入
+	MaxLoad float64
+
+	// 无效数据 (被覆盖或删除的记录) 超过阈值时，自动在后台在线迁移 value 文件，均为 0 时不自动迁移
+	GarbageRatio    float64 // 无效数据占 db 文件的比例
+	GarbageBytes    int64   // 无效数据的字节数
+	MinCompactBytes int64   // 按比例触发时 db 文件的最小大小，避免小文件频繁迁移，默认 DefaultMinCompactBytes
+
+	SegmentSize int64 // 当前 db 文件超过该大小时切换到新的 segment 文件继续写入，0 为不切分
+
+	// 用 mmap 映射 idx 文件，查找 slot 时直接读内存，多个 Get/Has 可以并发读 idx
+	// 写入 slot 同样写到映射中，按落盘策略 msync；暂不支持 mmap 的平台仍按文件读写
+	Mmap bool
+
+	// Get/Has 读到的 valueMeta 的 LRU 缓存的字节数上限，0 为不缓存
+	// CacheValues 时同时缓存 value，value 也计入字节数
+	CacheBytes  int64
+	CacheValues bool
+
+	// 后台定期扫描 idx 并删除已过期的 key 的间隔，0 为不定期扫描 (读到已过期的 key 时仍会在后台删除)，见 SetWithTTL
+	ReapInterval time.Duration
+
+	// Update/View 遇到冲突时重新执行的次数，默认 DefaultTxRetries，小于 0 时不重试，直接返回 ErrConflict
+	TxRetries int
+
+	// 维护按 key 排序的 key 文件 (diskv.keys) 和内存中新写入的 key，Scan/Range 时直接定位到起点
+	// 不开启时 Scan/Range 每次遍历整个 idx 后排序，见 Range
+	SortedKeys bool
+}
+
 func init() {
 	root, err := os.UserHomeDir()
 	if err != nil {
@@ -58,14 +149,120 @@ type CreateConfig struct {
 	// OffsetSize   int // value 偏移量的长度 (用多长的数字表示 value 的偏移量)
 	MaxLen  int // block 的最大长度 (key + valueLen + offset 共用)
 	KeysLen int // 预分配多少 key 的空间
+
+	Hash     HashType  // idx 使用的哈希算法，默认 HashFNV1a
+	HashSeed uint32    // 哈希种子，0 为不使用种子
+	Probe    ProbeMode // idx 处理哈希冲突的方式，默认 ProbeLinear
+
+	// slot 中只存 key 的 64 位哈希值，key 的长度不再受 MaxLen 限制，查找时从 db 文件中读取记录校验 key
+	HashedKeys bool
+
+	Options
+}
+
+type OpenConfig struct {
+	Dir string
+
+	RebuildIdx bool                     // idx 文件不存在或损坏时，从 db 文件回放记录重建 idx
+	OnRebuild  func(res *RebuildResult) // 重建完成后的回调，可用于记录重建结果
+
+	// 以 O_RDONLY 打开 db 和 idx 文件，不会对文件做任何修改，多个只读的 db 可以同时打开同一个目录
+	// 只读时不做打开时的恢复 (替换中断的迁移、重建 idx、截断不完整的记录)，需要恢复时返回错误
+	ReadOnly bool
+
+	Options
 }
 
 func OpenDB(ctx context.Context, dir string) (*Diskv, error) {
+	return OpenDBWithConfig(ctx, &OpenConfig{Dir: dir})
+}
+
+// 只读打开，见 OpenConfig.ReadOnly
+func OpenReadOnly(ctx context.Context, dir string) (*Diskv, error) {
+	return OpenDBWithConfig(ctx, &OpenConfig{Dir: dir, ReadOnly: true})
+}
+
+func OpenDBWithConfig(ctx context.Context, config *OpenConfig) (db *Diskv, err error) {
+	if config == nil {
+		return nil, errors.New("open config is nil")
+	}
+
 	d := &Diskv{
-		dir: dir,
+		dir:      config.Dir,
+		opts:     config.Options,
+		readOnly: config.ReadOnly,
+	}
+	d.initCache()
+	d.initSortedKeys()
+
+	err = d.lockDir(config.Dir, !config.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			d.closeFiles()
+		}
+	}()
+
+	if config.ReadOnly {
+		err = d.openReadOnly(ctx, config.Dir)
+		if err != nil {
+			return nil, err
+		}
+		d.openSortedKeys(ctx)
+		return d, nil
+	}
+
+	// 上次迁移在替换文件的过程中中断
+	err = d.finishSwap(ctx, config.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("finish migrate error: %s", err)
+	}
+
+	if config.RebuildIdx {
+		ok, err := d.checkIdx(ctx, config.Dir)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			res, err := d.rebuildIdx(ctx, CreateConfig{Dir: config.Dir})
+			if err != nil {
+				return nil, fmt.Errorf("rebuild idx error: %s", err)
+			}
+
+			if config.OnRebuild != nil {
+				config.OnRebuild(res)
+			}
+		}
+	}
+
+	err = d.openDB(ctx, config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.fixOverflowSlots(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fix overflow slots error: %s", err)
+	}
+
+	err = d.recover(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("recover db error: %s", err)
+	}
+
+	err = d.loadStats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("load stats error: %s", err)
 	}
 
-	return d, d.openDB(ctx, dir)
+	d.openSortedKeys(ctx)
+	d.startSyncer()
+	d.startReaper()
+
+	return d, nil
 }
 
 func (d *Diskv) idxFileName(dir string) string {
@@ -85,51 +282,143 @@ func (d *Diskv) openDB(ctx context.Context, dir string) error {
 	if !ok {
 		return fmt.Errorf("idx file not found")
 	}
-	d.idx = idx
-	dbstore, err := d.getOrCreateDBStore(d.dbFileName(dir))
+
+	idxMeta, err := idx.getIdxMeta(ctx)
+	if err != nil {
+		idx.close()
+		return fmt.Errorf("read idx meta error: %s", err)
+	}
+
+	if d.opts.Mmap {
+		err = idx.mmap(ctx, d.readOnly)
+		if err != nil {
+			idx.close()
+			return err
+		}
+	}
+
+	dbFile := d.dbFileName(dir)
+	dbstore, err := d.getOrCreateDBStore(dbFile)
 	if err != nil {
+		idx.close()
 		return fmt.Errorf("open db file error: %s", err)
 	}
+	dbstore.version = idxMeta.version
+	dbstore.segmentSize = d.opts.SegmentSize
+
+	// 迁移后重新打开时，关闭旧的文件，缓存中的位置都已失效
+	// 旧的 idx 还有快照在读时，由最后一个快照关闭
+	if d.idx != nil {
+		d.idx.retire()
+	}
+	if d.cache != nil {
+		d.cache.clear()
+	}
+	if d.dbstore != nil {
+		d.dbstore.close()
+	}
+
+	idx.store = dbstore
+
+	d.idx = idx
+	d.idxFile = idxFile
 	d.dbstore = dbstore
+	d.dbFile = dbFile
+	d.files++
 	return nil
 }
 
-func CreateDB(ctx context.Context, config *CreateConfig) (*Diskv, error) {
+// 目录中已经有 diskv.idx 或 diskv.db 时不会覆盖，按 OpenConfig{RebuildIdx: true} 打开已有的 db，
+// 此时以已有 idx 的配置为准，config 中的 MaxLen、KeysLen 等不生效
+func CreateDB(ctx context.Context, config *CreateConfig) (db *Diskv, err error) {
 	if config == nil {
 		config = &DefaultCreateConfig
 	}
 
-	d := &Diskv{}
+	d := &Diskv{opts: config.Options}
 
-	err := os.MkdirAll(config.Dir, 0777)
+	// 目录中已经有 db 时直接打开，不覆盖已有的数据；idx 不存在或损坏时从 db 重建
+	for _, file := range []string{d.idxFileName(config.Dir), d.dbFileName(config.Dir)} {
+		if _, serr := os.Stat(file); serr == nil {
+			return OpenDBWithConfig(ctx, &OpenConfig{Dir: config.Dir, Options: config.Options, RebuildIdx: true})
+		}
+	}
+
+	d.initCache()
+	d.initSortedKeys()
+
+	err = os.MkdirAll(config.Dir, 0777)
 	if err != nil {
 		return nil, fmt.Errorf("create dir error: %s", err)
 	}
 
+	err = d.lockDir(config.Dir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			d.closeFiles()
+		}
+	}()
+
 	idxFile := d.idxFileName(config.Dir)
-	idx, err := d.createIdx(ctx, idxFile, *config)
+	idx, err := d.createIdx(ctx, idxFile, *config, currentFormatVersion)
 	if err != nil {
 		return nil, fmt.Errorf("create idx file error: %s", err)
 	}
+	d.idx = idx
+
+	if d.opts.Mmap {
+		err = idx.mmap(ctx, false)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	dbFile := d.dbFileName(config.Dir)
 	dbstore, err := d.getOrCreateDBStore(dbFile)
 	if err != nil {
 		return nil, fmt.Errorf("create db file error: %s", err)
 	}
+	dbstore.version = currentFormatVersion
+	dbstore.segmentSize = d.opts.SegmentSize
 
 	d.dir = config.Dir
 	d.dbFile = dbFile
 	d.dbstore = dbstore
 
-	d.idx = idx
+	idx.store = dbstore
 	d.idxFile = idxFile
 
+	if err = d.loadStats(ctx); err != nil {
+		return nil, fmt.Errorf("load stats error: %s", err)
+	}
+
+	d.openSortedKeys(ctx)
+	d.startSyncer()
+	d.startReaper()
+
 	return d, nil
 }
 
-func (d *Diskv) createIdx(ctx context.Context, idxFile string, config CreateConfig) (*idx, error) {
-	f, err := os.OpenFile(idxFile, os.O_CREATE|os.O_RDWR, 0666)
+func (d *Diskv) createIdx(ctx context.Context, idxFile string, config CreateConfig, version int) (*idx, error) {
+	if !config.Hash.valid() {
+		return nil, fmt.Errorf("unsupported hash: %s", config.Hash)
+	}
+	if !config.Probe.valid() {
+		return nil, fmt.Errorf("unsupported probe mode: %s", config.Probe)
+	}
+	if config.Probe == ProbeRobinHood && version < formatVersion2 { // v1 的 key 中可能有 ','
+		return nil, errors.New("robin hood idx needs format version 2, migrate value first")
+	}
+
+	// 迁移的临时文件可能是上次中断时留下的，清空后重新写
+	flag := os.O_CREATE | os.O_RDWR
+	if strings.HasSuffix(idxFile, ".tmp") {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(idxFile, flag, 0666)
 	if err != nil {
 		return nil, fmt.Errorf("create idx file error: %s", err)
 	}
@@ -143,8 +432,13 @@ func (d *Diskv) createIdx(ctx context.Context, idxFile string, config CreateConf
 		// keySize:      config.KeySize,
 		// valueLenSize: config.ValueLenSize,
 		// offsetSize:   config.OffsetSize,
-		maxLength: config.MaxLen,
-		keysLen:   config.KeysLen,
+		maxLength:  config.MaxLen,
+		keysLen:    config.KeysLen,
+		version:    version,
+		hash:       config.Hash,
+		hashSeed:   config.HashSeed,
+		probe:      config.Probe,
+		hashedKeys: config.HashedKeys,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("set idx meta error: %s", err)
@@ -154,7 +448,12 @@ func (d *Diskv) createIdx(ctx context.Context, idxFile string, config CreateConf
 }
 
 func (d *Diskv) getIdx(idxFile string) (*idx, bool, error) {
-	f, err := os.OpenFile(idxFile, os.O_RDWR, 0666)
+	flag := os.O_RDWR
+	if d.readOnly {
+		flag = os.O_RDONLY
+	}
+
+	f, err := os.OpenFile(idxFile, flag, 0666)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, false, nil
@@ -171,24 +470,57 @@ func (d *Diskv) getIdx(idxFile string) (*idx, bool, error) {
 	return idx, true, nil
 }
 
+// 打开 db 文件，有多个 segment 时，在最后一个 segment 上继续写入
 func (d *Diskv) getOrCreateDBStore(dbFile string) (*dbsotre, error) {
-	f, err := os.OpenFile(dbFile, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	ids, err := listSegments(dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	seg := 0
+	if len(ids) > 0 {
+		seg = ids[len(ids)-1]
+	} else {
+		ids = []int{0}
+	}
+
+	flag := os.O_CREATE | os.O_RDWR | os.O_APPEND
+	if d.readOnly {
+		flag = os.O_RDONLY
+	}
+
+	f, err := os.OpenFile(segmentFileName(dbFile, seg), flag, 0666)
 	if err != nil {
 		return nil, err
 	}
 
 	return &dbsotre{
 		f:        f,
+		seg:      seg,
+		ids:      ids,
+		segs:     map[int]*os.File{},
 		filePath: dbFile,
 	}, nil
 }
 
 type idx struct {
+	moves uint64 // Robin Hood 移动 slot 的次数，见 beginMove
+
 	meta *idxMeta
 
 	filePath string // 索引文件地址
-	mu       sync.Mutex
+	mu       sync.RWMutex
 	f        *os.File
+	mm       []byte // idx 文件的映射，见 Options.Mmap
+
+	wmu     sync.Mutex               // 修改 idx 时持有，冲突链可能跨多个区间，修改之间依次进行
+	stripes [idxStripes]sync.RWMutex // 按 slot 区间划分的读写锁，见 stripe
+
+	store *dbsotre // idx 指向的 db 文件，hashedKeys 时用于校验 key
+
+	views   map[*idxView]bool // 未释放的快照，修改 slot 前把原来的内容复制给它们，由 wmu 保护，见 Snapshot
+	retired bool              // 已被迁移替换，由最后一个释放的快照关闭，见 retire
+	view    *idxView          // 不为 nil 时是快照的只读视图，从 view 中读取 slot
 }
 
 type idxMeta struct {
@@ -198,18 +530,39 @@ type idxMeta struct {
 	maxLength int
 
 	keysLen int // 预分配的 key 的数量
+	version int // 文件格式版本，旧文件中没有记录，为 formatVersion1
+	count   int // 有效的 key 的数量，旧文件中没有记录，打开时重新统计
+	deleted int // 线性探测留下的 tombstone 数量，同样会拉长探测，计入负载，打开时重新统计
+
+	hash     HashType  // 哈希算法，旧文件中没有记录，为 HashFNV1a
+	hashSeed uint32    // 哈希种子，0 为不使用种子
+	probe    ProbeMode // 处理哈希冲突的方式，旧文件中没有记录，为 ProbeLinear
+
+	hashedKeys bool // slot 中只存 key 的哈希值，见 CreateConfig.HashedKeys
+
+	checkpoint logPos // db 文件中此前的记录都已落盘并应用到 idx，打开时从这里开始检查，见 recover
 }
 
 type valueMeta struct {
 	key string
 
+	seg    int // 所在的 segment，0 为 diskv.db
 	offset int
 	length int
+
+	dist int // 到哈希位置的距离，仅 ProbeRobinHood 使用
+
+	expire int64 // 过期时间 (unix 毫秒)，0 为不过期，见 SetWithTTL
+
+	// hashedKeys 时从 slot 中读出的 meta 只有 key 的哈希值，key 需要从 db 文件中读取
+	fp    uint64
+	noKey bool
 }
 
 type valueItem struct {
-	key   string
-	value []byte
+	key    string
+	value  []byte
+	expire int64 // 过期时间 (unix 毫秒)，0 为不过期
 }
 
 func (idx *idx) runWithFile(ctx context.Context, rf func(ctx context.Context, f *os.File) error) error {
@@ -227,6 +580,91 @@ func (idx *idx) runWithFile(ctx context.Context, rf func(ctx context.Context, f
 	return rf(ctx, idx.f)
 }
 
+func (idx *idx) sync(ctx context.Context) error {
+	return idx.runWithFileShared(ctx, func(ctx context.Context, f *os.File) error {
+		if idx.mm != nil {
+			if err := msync(idx.mm); err != nil {
+				return fmt.Errorf("msync idx file error: %s", err)
+			}
+		}
+
+		return f.Sync()
+	})
+}
+
+func (idx *idx) close() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	var err error
+	if idx.mm != nil {
+		err = munmap(idx.mm)
+		idx.mm = nil
+	}
+
+	if idx.f == nil {
+		return err
+	}
+
+	if cerr := idx.f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	idx.f = nil
+	return err
+}
+
+// 写入 idx 文件，在映射范围内时写到映射中，调用方需持有 idx.mu，写 slot 时还需持有 stripe 锁
+func (idx *idx) writeAt(f *os.File, data []byte, offset int64) error {
+	if idx.mm != nil && offset+int64(len(data)) <= int64(len(idx.mm)) {
+		copy(idx.mm[offset:], data)
+		return nil
+	}
+
+	_, err := f.WriteAt(data, offset)
+	return err
+}
+
+// 映射整个 idx 表，可写时先把文件扩展到表的大小，否则映射到表外的部分会 SIGBUS
+// 只读时只映射文件已有的部分，之后的 slot 仍按文件读取
+func (idx *idx) mmap(ctx context.Context, readOnly bool) error {
+	meta, err := idx.getIdxMeta(ctx)
+	if err != nil {
+		return err
+	}
+	end := int64(meta.getBlockStartOffset(meta.keysLen))
+
+	return idx.runWithFile(ctx, func(ctx context.Context, f *os.File) error {
+		if idx.mm != nil {
+			return nil
+		}
+
+		fileInfo, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("stat idx file error: %s", err)
+		}
+
+		size := fileInfo.Size()
+		if size < end {
+			if readOnly {
+				end = size
+			} else if err := f.Truncate(end); err != nil {
+				return fmt.Errorf("extend idx file error: %s", err)
+			}
+		}
+		if end <= 0 {
+			return nil
+		}
+
+		mm, err := mmapFile(f, int(end), !readOnly)
+		if err != nil {
+			return fmt.Errorf("mmap idx file error: %s", err)
+		}
+		idx.mm = mm
+
+		return nil
+	})
+}
+
 func (idx *idx) setIdxMeta(ctx context.Context, meta *idxMeta) (err error) {
 	metaBytes := formatIdxMeta(meta)
 
@@ -235,7 +673,7 @@ func (idx *idx) setIdxMeta(ctx context.Context, meta *idxMeta) (err error) {
 	}
 
 	err = idx.runWithFile(ctx, func(ctx context.Context, f *os.File) error {
-		_, err := f.WriteAt(metaBytes, 0)
+		err := idx.writeAt(f, metaBytes, 0)
 		if err != nil {
 			return fmt.Errorf("write idx file error: %s", err)
 		}
@@ -284,6 +722,105 @@ func (idx *idx) getIdxMeta(ctx context.Context) (*idxMeta, error) {
 	return idx.meta, nil
 }
 
+// 调整 key 的数量并写入文件头，调用方需持有 idx.wmu 和 idx.mu
+func (idx *idx) addCount(f *os.File, delta int) error {
+	idx.meta.count += delta
+
+	return idx.writeHeader(f)
+}
+
+// 把 idx.meta 写入文件头，调用方需持有 idx.wmu 和 idx.mu
+func (idx *idx) writeHeader(f *os.File) error {
+	metaBytes := formatIdxMeta(idx.meta)
+	if len(metaBytes) != dbMetaLen {
+		return fmt.Errorf("write idx file error of unexpected length: %d", len(metaBytes))
+	}
+
+	err := idx.writeAt(f, metaBytes, 0)
+	if err != nil {
+		return fmt.Errorf("write idx file error: %s", err)
+	}
+
+	return nil
+}
+
+func (idx *idx) setCount(ctx context.Context, count, deleted int) error {
+	idx.wmu.Lock()
+	defer idx.wmu.Unlock()
+
+	return idx.runWithFileShared(ctx, func(ctx context.Context, f *os.File) error {
+		idx.meta.deleted = deleted
+		return idx.addCount(f, count-idx.meta.count)
+	})
+}
+
+func (idx *idx) setCheckpoint(ctx context.Context, pos logPos) error {
+	idx.wmu.Lock()
+	defer idx.wmu.Unlock()
+
+	return idx.runWithFileShared(ctx, func(ctx context.Context, f *os.File) error {
+		idx.meta.checkpoint = pos
+		return idx.writeHeader(f)
+	})
+}
+
+// 当前的负载: (key 数量 + tombstone 数量) / 预分配的 key 数量
+func (idx *idx) load(ctx context.Context) (float64, error) {
+	meta, err := idx.getIdxMeta(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	idx.wmu.Lock()
+	used := idx.meta.count + idx.meta.deleted
+	idx.wmu.Unlock()
+
+	return float64(used) / float64(meta.keysLen), nil
+}
+
+// 新增 key 时检查 idx 是否还有空间，已有的 key 原地覆盖不需要新的 slot
+func (idx *idx) checkRoom(ctx context.Context, key string) error {
+	meta, err := idx.getIdxMeta(ctx)
+	if err != nil {
+		return err
+	}
+
+	if idx.keyCount() < meta.keysLen {
+		return nil
+	}
+
+	_, ok, err := idx.getValueMeta(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrIndexFull
+	}
+
+	return nil
+}
+
+// 有效的 key 的数量，需先调用过 getIdxMeta
+func (idx *idx) keyCount() int {
+	idx.wmu.Lock()
+	defer idx.wmu.Unlock()
+
+	return idx.meta.count
+}
+
+// 与当前 idx 相同的配置，用于迁移时创建新的 idx
+func (m *idxMeta) createConfig() CreateConfig {
+	return CreateConfig{
+		MaxLen:   m.maxLength,
+		KeysLen:  m.keysLen,
+		Hash:     m.hash,
+		HashSeed: m.hashSeed,
+		Probe:    m.probe,
+
+		HashedKeys: m.hashedKeys,
+	}
+}
+
 func (m *idxMeta) getKeyBlockLength() int {
 	// 2 个字节是分隔符, eg: 0000000longtest,000000,000000000
 	// return m.keySize + 1 + m.valueLenSize + 1 + m.offsetSize
@@ -299,19 +836,76 @@ const dbMetaLen = 64
 // // kv db meta seems like: [keysize:000015,lensize:000006,offsetsize:000010,keyslen:001000]
 // // value meta eg: 0000000longtest,000000,000000000
 // // 为了做对齐，最好要能被 8 整除，例如 32 byte,64 byte 等等，上述配置基本是最小配置了，15个字符的key长度，6个字符的value长度 (单个 value 最大能到 0.95MB)，9个字符的value偏移量(单个文件最大到 0.93GB)
+// v2 eg: [maxlength:000032,keyslen:010000,v:2,n:12,x:0000000000000000000], 不足 64 字节的部分用 x 补齐
+// 不使用默认的哈希算法时记录哈希算法和种子, eg: [maxlength:000032,keyslen:010000,v:2,h:2.9e3779b9,n:12,x:000]
+// ProbeRobinHood 在哈希算法后加 r, HashedKeys 加 k, eg: h:0r h:2rk.9e3779b9 (文件头的空间有限，不单独记录)
+// 关闭时记录 checkpoint 的 segment 和偏移量, eg: c:3.1048576，放不下时不记录，打开时检查整个 segment
+// 有 tombstone 时记录其数量, eg: d:37，放不下时不记录，打开时重新统计
 func formatIdxMeta(meta *idxMeta) []byte {
 	// idxStr := fmt.Sprintf("[keysize:%06d,lensize:%06d,offsetsize:%06d,keyslen:%06d]", meta.keySize, meta.valueLenSize, meta.offsetSize, meta.keysLen)
-	idxStr := fmt.Sprintf("[maxlength:%06d,keyslen:%06d,x:%028d]", meta.maxLength, meta.keysLen, 0)
-	return []byte(idxStr)
-}
-
-const (
-	maxlength = "maxlength"
-	keyslen   = "keyslen"
-)
-
+	idxStr := fmt.Sprintf("[maxlength:%06d,keyslen:%06d", meta.maxLength, meta.keysLen)
+	if meta.hashSeed != 0 && meta.keysLen > 999999 { // 文件头放不下时，去掉补齐的 0
+		idxStr = fmt.Sprintf("[maxlength:%d,keyslen:%d", meta.maxLength, meta.keysLen)
+	}
+	if meta.version > formatVersion1 {
+		idxStr += fmt.Sprintf(",%s:%d", metaversion, meta.version)
+	}
+	if meta.hash != HashFNV1a || meta.hashSeed != 0 || meta.probe != ProbeLinear || meta.hashedKeys {
+		idxStr += fmt.Sprintf(",%s:%d", hashtype, meta.hash)
+		if meta.probe == ProbeRobinHood {
+			idxStr += "r"
+		}
+		if meta.hashedKeys {
+			idxStr += "k"
+		}
+		if meta.hashSeed != 0 {
+			idxStr += fmt.Sprintf(".%x", meta.hashSeed)
+		}
+	}
+
+	countStr := fmt.Sprintf(",%s:", keycount)
+	countLen := len(fmt.Sprint(meta.count))
+
+	if meta.deleted > 0 {
+		del := fmt.Sprintf(",%s:%d", deletedcount, meta.deleted)
+		if len(idxStr)+len(del)+len(countStr)+countLen+len("]") <= dbMetaLen {
+			idxStr += del
+		}
+	}
+
+	if meta.checkpoint != (logPos{}) {
+		cp := fmt.Sprintf(",%s:%d.%d", checkpointpos, meta.checkpoint.seg, meta.checkpoint.offset)
+		if len(idxStr)+len(cp)+len(countStr)+countLen+len("]") <= dbMetaLen {
+			idxStr += cp
+		}
+	}
+
+	pad := dbMetaLen - len(idxStr) - len(countStr) - countLen - len("]")
+	if pad > 0 && pad < len(",x:") { // 放不下 x 时用 0 补齐 key 的数量
+		countLen += pad
+		pad = 0
+	}
+	idxStr += fmt.Sprintf("%s%0*d", countStr, countLen, meta.count)
+
+	if pad > 0 {
+		idxStr += ",x:" + strings.Repeat("0", pad-len(",x:"))
+	}
+
+	return []byte(idxStr + "]")
+}
+
+const (
+	maxlength     = "maxlength"
+	keyslen       = "keyslen"
+	metaversion   = "v"
+	keycount      = "n"
+	hashtype      = "h"
+	checkpointpos = "c"
+	deletedcount  = "d"
+)
+
 func parseIdxMeta(data []byte) (*idxMeta, error) {
-	idxMeta := &idxMeta{}
+	idxMeta := &idxMeta{version: formatVersion1}
 	idxMetaStr := string(data)
 	if idxMetaStr[0] != '[' || idxMetaStr[len(idxMetaStr)-1] != ']' {
 		return nil, errors.New("idx meta format error")
@@ -335,6 +929,52 @@ func parseIdxMeta(data []byte) (*idxMeta, error) {
 			if err != nil {
 				return nil, fmt.Errorf("idx meta format error: %s", err)
 			}
+		case keycount:
+			_, err = fmt.Sscanf(kv[1], "%d", &idxMeta.count)
+			if err != nil {
+				return nil, fmt.Errorf("idx meta format error: %s", err)
+			}
+		case deletedcount:
+			_, err = fmt.Sscanf(kv[1], "%d", &idxMeta.deleted)
+			if err != nil {
+				return nil, fmt.Errorf("idx meta format error: %s", err)
+			}
+		case checkpointpos:
+			_, err = fmt.Sscanf(kv[1], "%d.%d", &idxMeta.checkpoint.seg, &idxMeta.checkpoint.offset)
+			if err != nil {
+				return nil, fmt.Errorf("idx meta format error: %s", err)
+			}
+		case metaversion:
+			_, err = fmt.Sscanf(kv[1], "%d", &idxMeta.version)
+			if err != nil {
+				return nil, fmt.Errorf("idx meta format error: %s", err)
+			}
+			if idxMeta.version > currentFormatVersion {
+				return nil, fmt.Errorf("unsupported idx format version: %d", idxMeta.version)
+			}
+		case hashtype:
+			hash, seed, _ := strings.Cut(kv[1], ".")
+			if strings.HasSuffix(hash, "k") {
+				hash = strings.TrimSuffix(hash, "k")
+				idxMeta.hashedKeys = true
+			}
+			if strings.HasSuffix(hash, "r") {
+				hash = strings.TrimSuffix(hash, "r")
+				idxMeta.probe = ProbeRobinHood
+			}
+			_, err = fmt.Sscanf(hash, "%d", &idxMeta.hash)
+			if err != nil {
+				return nil, fmt.Errorf("idx meta format error: %s", err)
+			}
+			if !idxMeta.hash.valid() {
+				return nil, fmt.Errorf("unsupported idx hash: %s", idxMeta.hash)
+			}
+			if seed != "" {
+				_, err = fmt.Sscanf(seed, "%x", &idxMeta.hashSeed)
+				if err != nil {
+					return nil, fmt.Errorf("idx meta format error: %s", err)
+				}
+			}
 		default:
 
 		}
@@ -355,188 +995,366 @@ func isEmpty(data []byte) bool { // 认为第一个字符为 \x0 时就是空的
 	return false
 }
 
-// value meta eg: 0000000longtest,000000,000000000,
+// 被删除的 slot 只写入结尾的分隔符 '|' (key 中的 '|' 会被转义或拒绝，正常的 slot 不会以 '|' 开头)
+// 查找时需要越过被删除的 slot 继续往后找，写入时可以复用
+const tombstone = '|'
+
+func isTombstone(data []byte) bool {
+	return len(data) > 0 && data[0] == tombstone
+}
+
+type slotState int
+
+const (
+	slotEmpty   slotState = iota // 从未使用过，查找到这里就可以结束
+	slotUsed                     // 有效的 key
+	slotDeleted                  // 被删除的 key
+)
+
+// value meta eg: 0000000longtest,000000,000000000|
+// 不在第 0 个 segment 时带上 segment 编号, eg: longtest,12,3456,2|
+// ProbeRobinHood 时总是带上 segment 编号和距离, eg: longtest,12,3456,0,2|
+// hashedKeys 时 key 的位置为 key 的哈希值, eg: 9e3779b97f4a7c15,12,3456|
+// 有过期时间时在最后加上 e + 过期时间, eg: longtest,12,3456,e1700000000000|
+func (idx *idx) formatSlot(meta *valueMeta) []byte {
+	return formatSlot(meta, idx.meta)
+}
+
+// 检查 slot 是否放得下，Robin Hood 的距离在写入时才确定，按 0 计算
+func (idx *idx) checkSlotLen(meta *valueMeta) error {
+	if n := len(idx.formatSlot(meta)); n > idx.meta.getKeyBlockLength() {
+		if meta.expire > 0 {
+			return fmt.Errorf("value too long with expire, need %d, max is %d", n, idx.meta.getKeyBlockLength())
+		}
+		return fmt.Errorf("value too long, need %d, max is %d", n, idx.meta.getKeyBlockLength())
+	}
+	return nil
+}
+
+func formatSlot(meta *valueMeta, m *idxMeta) []byte {
+	if m.hashedKeys {
+		hashed := *meta
+		hashed.key = formatFingerprint(meta.fingerprint())
+		meta = &hashed
+	}
+
+	if m.probe == ProbeRobinHood {
+		return []byte(fmt.Sprintf("%s,%d,%d,%d,%d%s|", meta.key, meta.length, meta.offset, meta.seg, meta.dist, formatExpire(meta)))
+	}
+	return formatValueMeta(meta)
+}
+
 func formatValueMeta(meta *valueMeta) []byte {
-	return []byte(fmt.Sprintf("%s,%d,%d|", meta.key, meta.length, meta.offset))
+	if meta.seg > 0 {
+		return []byte(fmt.Sprintf("%s,%d,%d,%d%s|", meta.key, meta.length, meta.offset, meta.seg, formatExpire(meta)))
+	}
+	return []byte(fmt.Sprintf("%s,%d,%d%s|", meta.key, meta.length, meta.offset, formatExpire(meta)))
+}
+
+func formatExpire(meta *valueMeta) string {
+	if meta.expire <= 0 {
+		return ""
+	}
+	return ",e" + strconv.FormatInt(meta.expire, 10)
 }
 
-func parseValueMeta(data []byte) (meta *valueMeta, ok bool, err error) {
+func parseValueMeta(data []byte) (meta *valueMeta, state slotState, err error) {
 	if isEmpty(data) { // 空数据
-		return nil, false, nil
+		return nil, slotEmpty, nil
+	}
+
+	if isTombstone(data) {
+		return nil, slotDeleted, nil
+	}
+
+	i := bytes.IndexByte(data, '|')
+	if i < 0 {
+		return nil, slotEmpty, fmt.Errorf("parse value meta error: %s", data)
 	}
 
 	meta = &valueMeta{}
-	dataStr := string(data[0 : len(data)-1]) // 去除尾部分隔符 '|'
+	dataStr := string(data[:i]) // 去除尾部分隔符 '|' 及之后的填充
 
 	dataStrs := strings.Split(dataStr, ",")
 
-	if len(dataStrs) != 3 { // [key,valuelen,offset]
-		return nil, false, fmt.Errorf("parse value meta error: %s", dataStr)
+	if last := dataStrs[len(dataStrs)-1]; len(dataStrs) > 3 && strings.HasPrefix(last, "e") {
+		meta.expire, err = strconv.ParseInt(last[1:], 10, 64)
+		if err != nil || meta.expire <= 0 {
+			return nil, slotEmpty, fmt.Errorf("parse value meta error: bad expire %s", last)
+		}
+		dataStrs = dataStrs[:len(dataStrs)-1]
+	}
+
+	if len(dataStrs) < 3 || len(dataStrs) > 5 { // [key,valuelen,offset] 或 [key,valuelen,offset,seg] 或 [key,valuelen,offset,seg,dist]
+		return nil, slotEmpty, fmt.Errorf("parse value meta error: %s", dataStr)
 	}
 
 	key := dataStrs[0]
 
 	_, err = fmt.Sscanf(dataStrs[1], "%d", &meta.length)
 	if err != nil {
-		return nil, false, fmt.Errorf("parse value meta error: %s", err)
+		return nil, slotEmpty, fmt.Errorf("parse value meta error: %s", err)
 	}
 	_, err = fmt.Sscanf(dataStrs[2], "%d", &meta.offset)
 	if err != nil {
-		return nil, false, fmt.Errorf("parse value meta error: %s", err)
+		return nil, slotEmpty, fmt.Errorf("parse value meta error: %s", err)
+	}
+	if len(dataStrs) >= 4 {
+		_, err = fmt.Sscanf(dataStrs[3], "%d", &meta.seg)
+		if err != nil {
+			return nil, slotEmpty, fmt.Errorf("parse value meta error: %s", err)
+		}
+	}
+	if len(dataStrs) == 5 {
+		_, err = fmt.Sscanf(dataStrs[4], "%d", &meta.dist)
+		if err != nil {
+			return nil, slotEmpty, fmt.Errorf("parse value meta error: %s", err)
+		}
 	}
 
 	meta.key = key
 
-	return meta, true, nil
+	return meta, slotUsed, nil
 }
 
 func (idx *idx) delValueMeta(ctx context.Context, key string) (has bool, err error) {
-	slot, err := idx.hashKey(ctx, key)
-	if err != nil {
-		return false, fmt.Errorf("hash key error: %s", err)
+	old, err := idx.removeValueMeta(ctx, key)
+	return old != nil, err
+}
+
+// 删除 key 的索引，返回删除前的索引，不存在时为 nil
+// 删除的 slot 写入 tombstone，而不是清空，否则同一冲突链上之后的 key 会查找不到
+func (idx *idx) removeValueMeta(ctx context.Context, key string) (old *valueMeta, err error) {
+	idx.wmu.Lock()
+	defer idx.wmu.Unlock()
+
+	if idx.robinHood(ctx) {
+		return idx.rhRemoveValueMeta(ctx, key)
 	}
 
-	idxMeta, err := idx.getIdxMeta(ctx)
-	if err != nil {
-		return false, err
+	slot, old, ok, err := idx.findSlotMeta(ctx, key)
+	if err != nil || !ok {
+		return nil, err
 	}
 
-	for {
-		v, ok, err := idx.getValueOfSlot(ctx, slot)
-		if err != nil {
-			return false, err
-		}
+	return old, idx.removeLinearSlot(ctx, slot)
+}
 
-		if !ok {
-			return false, nil
-		}
+// 按位置删除 slot 中的 key
+func (idx *idx) removeSlot(ctx context.Context, slot int) error {
+	idx.wmu.Lock()
+	defer idx.wmu.Unlock()
 
-		if v.key != key {
-			slot++
-			continue
-		}
+	if idx.robinHood(ctx) {
+		return idx.rhRemoveSlot(ctx, slot)
+	}
 
-		size := idxMeta.getKeyBlockLength()
-		data := make([]byte, size)
+	return idx.removeLinearSlot(ctx, slot)
+}
 
-		return true, idx.runWithFile(ctx, func(ctx context.Context, f *os.File) error {
-			offset := int64(idx.meta.getBlockStartOffset(slot))
+// 在 slot 上留下 tombstone，调用方需持有 idx.wmu
+func (idx *idx) removeLinearSlot(ctx context.Context, slot int) error {
+	data := make([]byte, idx.meta.getKeyBlockLength())
+	data[0] = tombstone
 
-			_, err := f.WriteAt(data, offset)
-			if err != nil {
-				return fmt.Errorf("write idx file in del error: %s", err)
-			}
+	return idx.runWithFileShared(ctx, func(ctx context.Context, f *os.File) error {
+		err := idx.writeBlock(f, slot, data)
+		if err != nil {
+			return fmt.Errorf("write idx file in del error: %s", err)
+		}
 
-			return nil
-		})
-	}
+		idx.meta.deleted++
+		return idx.addCount(f, -1)
+	})
 }
 
 func (idx *idx) setValueMeta(ctx context.Context, valueMeta *valueMeta) error {
-	// idxMeta, err := idx.getIdxMeta(ctx)
-	// if err != nil {
-	// 	return err
-	// }
+	_, err := idx.replaceValueMeta(ctx, valueMeta)
+	return err
+}
+
+// 写入 key 的索引，返回写入前的索引，新增的 key 为 nil
+// 新增的 key 优先复用冲突链上第一个被删除的 slot
+func (idx *idx) replaceValueMeta(ctx context.Context, valueMeta *valueMeta) (old *valueMeta, err error) {
+	idx.wmu.Lock()
+	defer idx.wmu.Unlock()
+
+	if idx.robinHood(ctx) {
+		return idx.rhReplaceValueMeta(ctx, valueMeta)
+	}
+
+	valueMetaData := idx.formatSlot(valueMeta)
+	if len(valueMetaData) > idx.meta.getKeyBlockLength() {
+		return nil, fmt.Errorf("value too long, max is %d", idx.meta.getKeyBlockLength())
+	}
 
 	slot, err := idx.hashKey(ctx, valueMeta.key)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	keysLen := idx.meta.keysLen
+
+	free := -1 // 第一个被删除的 slot
+	reuse := false
+	probes := 0
 	for {
-		slotmeta, ok, err := idx.getValueOfSlot(ctx, slot)
-		if err != nil {
-			return err
+		if probes == keysLen { // 转了一圈，没有空的 slot
+			if free < 0 {
+				return nil, ErrIndexFull
+			}
+			slot, reuse = free, true
+			break
 		}
-		if ok && slotmeta.key != valueMeta.key { // 位置被占了，往下一个
-			slot++
-			continue
+		probes++
+
+		slotmeta, state, err := idx.getValueOfSlot(ctx, slot)
+		if err != nil {
+			return nil, err
 		}
 
-		offset := int64(idx.meta.getBlockStartOffset(slot))
+		if state == slotUsed {
+			match, err := idx.matchKey(ctx, slotmeta, valueMeta.key)
+			if err != nil {
+				return nil, err
+			}
+			if match { // 已有的 key，原地覆盖
+				old = slotmeta
+				break
+			}
+		}
 
-		valueMetaData := formatValueMeta(valueMeta)
-		if len(valueMetaData) > idx.meta.getKeyBlockLength() {
-			return fmt.Errorf("value too long, max is %d", idx.meta.getKeyBlockLength())
+		if state == slotDeleted && free < 0 {
+			free = slot
 		}
 
-		return idx.runWithFile(ctx, func(ctx context.Context, f *os.File) error {
-			_, err := f.WriteAt(valueMetaData, offset)
-			if err != nil {
-				return fmt.Errorf("write idx file error: %s", err)
+		if state == slotEmpty { // key 不存在
+			if free >= 0 {
+				slot, reuse = free, true
 			}
-			return nil
-		})
+			break
+		}
+
+		slot = (slot + 1) % keysLen // 位置被占了，往下一个，到结尾后回到第 0 个
 	}
 
+	// 被删除的 slot 可能比新数据长，补齐整个 block，覆盖 tombstone 之后的旧数据
+	data := make([]byte, idx.meta.getKeyBlockLength())
+	copy(data, valueMetaData)
+
+	return old, idx.runWithFileShared(ctx, func(ctx context.Context, f *os.File) error {
+		err := idx.writeBlock(f, slot, data)
+		if err != nil {
+			return fmt.Errorf("write idx file error: %s", err)
+		}
+
+		if old == nil { // 新增的 key
+			if reuse && idx.meta.deleted > 0 {
+				idx.meta.deleted--
+			}
+			return idx.addCount(f, 1)
+		}
+		return nil
+	})
 }
 
 func (idx *idx) getValueMeta(ctx context.Context, key string) (*valueMeta, bool, error) {
-	slot, err := idx.hashKey(ctx, key)
-	if err != nil {
+	_, meta, ok, err := idx.findSlotMeta(ctx, key)
+	if err != nil || !ok {
 		return nil, false, err
 	}
+	meta.key, meta.noKey = key, false // 查找时已校验过 key
 
-	return idx.getValueOfKeyFromSlot(ctx, key, slot)
+	return meta, true, nil
 }
 
-func (idx *idx) getValueOfKeyFromSlot(ctx context.Context, key string, slot int) (*valueMeta, bool, error) {
+// 查找 key 所在的 slot
+func (idx *idx) findSlot(ctx context.Context, key string) (slot int, ok bool, err error) {
+	slot, _, ok, err = idx.findSlotMeta(ctx, key)
+	return slot, ok, err
+}
 
-	for {
-		valueMeta, ok, err := idx.getValueOfSlot(ctx, slot)
+// 查找 key 所在的 slot，同时返回查找时读到的 slot 中的内容
+// 不持有 idx.wmu 时，slot 之后可能被其他 key 复用，不能按 slot 再读一次
+func (idx *idx) findSlotMeta(ctx context.Context, key string) (slot int, meta *valueMeta, ok bool, err error) {
+	if idx.robinHood(ctx) {
+		return idx.retryMiss(ctx, func() (int, *valueMeta, bool, error) {
+			return idx.rhFindSlot(ctx, key)
+		})
+	}
+
+	return idx.linearFindSlot(ctx, key)
+}
+
+// 线性探测查找 key，越过被删除的 slot，遇到空的 slot 时结束
+func (idx *idx) linearFindSlot(ctx context.Context, key string) (slot int, meta *valueMeta, ok bool, err error) {
+	slot, err = idx.hashKey(ctx, key)
+	if err != nil {
+		return 0, nil, false, fmt.Errorf("hash key error: %s", err)
+	}
+
+	keysLen := idx.meta.keysLen
+	for probes := 0; probes < keysLen; probes++ { // 最多转一圈
+		valueMeta, state, err := idx.getValueOfSlot(ctx, slot)
 		if err != nil {
-			return nil, false, err
+			return 0, nil, false, err
 		}
 
-		if !ok { // 空数据
-			return nil, false, nil
+		if state == slotEmpty { // 空数据
+			return 0, nil, false, nil
 		}
 
-		if valueMeta.key == key { // key 相同才是命中，否则顺延 slot
-			return valueMeta, true, nil
+		if state == slotUsed {
+			match, err := idx.matchKey(ctx, valueMeta, key)
+			if err != nil {
+				return 0, nil, false, err
+			}
+			if match { // key 相同才是命中，否则顺延 slot
+				return slot, valueMeta, true, nil
+			}
 		}
 
-		slot++
-		// if slot >= idxMeta.keysLen { // 暂时不设置最大 slot 限制，允许退化成遍历
-		// 	return nil, ErrKeyNotFound
-		// }
+		slot = (slot + 1) % keysLen
 	}
+
+	return 0, nil, false, nil
 }
 
-func (idx *idx) getValueOfSlot(ctx context.Context, slot int) (valueMeta *valueMeta, ok bool, err error) {
+func (idx *idx) getValueOfSlot(ctx context.Context, slot int) (valueMeta *valueMeta, state slotState, err error) {
 	idxMeta, err := idx.getIdxMeta(ctx)
 	if err != nil {
-		return nil, false, err
+		return nil, slotEmpty, err
 	}
 
-	startOffset := idxMeta.getBlockStartOffset(slot)
 	blockLen := idxMeta.getKeyBlockLength()
 
 	data := make([]byte, blockLen)
-	err = idx.runWithFile(ctx, func(ctx context.Context, f *os.File) error {
-		n, err := f.ReadAt(data, int64(startOffset))
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				return nil
-			}
-			return fmt.Errorf("read idx file error: %s", err)
-		}
+	n, err := idx.readBlock(ctx, slot, data)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, slotEmpty, fmt.Errorf("read idx file error: %s", err)
+	}
+	if err == nil && n != blockLen {
+		return nil, slotEmpty, fmt.Errorf("read idx file error of unexpected length: %d", n)
+	}
 
-		if n != blockLen {
-			return fmt.Errorf("read idx file error of unexpected length: %d", n)
-		}
-		return nil
-	})
+	return idx.parseSlot(idxMeta, data)
+}
+
+func (idx *idx) parseSlot(idxMeta *idxMeta, data []byte) (valueMeta *valueMeta, state slotState, err error) {
+	valueMeta, state, err = parseValueMeta(data)
 	if err != nil {
-		return nil, false, err
+		return nil, slotEmpty, fmt.Errorf("parse value meta error: %s", err)
 	}
 
-	valueMeta, ok, err = parseValueMeta(data)
-	if err != nil {
-		return nil, false, fmt.Errorf("parse value meta error: %s", err)
+	if state == slotUsed && idxMeta.hashedKeys {
+		valueMeta.fp, err = parseFingerprint(valueMeta.key)
+		if err != nil {
+			return nil, slotEmpty, fmt.Errorf("parse value meta error: %s", err)
+		}
+		valueMeta.key, valueMeta.noKey = "", true
 	}
 
-	return valueMeta, ok, nil
+	return valueMeta, state, nil
 }
 
 func (idx *idx) hashKey(ctx context.Context, key string) (int, error) {
@@ -546,159 +1364,583 @@ func (idx *idx) hashKey(ctx context.Context, key string) (int, error) {
 	}
 
 	keysLen := meta.keysLen
-	// 计算 key 的哈希值，使用 fnv1a 算法
-	h := fnv.New32a()
-	h.Write([]byte(key))
-	hashValue := int(h.Sum32())
-
-	hashValue = hashValue % keysLen
+	// 计算 key 的哈希值，使用 idx 文件头中记录的算法
+	hashValue := int(meta.hash.sum32([]byte(key), meta.hashSeed) % uint32(keysLen))
 
 	return hashValue, nil
 }
 
+// 遍历 idx 中所有的 key，hashedKeys 时从 db 文件中读取 key
 func (d *Diskv) forEachKey(ctx context.Context, f func(ctx context.Context, valMeta *valueMeta) (ok bool)) error {
-	idxMeta, err := d.idx.getIdxMeta(ctx)
+	var err error
+	ferr := d.idx.forEachSlot(ctx, func(slot int, valMeta *valueMeta) bool {
+		err = d.idx.resolveKey(ctx, valMeta)
+		if err != nil {
+			return false
+		}
+
+		return f(ctx, valMeta)
+	})
+	if ferr != nil {
+		return ferr
+	}
+
+	return err
+}
+
+// 遍历 idx 中所有有效的 slot，hashedKeys 时 valMeta 中没有 key
+func (idx *idx) forEachSlot(ctx context.Context, f func(slot int, valMeta *valueMeta) (ok bool)) error {
+	idxMeta, err := idx.getIdxMeta(ctx)
 	if err != nil {
 		return err
 	}
 
-	slot := 0
-	maxSlots := idxMeta.keysLen
-
-	for {
-		valMeta, ok, err := d.idx.getValueOfSlot(ctx, slot)
+	for slot := 0; slot < idxMeta.keysLen; slot++ {
+		valMeta, state, err := idx.getValueOfSlot(ctx, slot)
 		if err != nil {
 			return err
 		}
 
-		if !ok {
-			if slot >= maxSlots {
-				return nil // 结束
-			}
-
-			slot++
+		if state != slotUsed {
 			continue
 		}
 
-		if !f(ctx, valMeta) { // 用户主动退出
+		if !f(slot, valMeta) { // 用户主动退出
 			return nil
 		}
-		slot++
 	}
+
+	return nil
 }
 
 func (d *Diskv) ForEach(ctx context.Context, f func(ctx context.Context, key string, value []byte) (ok bool)) error {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	return d.forEach(ctx, f)
-}
+	if err := d.checkClosed(); err != nil {
+		return err
+	}
 
-func (d *Diskv) forEach(ctx context.Context, f func(ctx context.Context, key string, value []byte) (ok bool)) error {
 	var err error
-	d.forEachKey(ctx, func(ctx context.Context, valMeta *valueMeta) bool {
-		var val *valueItem
-		val, err = d.dbstore.read(ctx, valMeta)
+	ferr := d.forEach(ctx, func(ctx context.Context, key string, value []byte) bool {
+		key, err = d.decodeKey(ctx, key)
 		if err != nil {
 			return false
 		}
 
-		if !f(ctx, valMeta.key, val.value) { // 用户主动退出
-			return false
-		}
-
-		return true
+		return f(ctx, key, value)
 	})
+	if ferr != nil {
+		return ferr
+	}
+
 	return err
 }
 
-func (d *Diskv) Get(ctx context.Context, key string) (data []byte, ok bool, err error) {
+// 遍历所有有效的 key，只读取 idx，不读取 value (hashedKeys 时从 db 文件中只读取 key)，无序
+// 适合统计数量、列出 key 等不需要 value 的场景
+func (d *Diskv) ForEachKey(ctx context.Context, f func(ctx context.Context, key string) (ok bool)) error {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	meta, ok, err := d.idx.getValueMeta(ctx, key)
-	if err != nil {
-		return nil, false, err
+	if err := d.checkClosed(); err != nil {
+		return err
 	}
 
-	if !ok {
-		return nil, false, nil
-	}
+	now := timeNow()
 
-	val, err := d.dbstore.read(ctx, meta)
-	if err != nil {
-		return nil, false, err
+	var err error
+	ferr := d.forEachKey(ctx, func(ctx context.Context, valMeta *valueMeta) bool {
+		if valMeta.expired(now) {
+			return true
+		}
+
+		var key string
+		key, err = d.decodeKey(ctx, valMeta.key)
+		if err != nil {
+			return false
+		}
+
+		return f(ctx, key)
+	})
+	if ferr != nil {
+		return ferr
 	}
 
-	return val.value, true, nil
+	return err
 }
 
-func (d *Diskv) GetString(ctx context.Context, key string) (data string, ok bool, err error) {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
-
-	val, ok, err := d.Get(ctx, key)
+// 返回所有有效的 key，无序，见 ForEachKey
+func (d *Diskv) Keys(ctx context.Context) ([]string, error) {
+	keys := []string{}
+	err := d.ForEachKey(ctx, func(ctx context.Context, key string) bool {
+		keys = append(keys, key)
+		return true
+	})
 	if err != nil {
-		return "", false, err
+		return nil, err
 	}
 
-	return string(val), ok, nil
+	return keys, nil
 }
 
-func (d *Diskv) Set(ctx context.Context, key string, val []byte) error {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
-
-	valMeta, err := d.dbstore.write(ctx, &valueItem{key: key, value: val})
+// 把 key 转换为文件中存储的形式，见 encodeKey
+func (d *Diskv) encodeKey(ctx context.Context, key string) (string, error) {
+	idxMeta, err := d.idx.getIdxMeta(ctx)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return d.idx.setValueMeta(ctx, valMeta)
+	return encodeKey(idxMeta.version, key)
 }
 
-func (d *Diskv) SetString(ctx context.Context, key string, val string) error {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
+func (d *Diskv) decodeKey(ctx context.Context, key string) (string, error) {
+	idxMeta, err := d.idx.getIdxMeta(ctx)
+	if err != nil {
+		return "", err
+	}
 
-	return d.Set(ctx, key, []byte(val))
+	return decodeKey(idxMeta.version, key)
 }
 
-func (d *Diskv) Has(ctx context.Context, key string) (has bool, err error) {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
-
-	_, has, err = d.idx.getValueMeta(ctx, key)
-	return has, err
+func (d *Diskv) forEach(ctx context.Context, f func(ctx context.Context, key string, value []byte) (ok bool)) error {
+	return d.forEachItem(ctx, func(ctx context.Context, item *valueItem) bool {
+		return f(ctx, item.key, item.value)
+	})
 }
 
-// ok = true => 值存在并已删除
+// 遍历有效的记录，跳过已过期的 key，item 中带有过期时间
+func (d *Diskv) forEachItem(ctx context.Context, f func(ctx context.Context, item *valueItem) (ok bool)) error {
+	now := timeNow()
+
+	var err error
+	ferr := d.forEachKey(ctx, func(ctx context.Context, valMeta *valueMeta) bool {
+		if valMeta.expired(now) {
+			return true
+		}
+
+		var val *valueItem
+		val, err = d.dbstore.read(ctx, valMeta)
+		if err != nil {
+			return false
+		}
+
+		if !f(ctx, val) { // 用户主动退出
+			return false
+		}
+
+		return true
+	})
+	if ferr != nil {
+		return ferr
+	}
+
+	return err
+}
+
+func (d *Diskv) Get(ctx context.Context, key string) (data []byte, ok bool, err error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if err := d.checkClosed(); err != nil {
+		return nil, false, err
+	}
+
+	key, err = d.encodeKey(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	_, value, ok, err := d.lookup(ctx, key, true)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	return value, true, nil
+}
+
+func (d *Diskv) GetString(ctx context.Context, key string) (data string, ok bool, err error) {
+	val, ok, err := d.Get(ctx, key)
+	if err != nil {
+		return "", false, err
+	}
+
+	return string(val), ok, nil
+}
+
+func (d *Diskv) Set(ctx context.Context, key string, val []byte) error {
+	return d.setWithExpire(ctx, key, val, 0)
+}
+
+func (d *Diskv) setWithExpire(ctx context.Context, key string, val []byte, expire int64) error {
+	err := d.set(ctx, key, val, expire)
+	if errors.Is(err, ErrIndexFull) && d.opts.MaxLoad >= 0 {
+		// idx 写满时同步扩容后重试
+		err = d.growIdx(ctx)
+		if err != nil {
+			return fmt.Errorf("grow idx error: %w", err)
+		}
+
+		return d.set(ctx, key, val, expire)
+	}
+
+	return err
+}
+
+func (d *Diskv) set(ctx context.Context, key string, val []byte, expire int64) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+
+	key, err := d.encodeKey(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	// 同一个 key 的写入依次进行，后写入 db 文件的记录也后写入 idx
+	defer d.lockKey(key)()
+
+	// idx 已满时不写 db 文件，否则重建 idx 时会出现写入失败的 key
+	err = d.idx.checkRoom(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	// 先写 db 文件，再写 idx 文件，保证 idx 不会指向未写入的数据
+	// slot 放不下时 (过期时间会占用 slot 的空间) 不写 db 文件
+	valMeta, err := d.dbstore.writeChecked(ctx, &valueItem{key: key, value: val, expire: expire}, d.idx.checkSlotLen)
+	if err != nil {
+		return err
+	}
+
+	err = d.syncFile(ctx, d.dbstore)
+	if err != nil {
+		return err
+	}
+
+	old, err := d.idx.replaceValueMeta(ctx, valMeta)
+	d.invalidateCache(key)
+	if err != nil {
+		return err
+	}
+	d.addSortedKey(key)
+
+	err = d.syncFile(ctx, d.idx)
+	if err != nil {
+		return err
+	}
+
+	d.addStats(valMeta.length, valMeta.length, old)
+	d.maybeGrowIdx(ctx)
+	d.maybeCompact()
+
+	return nil
+}
+
+func (d *Diskv) SetString(ctx context.Context, key string, val string) error {
+	return d.Set(ctx, key, []byte(val))
+}
+
+func (d *Diskv) Has(ctx context.Context, key string) (has bool, err error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if err := d.checkClosed(); err != nil {
+		return false, err
+	}
+
+	key, err = d.encodeKey(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	_, _, has, err = d.lookup(ctx, key, false)
+	return has, err
+}
+
+// ok = true => 值存在并已删除
 // ok = false => 值不存在
 func (d *Diskv) Del(ctx context.Context, key string) (ok bool, err error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	// db file 记录删除
-	err = d.dbstore.del(ctx, key)
+	if err := d.checkWritable(); err != nil {
+		return false, err
+	}
+
+	key, err = d.encodeKey(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	defer d.lockKey(key)()
+
+	old, err := d.del(ctx, key)
 	if err != nil {
 		return false, err
 	}
 
-	return d.idx.delValueMeta(ctx, key) // 只删索引，不删值
+	return old != nil && !old.expired(timeNow()), nil
+}
+
+// 删除 key，返回删除前的索引，调用方需持有 d.mu 的读锁和 key 的锁
+func (d *Diskv) del(ctx context.Context, key string) (old *valueMeta, err error) {
+	// db file 记录删除
+	n, err := d.dbstore.del(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.syncFile(ctx, d.dbstore)
+	if err != nil {
+		return nil, err
+	}
+
+	old, err = d.idx.removeValueMeta(ctx, key) // 只删索引，不删值
+	d.invalidateCache(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.syncFile(ctx, d.idx)
+	if err != nil {
+		return nil, err
+	}
+
+	d.addStats(n, 0, old)
+	d.maybeCompact()
+
+	return old, nil
+}
+
+type syncer interface {
+	sync(ctx context.Context) error
+}
+
+// 按照落盘策略处理一次写入
+func (d *Diskv) syncFile(ctx context.Context, s syncer) error {
+	switch d.opts.Sync {
+	case SyncAlways:
+		err := s.sync(ctx)
+		if err != nil {
+			return fmt.Errorf("sync file error: %s", err)
+		}
+	case SyncPeriodic:
+		atomic.StoreInt32(&d.dirty, 1)
+	}
+
+	return nil
+}
+
+// SyncPeriodic 时，后台定期 fsync
+func (d *Diskv) startSyncer() {
+	if d.opts.Sync != SyncPeriodic {
+		return
+	}
+
+	interval := d.opts.SyncInterval
+	if interval <= 0 {
+		interval = DefaultSyncInterval
+	}
+
+	if d.done == nil {
+		d.done = make(chan struct{})
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-d.done:
+				return
+			case <-ticker.C:
+				d.syncDirty(context.Background())
+			}
+		}
+	}()
+}
+
+func (d *Diskv) syncDirty(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&d.dirty, 1, 0) {
+		return nil
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.checkClosed() != nil {
+		return nil
+	}
+
+	err := d.syncAll(ctx)
+	if err != nil {
+		atomic.StoreInt32(&d.dirty, 1) // 下次重试
+		return err
+	}
+
+	return nil
+}
+
+// 先 db 文件，后 idx 文件
+func (d *Diskv) syncAll(ctx context.Context) error {
+	err := d.dbstore.sync(ctx)
+	if err == nil {
+		err = d.idx.sync(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("sync file error: %s", err)
+	}
+
+	return nil
+}
+
+// 把 db 和 idx 文件落盘，与落盘策略无关
+func (d *Diskv) Sync(ctx context.Context) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if err := d.checkClosed(); err != nil {
+		return err
+	}
+
+	if d.readOnly { // 没有需要落盘的数据
+		return nil
+	}
+
+	atomic.StoreInt32(&d.dirty, 0)
+
+	return d.syncAll(ctx)
+}
+
+// 关闭 db: 停止后台任务，落盘并关闭所有文件，之后的操作均返回 ErrClosed
+func (d *Diskv) Close() error {
+	if !atomic.CompareAndSwapInt32(&d.closed, 0, 1) {
+		return ErrClosed
+	}
+
+	if d.done != nil {
+		close(d.done)
+	}
+
+	// 等待进行中的操作完成，之后的操作都会看到 closed，不会再启动后台任务
+	d.mu.Lock()
+	d.mu.Unlock()
+
+	d.bg.Wait()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var err error
+	if !d.readOnly {
+		err = d.syncAll(context.Background())
+		if err == nil {
+			err = d.saveCheckpoint(context.Background())
+		}
+		d.closeSortedKeys(context.Background()) // 失败时下次打开重新生成
+	}
+
+	if cerr := d.closeFiles(); cerr != nil && err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// 关闭 db 和 idx 文件，并释放目录锁
+func (d *Diskv) closeFiles() (err error) {
+	if d.dbstore != nil {
+		if cerr := d.dbstore.close(); cerr != nil && err == nil {
+			err = fmt.Errorf("close db file error: %s", cerr)
+		}
+	}
+	if d.idx != nil {
+		if cerr := d.idx.close(); cerr != nil && err == nil {
+			err = fmt.Errorf("close idx file error: %s", cerr)
+		}
+	}
+	if d.sorted != nil && d.sorted.f != nil {
+		d.sorted.f.Close()
+		d.sorted.f = nil
+	}
+	if cerr := d.unlockDir(); cerr != nil && err == nil {
+		err = fmt.Errorf("unlock db dir error: %s", cerr)
+	}
+
+	return err
+}
+
+// 调用方需持有 d.mu
+func (d *Diskv) checkClosed() error {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		return ErrClosed
+	}
+
+	return nil
+}
+
+// 写操作前检查，调用方需持有 d.mu
+func (d *Diskv) checkWritable() error {
+	if err := d.checkClosed(); err != nil {
+		return err
+	}
+
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	return nil
+}
+
+// 只读打开: 不修改任何文件，需要恢复时返回错误
+func (d *Diskv) openReadOnly(ctx context.Context, dir string) error {
+	if _, err := os.Stat(d.migrateMarkFileName(dir)); err == nil {
+		return errors.New("unfinished migration found, open it in read-write mode first")
+	}
+
+	err := d.openDB(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	n, err := d.idx.overflowSlots(ctx)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errors.New("idx written by an old version found, open it in read-write mode first")
+	}
+
+	return d.loadStats(ctx)
 }
 
 type dbsotre struct {
-	filePath string
-	mu       sync.Mutex
-	f        *os.File
+	version int // 与 idx 的格式版本一致
+
+	filePath    string // 第 0 个 segment 的文件地址，之后的 segment 见 segmentFileName
+	segmentSize int64  // 当前 segment 超过该大小时切换到新的 segment，0 为不切分
+
+	mu   sync.RWMutex     // 追加和切换 segment 时持有写锁，读取记录时只在取文件时持有读锁
+	seg  int              // 当前写入的 segment
+	f    *os.File         // 当前写入的 segment 文件
+	ids  []int            // 所有的 segment，从小到大
+	segs map[int]*os.File // 之前的 segment，只读，按需打开
+
+	applying int // 已写入但还没应用到 idx 的 batch 数量，不为 0 时不切换 segment，见 redoBatches
 }
 
+// 在当前写入的 segment 文件上执行
 func (d *dbsotre) runWithFile(ctx context.Context, rf func(ctx context.Context, f *os.File) error) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
 	if d.f == nil {
-		f, err := os.OpenFile(d.filePath, os.O_RDONLY|os.O_APPEND, 0666)
+		f, err := os.OpenFile(segmentFileName(d.filePath, d.seg), os.O_RDONLY|os.O_APPEND, 0666)
 		if err != nil {
 			return err
 		}
@@ -708,16 +1950,99 @@ func (d *dbsotre) runWithFile(ctx context.Context, rf func(ctx context.Context,
 	return rf(ctx, d.f)
 }
 
+// 所有 segment 的总大小
+func (d *dbsotre) size(ctx context.Context) (size int64, err error) {
+	sizes, err := d.segmentSizes(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, s := range sizes {
+		size += s
+	}
+
+	return size, nil
+}
+
+// 当前写入的位置
+func (d *dbsotre) end(ctx context.Context) (pos logPos, err error) {
+	err = d.runWithFile(ctx, func(ctx context.Context, f *os.File) error {
+		fileInfo, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		pos = logPos{seg: d.seg, offset: fileInfo.Size()}
+		return nil
+	})
+
+	return pos, err
+}
+
+func (d *dbsotre) sync(ctx context.Context) error {
+	return d.runWithFile(ctx, func(ctx context.Context, f *os.File) error {
+		return f.Sync()
+	})
+}
+
 func (d *dbsotre) read(ctx context.Context, m *valueMeta) (*valueItem, error) {
-	data := make([]byte, m.length)
+	data, err := d.readAt(ctx, m.seg, m.offset, m.length)
+	if err != nil {
+		return nil, err
+	}
 
-	err := d.runWithFile(ctx, func(ctx context.Context, f *os.File) error {
-		n, err := f.ReadAt(data, int64(m.offset))
+	_, val, err := decodeValue(m.key, data)
+	return val, err
+}
+
+// 读取 m 指向的记录中的 key
+func (d *dbsotre) readKey(ctx context.Context, m *valueMeta) (string, error) {
+	data, err := d.readAt(ctx, m.seg, m.offset, m.length)
+	if err != nil {
+		return "", err
+	}
+
+	_, val, err := decodeRecord(data)
+	if err != nil {
+		return "", err
+	}
+
+	return val.key, nil
+}
+
+// 记录头部 (eg: _set:1a2b3c4d:5) 的最大长度
+const maxRecordHeadLen = 40
+
+// 只读取记录的头部，检查 m 指向的记录的 key 是否为 key
+func (d *dbsotre) hasKey(ctx context.Context, m *valueMeta, key string) (bool, error) {
+	n := maxRecordHeadLen + len(key) + 2 // [key]
+	if n > m.length {
+		n = m.length
+	}
+
+	data, err := d.readAt(ctx, m.seg, m.offset, n)
+	if err != nil {
+		return false, err
+	}
+
+	i := bytes.IndexByte(data, '[')
+	if i < 0 || i+len(key)+2 > len(data) {
+		return false, nil
+	}
+
+	return string(data[i+1:i+1+len(key)]) == key && data[i+1+len(key)] == ']', nil
+}
+
+func (d *dbsotre) readAt(ctx context.Context, seg int, offset int, length int) ([]byte, error) {
+	data := make([]byte, length)
+
+	err := d.runWithSegment(ctx, seg, func(ctx context.Context, f *os.File) error {
+		n, err := f.ReadAt(data, int64(offset))
 		if err != nil {
 			return err
 		}
 
-		if n != m.length {
+		if n != length {
 			return errors.New("read data error, value length not match")
 		}
 		return nil
@@ -726,8 +2051,7 @@ func (d *dbsotre) read(ctx context.Context, m *valueMeta) (*valueItem, error) {
 		return nil, err
 	}
 
-	_, val, err := decodeValue(m.key, data)
-	return val, err
+	return data, nil
 }
 
 const (
@@ -737,29 +2061,51 @@ const (
 	splitOp = '\n'
 )
 
-func (d *dbsotre) del(ctx context.Context, key string) error {
-	return d.runWithFile(ctx, func(ctx context.Context, f *os.File) error {
-		_, err := f.Write(encodeValueItem(opDel, &valueItem{key: key}))
+// 返回写入的字节数
+func (d *dbsotre) del(ctx context.Context, key string) (n int, err error) {
+	err = d.runWithFile(ctx, func(ctx context.Context, f *os.File) error {
+		f, _, err := d.rollIfFull(f)
+		if err != nil {
+			return err
+		}
+
+		n, err = f.Write(encodeValueItem(d.version, opDel, &valueItem{key: key}))
 		return err
 	})
+
+	return n, err
 }
 
 func (d *dbsotre) write(ctx context.Context, valueItem *valueItem) (*valueMeta, error) {
+	return d.writeChecked(ctx, valueItem, nil)
+}
+
+// 确定写入位置后先调用 check，返回错误时不写入
+func (d *dbsotre) writeChecked(ctx context.Context, valueItem *valueItem, check func(meta *valueMeta) error) (*valueMeta, error) {
 	meta := &valueMeta{
-		key: valueItem.key,
+		key:    valueItem.key,
+		expire: valueItem.expire,
 	}
 
 	err := d.runWithFile(ctx, func(ctx context.Context, f *os.File) error {
-		fileInfo, err := f.Stat()
+		f, size, err := d.rollIfFull(f)
 		if err != nil {
 			return err
 		}
 
-		meta.offset = int(fileInfo.Size())
+		meta.seg = d.seg
+		meta.offset = int(size)
 
-		val := encodeValueItem(opSet, valueItem)
+		val := encodeValueItem(d.version, opSet, valueItem)
 		meta.length = len(val)
 
+		if check != nil {
+			err = check(meta)
+			if err != nil {
+				return err
+			}
+		}
+
 		_, err = f.Write(val)
 		if err != nil {
 			return err
@@ -775,7 +2121,20 @@ func (d *dbsotre) write(ctx context.Context, valueItem *valueItem) (*valueMeta,
 }
 
 func decodeValue(key string, data []byte) (op string, val *valueItem, err error) {
+	op, val, err = decodeRecord(data)
+	if err != nil {
+		return "", nil, err
+	}
 
+	if val.key != key {
+		return "", nil, errors.New("read data error, key not match")
+	}
+
+	return op, val, nil
+}
+
+// 解析一条完整的记录, eg: _set[key]value\n
+func decodeRecord(data []byte) (op string, val *valueItem, err error) {
 	val = &valueItem{}
 	if len(data) < 5 {
 		return "", nil, errors.New("read data error, data length not match")
@@ -785,7 +2144,17 @@ func decodeValue(key string, data []byte) (op string, val *valueItem, err error)
 		return "", nil, errors.New("read data error, split length not match")
 	}
 
-	op = string(vals[0])
+	head, err := parseRecordHead(string(vals[0]))
+	if err != nil {
+		return "", nil, err
+	}
+
+	op = head.op
+	if head.checksum { // 带校验和的记录, eg: _set:1a2b3c4d:5[key]value\n
+		if data[len(data)-1] != splitOp || checksum(checksumOp(op, head.expire), data[len(vals[0]):len(data)-1]) != head.sum {
+			return "", nil, errors.New("read data error, checksum not match")
+		}
+	}
 
 	kvdata := vals[1][0 : len(vals[1])-1] // 去除结尾的 splitOp
 
@@ -795,18 +2164,101 @@ func decodeValue(key string, data []byte) (op string, val *valueItem, err error)
 	}
 
 	val.key = string(dataVals[0])
-	if val.key != key {
-		return "", nil, errors.New("read data error, key not match")
-	}
+	val.expire = head.expire
 
 	if len(dataVals) == 2 {
 		val.value = dataVals[1]
 	}
 
+	if head.valueLen >= 0 && len(val.value) != head.valueLen {
+		return "", nil, errors.New("read data error, value length not match")
+	}
+
 	return op, val, nil
 }
 
-func encodeValueItem(op string, val *valueItem) []byte {
-	res := append([]byte(op+"["+val.key+"]"), val.value...)
+type recordHead struct {
+	op string
+
+	checksum bool   // 是否带有校验和 (旧格式的记录没有)
+	sum      uint32 // op 和 [key]value 的 crc32
+	valueLen int    // value 的长度，-1 表示没有 (v1 格式)
+	expire   int64  // 过期时间 (unix 毫秒)，0 为不过期
+}
+
+// 解析记录的头部, eg: _set / _set:1a2b3c4d / _set:1a2b3c4d:5 / _set:1a2b3c4d:5:1700000000000
+func parseRecordHead(data string) (*recordHead, error) {
+	fields := strings.Split(data, ":")
+	if len(fields) > 4 {
+		return nil, errors.New("read data error, bad record head")
+	}
+
+	head := &recordHead{op: fields[0], valueLen: -1}
+
+	if len(fields) > 1 {
+		sum, err := strconv.ParseUint(fields[1], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("read data error, parse checksum error: %s", err)
+		}
+		head.checksum, head.sum = true, uint32(sum)
+	}
+
+	if len(fields) > 2 {
+		l, err := strconv.Atoi(fields[2])
+		if err != nil || l < 0 {
+			return nil, fmt.Errorf("read data error, parse value length error: %s", fields[2])
+		}
+		head.valueLen = l
+	}
+
+	if len(fields) > 3 {
+		expire, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil || expire <= 0 {
+			return nil, fmt.Errorf("read data error, parse expire error: %s", fields[3])
+		}
+		head.expire = expire
+	}
+
+	return head, nil
+}
+
+// v1 eg: _set:1a2b3c4d[key]value\n
+// v2 eg: _set:1a2b3c4d:5[key]value\n, 带有 value 的长度，key 为转义后的形式
+// 有过期时间时在 value 长度之后, eg: _set:1a2b3c4d:5:1700000000000[key]value\n，v1 不支持过期时间
+// 校验和为 op (及过期时间) 和 [key]value 的 crc32
+func encodeValueItem(version int, op string, val *valueItem) []byte {
+	body := append([]byte("["+val.key+"]"), val.value...)
+
+	expire := val.expire
+	if version < formatVersion2 {
+		expire = 0
+	}
+
+	head := fmt.Sprintf("%s:%08x", op, checksum(checksumOp(op, expire), body))
+	if version >= formatVersion2 {
+		head += ":" + strconv.Itoa(len(val.value))
+	}
+	if expire > 0 {
+		head += ":" + strconv.FormatInt(expire, 10)
+	}
+
+	res := make([]byte, 0, len(head)+len(body)+1)
+	res = append(res, head...)
+	res = append(res, body...)
 	return append(res, splitOp)
 }
+
+// 校验和中 op 的部分，有过期时间时带上过期时间
+func checksumOp(op string, expire int64) string {
+	if expire <= 0 {
+		return op
+	}
+	return op + ":" + strconv.FormatInt(expire, 10)
+}
+
+func checksum(op string, body []byte) uint32 {
+	h := crc32.NewIEEE()
+	h.Write([]byte(op))
+	h.Write(body)
+	return h.Sum32()
+}
@@ -2,10 +2,19 @@ package diskv
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
 	"testing"
+	"time"
+
+	"github.com/iamlongalong/diskv/kvstore"
 )
 
+var _ kvstore.KeyLister = (*Diskv)(nil)
+
 func TestDiskv(t *testing.T) {
 	ctx := context.Background()
 	dir := "./test"
@@ -13,6 +22,12 @@ func TestDiskv(t *testing.T) {
 	var db *Diskv
 	var err error
 
+	// CreateDB 会打开目录中已有的 db，每次都从空目录开始
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	config := DefaultCreateConfig
 	config.Dir = dir
 
@@ -21,6 +36,7 @@ func TestDiskv(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer db.Close()
 
 	t.Run("set key", func(t *testing.T) {
 		err = db.Set(ctx, "key", []byte("value"))
@@ -189,6 +205,64 @@ func BenchmarkDiskv(b *testing.B) {
 	}
 }
 
+// 并发 Get/Has，对比按文件读取和 mmap 读取 idx
+// go test -run ^$ -bench BenchmarkDiskvParallel -benchmem -cpu 1,4,8
+func BenchmarkDiskvParallel(b *testing.B) {
+	ctx := context.Background()
+	keynums := 5000
+
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap-%v", mmap), func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "diskv-bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			config := CreateConfig{
+				KeysLen: 10000,
+				MaxLen:  128,
+				Options: Options{Mmap: mmap},
+			}
+			config.Dir = dir
+
+			db, err := CreateDB(ctx, &config)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			for i := 0; i < keynums; i++ {
+				nameStr := fmt.Sprintf("%d", i)
+				err = db.Set(ctx, nameStr, []byte("value: "+nameStr))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					nameStr := fmt.Sprintf("%d", i%(keynums*2)) // 后一半不存在
+					i++
+
+					var err error
+					if i%2 == 0 {
+						_, _, err = db.Get(ctx, nameStr)
+					} else {
+						_, err = db.Has(ctx, nameStr)
+					}
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
 func TestDecode(t *testing.T) {
 	x := "_del[xx]"
 	op, item, err := decodeValue("xx", []byte(x))
@@ -210,3 +284,645 @@ func TestDecode(t *testing.T) {
 
 	fmt.Printf("op: [%s], key: [%s], val: [%s]\n", op, item.key, string(item.value))
 }
+
+func TestRebuildIndex(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		err = db.Set(ctx, fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.Set(ctx, "key1", []byte("multi\nline\n_set:value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Del(ctx, "key2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Remove(filepath.Join(dir, "diskv.idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenDB(ctx, dir)
+	if err == nil {
+		t.Fatal("should get idx file not found error")
+	}
+
+	var res *RebuildResult
+	db, err = OpenDBWithConfig(ctx, &OpenConfig{
+		Dir:        dir,
+		RebuildIdx: true,
+		OnRebuild:  func(r *RebuildResult) { res = r },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if res == nil || res.Records != 12 || res.Keys != 9 {
+		t.Fatalf("unexpected rebuild result: %+v", res)
+	}
+
+	val, ok, err := db.GetString(ctx, "key1")
+	if err != nil || !ok || val != "multi\nline\n_set:value" {
+		t.Fatalf("get key1 error: %q %v %v", val, ok, err)
+	}
+
+	val, ok, err = db.GetString(ctx, "key9")
+	if err != nil || !ok || val != "value9" {
+		t.Fatalf("get key9 error: %q %v %v", val, ok, err)
+	}
+
+	ok, err = db.Has(ctx, "key2")
+	if err != nil || ok {
+		t.Fatalf("key2 should be deleted: %v %v", ok, err)
+	}
+
+	t.Run("legacy data", func(t *testing.T) {
+		dir := t.TempDir()
+		data, err := os.ReadFile("testdata/diskv.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, "diskv.db"), data, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := RebuildIndex(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 20})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Records != 7 || res.Keys != 7 || res.MaxLen != 40 {
+			t.Fatalf("unexpected rebuild result: %+v", res)
+		}
+
+		db, err := OpenDB(ctx, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		val, ok, err := db.GetString(ctx, "123456789012345678901234567890")
+		if err != nil || !ok || val != "xxxxxxx" {
+			t.Fatalf("get legacy key error: %q %v %v", val, ok, err)
+		}
+	})
+}
+
+func TestCreateDBExisting(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		err = db.SetString(ctx, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for i := 0; i < 10; i++ {
+			val, ok, err := db.GetString(ctx, fmt.Sprintf("key%d", i))
+			if err != nil || !ok || val != fmt.Sprintf("value%d", i) {
+				t.Fatalf("get key%d error: %q %v %v", i, val, ok, err)
+			}
+		}
+	}
+
+	// 已有的 idx 和 db 都保留
+	check()
+
+	// 只剩 db 时从 db 重建 idx
+	err = os.Remove(filepath.Join(dir, "diskv.idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestRecover(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 100, Options: Options{Sync: SyncAlways}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kv := range [][2]string{{"k1", "v1"}, {"k2", "v2"}, {"k1", "v1-new"}} {
+		err = db.Set(ctx, kv[0], []byte(kv[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟写入 k1 最后一条记录时崩溃：记录只写了一半，idx 已经更新
+	dbFile := filepath.Join(dir, "diskv.db")
+	info, err := os.Stat(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(dbFile, info.Size()-5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDBWithConfig(ctx, &OpenConfig{Dir: dir, Options: Options{Sync: SyncPeriodic, SyncInterval: 10 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	val, ok, err := db.GetString(ctx, "k1")
+	if err != nil || !ok || val != "v1" {
+		t.Fatalf("k1 should fall back to v1: %q %v %v", val, ok, err)
+	}
+
+	val, ok, err = db.GetString(ctx, "k2")
+	if err != nil || !ok || val != "v2" {
+		t.Fatalf("get k2 error: %q %v %v", val, ok, err)
+	}
+
+	err = db.SetString(ctx, "k3", "v3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 尾部不完整的记录已被截断，新记录紧接着最后一条有效记录
+	n := 0
+	_, err = scanLog(ctx, db.dbstore.f, 0, func(rec *logRecord) bool {
+		if rec.err != nil {
+			t.Fatalf("unexpected bad record at %d: %s", rec.offset, rec.err)
+		}
+		n++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expect 3 records, got %d: %q", n, data)
+	}
+
+	t.Run("checksum", func(t *testing.T) {
+		_, item, err := decodeRecord(encodeValueItem(currentFormatVersion, opSet, &valueItem{key: "k", value: []byte("v")}))
+		if err != nil || item.key != "k" || string(item.value) != "v" {
+			t.Fatalf("decode error: %v", err)
+		}
+
+		data := encodeValueItem(currentFormatVersion, opSet, &valueItem{key: "k", value: []byte("v")})
+		data[len(data)-2] = 'x'
+		_, _, err = decodeRecord(data)
+		if err == nil {
+			t.Fatal("should get checksum error")
+		}
+	})
+}
+
+// 正常关闭时记录 checkpoint，打开时只检查之后的部分，尾部不完整的记录仍会被截断
+func TestRecoverCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.SetString(ctx, fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dbFile := filepath.Join(dir, "diskv.db")
+	info, err := os.Stat(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := info.Size()
+
+	// 关闭之后写了一半的记录
+	f, err := os.OpenFile(dbFile, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(encodeValueItem(currentFormatVersion, opSet, &valueItem{key: "k0", value: []byte("torn")})[:10]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if cp := db.idx.meta.checkpoint; cp != (logPos{offset: size}) {
+		t.Fatalf("unexpected checkpoint: %+v, db file size %d", cp, size)
+	}
+	if info, err := os.Stat(dbFile); err != nil || info.Size() != size {
+		t.Fatalf("torn record should be truncated: %v %v", info.Size(), err)
+	}
+	for i := 0; i < 10; i++ {
+		val, ok, err := db.GetString(ctx, fmt.Sprintf("k%d", i))
+		if err != nil || !ok || val != fmt.Sprintf("v%d", i) {
+			t.Fatalf("get k%d error: %q %v %v", i, val, ok, err)
+		}
+	}
+}
+
+func TestBinarySafeKeys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 64, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kvs := map[string][]byte{
+		"a]b":         []byte("v1"),
+		"a,b":         {0, '\n', ']', '|', ','},
+		"a|b":         []byte("\n_set:00000000:1[x]y\n"),
+		"\x00lead":    []byte("v4"),
+		"100%":        []byte("v5"),
+		"line\nbreak": []byte("v6"),
+		"[x:y]":       nil,
+	}
+
+	check := func(t *testing.T, db *Diskv) {
+		for k, v := range kvs {
+			val, ok, err := db.Get(ctx, k)
+			if err != nil || !ok || string(val) != string(v) {
+				t.Fatalf("get %q error: %q %v %v", k, val, ok, err)
+			}
+		}
+
+		n := 0
+		err := db.ForEach(ctx, func(ctx context.Context, key string, value []byte) bool {
+			if v, ok := kvs[key]; !ok || string(v) != string(value) {
+				t.Fatalf("unexpected key %q", key)
+			}
+			n++
+			return true
+		})
+		if err != nil || n != len(kvs) {
+			t.Fatalf("foreach error: %d %v", n, err)
+		}
+	}
+
+	for k, v := range kvs {
+		err = db.Set(ctx, k, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(t, db)
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Remove(filepath.Join(dir, "diskv.idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDBWithConfig(ctx, &OpenConfig{Dir: dir, RebuildIdx: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(t, db)
+
+	t.Run("legacy format", func(t *testing.T) {
+		dir := t.TempDir()
+		for _, name := range []string{"diskv.db", "diskv.idx"} {
+			data, err := os.ReadFile(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(filepath.Join(dir, name), data, 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		db, err := OpenDB(ctx, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		err = db.Set(ctx, "a,b", []byte("v"))
+		if !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("should get invalid key error, got: %v", err)
+		}
+
+		err = db.Set(ctx, "100%", []byte("v"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 迁移后升级为新的格式
+		err = db.MigrateValue(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.Set(ctx, "a,b", []byte("v"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, key := range []string{"key6", "100%", "a,b"} {
+			_, ok, err := db.Get(ctx, key)
+			if err != nil || !ok {
+				t.Fatalf("get %q error: %v %v", key, ok, err)
+			}
+		}
+	})
+}
+
+// 只遍历 key 时不读取 db 文件
+func TestForEachKey(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	advance := fakeClock(t)
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 48, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"a", "a,b", "100%", "line\nbreak", "deleted"} {
+		if err := db.SetString(ctx, key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Del(ctx, "deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetStringWithTTL(ctx, "expired", "expired", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	advance(2 * time.Minute)
+
+	// db 文件清空后，ForEach 读取 value 出错，只遍历 key 不受影响
+	if err := os.Truncate(filepath.Join(dir, "diskv.db"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ForEach(ctx, func(ctx context.Context, key string, value []byte) bool { return true }); err == nil {
+		t.Fatal("foreach should read the db file")
+	}
+
+	keys, err := db.Keys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if fmt.Sprintf("%q", keys) != `["100%" "a" "a,b" "line\nbreak"]` {
+		t.Fatalf("unexpected keys: %q", keys)
+	}
+
+	n := 0
+	err = kvstore.ForEachKey(ctx, db, func(ctx context.Context, key string) bool {
+		n++
+		return n < 2
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("foreach key should stop: %d %v", n, err)
+	}
+
+	// 没有实现 KeyLister 的存储退化为 ForEach
+	err = kvstore.ForEachKey(ctx, forEachOnly{db}, func(ctx context.Context, key string) bool { return true })
+	if err == nil {
+		t.Fatal("fallback should read the db file")
+	}
+}
+
+func TestAutoGrowIdx(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 16, Options: Options{MaxLoad: 0.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(readErr)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			_, ok, err := db.Get(ctx, "key0")
+			if err != nil || !ok {
+				readErr <- fmt.Errorf("get key0 during grow error: %v %v", ok, err)
+				return
+			}
+		}
+	}()
+
+	keys := 300
+	err = db.Set(ctx, "key0", []byte("value0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < keys; i++ {
+		err = db.Set(ctx, fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db.bg.Wait()
+	close(stop)
+	if err := <-readErr; err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := db.idx.getIdxMeta(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.count != keys || float64(meta.count)/float64(meta.keysLen) > 0.5 {
+		t.Fatalf("unexpected idx meta after grow: %+v", meta)
+	}
+
+	for i := 0; i < keys; i++ {
+		val, ok, err := db.GetString(ctx, fmt.Sprintf("key%d", i))
+		if err != nil || !ok || val != fmt.Sprintf("value%d", i) {
+			t.Fatalf("get key%d error: %q %v %v", i, val, ok, err)
+		}
+	}
+
+	// 扩容后删除一部分 key，其余的 key 仍然可以找到
+	deleted := 0
+	for i := 1; i < keys; i += 3 {
+		has, err := db.Del(ctx, fmt.Sprintf("key%d", i))
+		if err != nil || !has {
+			t.Fatalf("del key%d error: %v %v", i, has, err)
+		}
+		deleted++
+	}
+	for i := 0; i < keys; i++ {
+		val, ok, err := db.GetString(ctx, fmt.Sprintf("key%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%3 == 1 {
+			if ok {
+				t.Fatalf("key%d should be deleted", i)
+			}
+			continue
+		}
+		if !ok || val != fmt.Sprintf("value%d", i) {
+			t.Fatalf("get key%d after del error: %q %v", i, val, ok)
+		}
+	}
+	keys -= deleted
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开后 key 的数量不变
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	meta, err = db.idx.getIdxMeta(ctx)
+	if err != nil || meta.count != keys {
+		t.Fatalf("unexpected idx meta after reopen: %+v %v", meta, err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 100, Options: Options{Sync: SyncPeriodic, SyncInterval: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.SetString(ctx, "key", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Sync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Close(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expect ErrClosed, got %v", err)
+	}
+	if err = db.Set(ctx, "key", nil); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expect ErrClosed, got %v", err)
+	}
+	if _, _, err = db.Get(ctx, "key"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expect ErrClosed, got %v", err)
+	}
+	if _, err = db.Del(ctx, "key"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expect ErrClosed, got %v", err)
+	}
+	if err = db.Sync(ctx); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expect ErrClosed, got %v", err)
+	}
+	if err = db.MigrateValue(ctx); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expect ErrClosed, got %v", err)
+	}
+
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	val, ok, err := db.GetString(ctx, "key")
+	if err != nil || !ok || val != "value" {
+		t.Fatalf("unexpected value after reopen: %q %v %v", val, ok, err)
+	}
+
+	// 迁移后旧的文件句柄已关闭
+	err = db.MigrateValue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err == nil {
+		open := 0
+		for _, entry := range entries {
+			target, err := os.Readlink(filepath.Join("/proc/self/fd", entry.Name()))
+			if err == nil && filepath.Dir(target) == dir {
+				open++
+			}
+		}
+		if open != 3 { // db、idx 和 lock 文件
+			t.Fatalf("expect 3 open files in db dir, got %d", open)
+		}
+	}
+}
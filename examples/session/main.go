@@ -14,19 +14,21 @@ import (
 	"github.com/iamlongalong/diskv/gkv"
 )
 
-var sessionStore *gkv.Gkv[User]
+var db *diskv.Diskv
 
 func init() {
-	db, err := diskv.CreateDB(context.Background(), &diskv.CreateConfig{
+	var err error
+	db, err = diskv.CreateDB(context.Background(), &diskv.CreateConfig{
 		Dir:     "./test/.data",
 		KeysLen: 500,
 		MaxLen:  128,
+		Options: diskv.Options{
+			GarbageRatio: 0.5, // 每次请求都会重写 session，无效数据过半时自动迁移
+		},
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	sessionStore = gkv.New[User](db)
 }
 
 func main() {
@@ -56,7 +58,15 @@ func main() {
 		user.Expire = 1 * time.Hour
 		user.LastActive = time.Now()
 
-		err = sessionStore.Set(r.Context(), sessionID, user)
+		// session 在 Expire 之后过期，过期后 diskv 会自动删除，不会一直留在 db 文件中
+		data, err := json.Marshal(user)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		err = db.SetWithTTL(r.Context(), sessionID, data, user.Expire)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
@@ -81,23 +91,40 @@ func main() {
 			return
 		}
 
-		// 从带类型的 store 中获取数据，得到的是 User 类型的实例
-		user, ok, err := sessionStore.Get(r.Context(), sessionID)
+		// 读取、更新 LastActive、写回放在一个事务中，并发请求同一个 session 时不会丢失更新
+		var user *User
+		err := db.Update(r.Context(), func(tx *diskv.Tx) error {
+			store := gkv.New[User](tx) // 事务同样可以作为带类型的 store 使用
+
+			// 从带类型的 store 中获取数据，得到的是 User 类型的实例
+			u, ok, err := store.Get(r.Context(), sessionID)
+			if err != nil || !ok {
+				user = nil
+				return err
+			}
+
+			u.LastActive = time.Now()
+			user = u
+
+			// 重新塞回去，并重新计算过期时间 (Set 会清除过期时间)
+			data, err := json.Marshal(u)
+			if err != nil {
+				return err
+			}
+			return tx.SetWithTTL(r.Context(), sessionID, data, u.Expire)
+		})
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
 			return
 		}
 
-		if !ok {
+		if user == nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte("Unauthorized, login first"))
 			return
 		}
 
-		user.LastActive = time.Now()
-		sessionStore.Set(r.Context(), sessionID, user) // 重新塞回去
-
 		userbs, _ := json.Marshal(map[string]any{"user": user})
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(userbs))
@@ -112,7 +139,7 @@ func main() {
 			return
 		}
 
-		err := sessionStore.Set(r.Context(), sessionID, nil)
+		_, err := db.Del(r.Context(), sessionID)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
@@ -0,0 +1,8 @@
+//go:build windows || plan9 || js
+
+package diskv
+
+// 暂不支持对目录 fsync 的平台不落盘目录
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !windows && !plan9 && !js
+
+package diskv
+
+import "os"
+
+// 落盘目录中的文件名变更 (创建、重命名、删除)，否则崩溃后可能恢复成变更之前的样子
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
@@ -103,6 +103,7 @@ func TestGDiskMarshaler(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer disk.Close()
 
 	t.Run("test gdisk gmarshaler", func(t *testing.T) {
 		RegisterGMarshaler(NewTStructMarshal())
@@ -252,6 +253,7 @@ func TestNDisk(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer db.Close()
 
 	nd := NewNkv(db)
 
@@ -0,0 +1,177 @@
+package diskv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// idx 中计算 key 所在 slot 的哈希算法，创建时指定，记录在 idx 文件头中 (h:<算法>.<种子>)
+// 顺序递增、前缀相同的 key 用 fnv1a 时容易聚集，可以换用 xxhash 或 murmur3
+type HashType int
+
+const (
+	HashFNV1a   HashType = iota // fnv1a 32 位，旧文件默认使用
+	HashXXHash                  // xxhash 32 位
+	HashMurmur3                 // murmur3 32 位
+)
+
+func (h HashType) String() string {
+	switch h {
+	case HashFNV1a:
+		return "fnv1a"
+	case HashXXHash:
+		return "xxhash"
+	case HashMurmur3:
+		return "murmur3"
+	}
+
+	return fmt.Sprintf("HashType(%d)", int(h))
+}
+
+func (h HashType) valid() bool {
+	return h >= HashFNV1a && h <= HashMurmur3
+}
+
+// 计算 key 的哈希值，seed 不为 0 时不同种子的哈希值互不相关
+func (h HashType) sum32(key []byte, seed uint32) uint32 {
+	switch h {
+	case HashXXHash:
+		return xxhash32(key, seed)
+	case HashMurmur3:
+		return murmur3Sum32(key, seed)
+	}
+
+	return fnv1aSum32(key, seed)
+}
+
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+// fnv1a 本身没有种子，有种子时先把种子的 4 个字节混入
+func fnv1aSum32(key []byte, seed uint32) uint32 {
+	h := uint32(fnvOffset32)
+	if seed != 0 {
+		for i := 0; i < 4; i++ {
+			h ^= (seed >> (8 * i)) & 0xff
+			h *= fnvPrime32
+		}
+	}
+
+	for _, c := range key {
+		h ^= uint32(c)
+		h *= fnvPrime32
+	}
+
+	return h
+}
+
+const (
+	xxPrime1 uint32 = 2654435761
+	xxPrime2 uint32 = 2246822519
+	xxPrime3 uint32 = 3266489917
+	xxPrime4 uint32 = 668265263
+	xxPrime5 uint32 = 374761393
+)
+
+func xxRound(acc, input uint32) uint32 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft32(acc, 13)
+	return acc * xxPrime1
+}
+
+// XXH32
+func xxhash32(key []byte, seed uint32) uint32 {
+	n := len(key)
+	var h uint32
+
+	if n >= 16 {
+		v1 := seed + xxPrime1 + xxPrime2
+		v2 := seed + xxPrime2
+		v3 := seed
+		v4 := seed - xxPrime1
+
+		for len(key) >= 16 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint32(key[0:]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint32(key[4:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint32(key[8:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint32(key[12:]))
+			key = key[16:]
+		}
+
+		h = bits.RotateLeft32(v1, 1) + bits.RotateLeft32(v2, 7) + bits.RotateLeft32(v3, 12) + bits.RotateLeft32(v4, 18)
+	} else {
+		h = seed + xxPrime5
+	}
+
+	h += uint32(n)
+
+	for len(key) >= 4 {
+		h += binary.LittleEndian.Uint32(key) * xxPrime3
+		h = bits.RotateLeft32(h, 17) * xxPrime4
+		key = key[4:]
+	}
+
+	for _, c := range key {
+		h += uint32(c) * xxPrime5
+		h = bits.RotateLeft32(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 15
+	h *= xxPrime2
+	h ^= h >> 13
+	h *= xxPrime3
+	h ^= h >> 16
+
+	return h
+}
+
+const (
+	murmurC1 uint32 = 0xcc9e2d51
+	murmurC2 uint32 = 0x1b873593
+)
+
+// MurmurHash3_x86_32
+func murmur3Sum32(key []byte, seed uint32) uint32 {
+	h := seed
+	n := len(key)
+
+	for len(key) >= 4 {
+		k := binary.LittleEndian.Uint32(key)
+		k *= murmurC1
+		k = bits.RotateLeft32(k, 15)
+		k *= murmurC2
+
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+		key = key[4:]
+	}
+
+	var k uint32
+	switch len(key) {
+	case 3:
+		k ^= uint32(key[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(key[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(key[0])
+		k *= murmurC1
+		k = bits.RotateLeft32(k, 15)
+		k *= murmurC2
+		h ^= k
+	}
+
+	h ^= uint32(n)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h
+}
@@ -0,0 +1,165 @@
+package diskv
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestHashSum32(t *testing.T) {
+	cases := []struct {
+		hash   HashType
+		key    string
+		seed   uint32
+		expect uint32
+	}{
+		{HashFNV1a, "", 0, 0x811c9dc5},
+		{HashFNV1a, "a", 0, 0xe40c292c},
+		{HashFNV1a, "foobar", 0, 0xbf9cf968},
+		{HashXXHash, "", 0, 0x02cc5d05},
+		{HashXXHash, "a", 0, 0x550d7456},
+		{HashXXHash, "abc", 0, 0x32d153ff},
+		{HashXXHash, "Nobody inspects the spammish repetition", 0, 0xe2293b2f},
+		{HashMurmur3, "", 0, 0},
+		{HashMurmur3, "", 1, 0x514e28b7},
+		{HashMurmur3, "hello", 0, 0x248bfa47},
+		{HashMurmur3, "The quick brown fox jumps over the lazy dog", 0, 0x2e4ff723},
+	}
+
+	for _, c := range cases {
+		if got := c.hash.sum32([]byte(c.key), c.seed); got != c.expect {
+			t.Errorf("%s(%q, %d) = %#x, expect %#x", c.hash, c.key, c.seed, got, c.expect)
+		}
+	}
+
+	// 不同的种子得到不同的哈希值
+	for _, h := range []HashType{HashFNV1a, HashXXHash, HashMurmur3} {
+		if h.sum32([]byte("key"), 0) == h.sum32([]byte("key"), 42) {
+			t.Errorf("%s should differ with seed", h)
+		}
+	}
+}
+
+func TestIdxMetaHash(t *testing.T) {
+	cases := []*idxMeta{
+		{maxLength: 32, keysLen: 10000, version: 2, count: 12},
+		{maxLength: 32, keysLen: 10000, version: 2, count: 12, hash: HashMurmur3},
+		{maxLength: 32, keysLen: 10000, version: 2, count: 12, hash: HashXXHash, hashSeed: 0x9e3779b9},
+		{maxLength: 64, keysLen: 99999999, version: 2, count: 999999999, hash: HashXXHash, hashSeed: 0xffffffff},
+		{maxLength: 64, keysLen: 1000000, version: 2, count: 123456, hash: HashFNV1a, hashSeed: 1},
+		{maxLength: 64, keysLen: 99999999, version: 2, count: 99999999, hash: HashXXHash, hashSeed: 0xffffffff, probe: ProbeRobinHood, hashedKeys: true},
+		{maxLength: 48, keysLen: 100, version: 2, count: 3, probe: ProbeRobinHood},
+		{maxLength: 48, keysLen: 100, version: 2, count: 3, hashedKeys: true},
+		{maxLength: 32, keysLen: 10000, version: 2, count: 12, checkpoint: logPos{seg: 3, offset: 1048576}},
+		{maxLength: 48, keysLen: 100, version: 2, count: 3, probe: ProbeRobinHood, hashedKeys: true, checkpoint: logPos{offset: 123}},
+	}
+
+	for _, meta := range cases {
+		data := formatIdxMeta(meta)
+		if len(data) != dbMetaLen {
+			t.Fatalf("unexpected idx meta length: %d %s", len(data), data)
+		}
+
+		got, err := parseIdxMeta(data)
+		if err != nil {
+			t.Fatalf("parse %s error: %s", data, err)
+		}
+		if *got != *meta {
+			t.Fatalf("parse %s: %+v, expect %+v", data, got, meta)
+		}
+	}
+
+	// 文件头放不下 checkpoint 时不记录
+	full := &idxMeta{maxLength: 64, keysLen: 99999999, version: 2, count: 99999999, hash: HashXXHash, hashSeed: 0xffffffff, checkpoint: logPos{seg: 12, offset: 1 << 40}}
+	data := formatIdxMeta(full)
+	got, err := parseIdxMeta(data)
+	if err != nil || len(data) != dbMetaLen || got.checkpoint != (logPos{}) || got.count != full.count {
+		t.Fatalf("parse %s: %+v %v", data, got, err)
+	}
+
+	if _, err := parseIdxMeta([]byte("[maxlength:000032,keyslen:010000,v:2,h:9,n:1]")); err == nil {
+		t.Fatal("should fail with unknown hash")
+	}
+}
+
+func TestHashConfig(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 256, Hash: HashMurmur3, HashSeed: 7, Options: Options{MaxLoad: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	keys := 100
+	check := func(t *testing.T, hash HashType, seed uint32) {
+		meta, err := db.idx.getIdxMeta(ctx)
+		if err != nil || meta.hash != hash || meta.hashSeed != seed {
+			t.Fatalf("unexpected idx hash: %+v %v", meta, err)
+		}
+
+		for i := 0; i < keys; i++ {
+			val, ok, err := db.GetString(ctx, fmt.Sprintf("user:%06d", i))
+			if err != nil || !ok || val != fmt.Sprint(i) {
+				t.Fatalf("get user:%06d error: %q %v %v", i, val, ok, err)
+			}
+		}
+
+		// key 按记录的哈希算法放在对应的 slot 附近
+		slot, err := db.idx.hashKey(ctx, "user:000000")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(hash.sum32([]byte("user:000000"), seed)%uint32(meta.keysLen)) != slot {
+			t.Fatalf("hash key not using %s", hash)
+		}
+	}
+
+	for i := 0; i < keys; i++ {
+		if err := db.SetString(ctx, fmt.Sprintf("user:%06d", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(t, HashMurmur3, 7)
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenDB(ctx, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, HashMurmur3, 7)
+	})
+
+	t.Run("migrate idx", func(t *testing.T) {
+		err := db.MigrateIdx(ctx, &CreateConfig{MaxLen: 32, KeysLen: 256, Hash: HashXXHash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, HashXXHash, 0)
+	})
+
+	t.Run("migrate value", func(t *testing.T) {
+		if err := db.MigrateValue(ctx); err != nil {
+			t.Fatal(err)
+		}
+		check(t, HashXXHash, 0)
+	})
+
+	t.Run("grow", func(t *testing.T) {
+		if err := db.growIdx(ctx); err != nil {
+			t.Fatal(err)
+		}
+		check(t, HashXXHash, 0)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := CreateDB(ctx, &CreateConfig{Dir: t.TempDir(), MaxLen: 32, KeysLen: 16, Hash: HashType(9)})
+		if err == nil {
+			t.Fatal("should fail with unsupported hash")
+		}
+	})
+}
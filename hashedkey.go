@@ -0,0 +1,98 @@
+package diskv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+)
+
+// HashedKeys:
+// slot 中不存 key，只存 key 的 64 位哈希值 (与计算 slot 的哈希算法无关)，eg: 9e3779b97f4a7c15,12,3456|
+// 哈希值相同时从 db 文件中读取记录的头部，比较完整的 key，因此 key 的长度不受 MaxLen 的限制
+// 遍历时需要从 db 文件中读取 key
+
+// 未关联 db 文件的 idx 无法校验 key
+var errNoStore = errors.New("idx with hashed keys has no db store")
+
+func keyFingerprint(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func formatFingerprint(fp uint64) string {
+	return fmt.Sprintf("%016x", fp)
+}
+
+func parseFingerprint(s string) (uint64, error) {
+	return strconv.ParseUint(s, 16, 64)
+}
+
+// meta 中 key 的哈希值
+func (m *valueMeta) fingerprint() uint64 {
+	if m.noKey {
+		return m.fp
+	}
+	return keyFingerprint(m.key)
+}
+
+// 用于区分 slot 中不同的 key
+func (idx *idx) slotID(meta *valueMeta) string {
+	if idx.meta.hashedKeys {
+		return formatFingerprint(meta.fingerprint())
+	}
+	return meta.key
+}
+
+// slot 中的 key 是否为 key，hashedKeys 时哈希值相同后再从 db 文件中校验，命中时补上 meta 中的 key
+func (idx *idx) matchKey(ctx context.Context, meta *valueMeta, key string) (bool, error) {
+	if !idx.meta.hashedKeys {
+		return meta.key == key, nil
+	}
+
+	if !meta.noKey {
+		return meta.key == key, nil
+	}
+
+	if meta.fp != keyFingerprint(key) {
+		return false, nil
+	}
+
+	if idx.store == nil {
+		return false, errNoStore
+	}
+
+	ok, err := idx.store.hasKey(ctx, meta, key)
+	if err != nil {
+		return false, fmt.Errorf("check key error: %s", err)
+	}
+	if ok {
+		meta.key, meta.noKey = key, false
+	}
+
+	return ok, nil
+}
+
+// hashedKeys 时从 db 文件中读取 meta 的 key
+func (idx *idx) resolveKey(ctx context.Context, meta *valueMeta) error {
+	if !meta.noKey {
+		return nil
+	}
+
+	if idx.store == nil {
+		return errNoStore
+	}
+
+	key, err := idx.store.readKey(ctx, meta)
+	if err != nil {
+		return fmt.Errorf("read key error: %s", err)
+	}
+	if keyFingerprint(key) != meta.fp {
+		return fmt.Errorf("read key error: key [%s] not match hash %s", key, formatFingerprint(meta.fp))
+	}
+
+	meta.key, meta.noKey = key, false
+	return nil
+}
@@ -0,0 +1,218 @@
+package diskv
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func longKey(i int) string {
+	return fmt.Sprintf("tenant-a/orders/%08x-%04x-%04x-%04x-%012x", i, i%7, i%11, i%13, i*7919)
+}
+
+func TestHashedKeys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// 32 字节的 block 放不下这些 key
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 40, KeysLen: 64, HashedKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	keys := 100
+	for i := 0; i < keys; i++ {
+		if err := db.SetString(ctx, longKey(i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < keys; i += 3 {
+		if _, err := db.Del(ctx, longKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.bg.Wait()
+
+	check := func(t *testing.T, db *Diskv) {
+		for i := 0; i < keys; i++ {
+			val, ok, err := db.GetString(ctx, longKey(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i%3 == 0 {
+				if ok {
+					t.Fatalf("%s should be deleted", longKey(i))
+				}
+				continue
+			}
+			if !ok || val != fmt.Sprint(i) {
+				t.Fatalf("get %s error: %q %v", longKey(i), val, ok)
+			}
+		}
+
+		got := []string{}
+		err := db.ForEach(ctx, func(ctx context.Context, key string, value []byte) bool {
+			got = append(got, key)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := []string{}
+		for i := 0; i < keys; i++ {
+			if i%3 != 0 {
+				expect = append(expect, longKey(i))
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(expect)
+		if fmt.Sprint(got) != fmt.Sprint(expect) {
+			t.Fatalf("unexpected keys: %v", got)
+		}
+
+		meta, err := db.idx.getIdxMeta(ctx)
+		if err != nil || !meta.hashedKeys || meta.count != len(expect) {
+			t.Fatalf("unexpected idx meta: %+v %v", meta, err)
+		}
+	}
+	check(t, db)
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenDB(ctx, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+	})
+
+	t.Run("migrate", func(t *testing.T) {
+		err := db.MigrateIdx(ctx, &CreateConfig{MaxLen: 48, KeysLen: 256, Probe: ProbeRobinHood, HashedKeys: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+
+		if err := db.MigrateValue(ctx); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+
+		if err := db.MigrateValueOnline(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+	})
+
+	t.Run("rebuild", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := RebuildIndex(ctx, &CreateConfig{Dir: dir}); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenDB(ctx, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.idx.meta.probe != ProbeRobinHood {
+			t.Fatalf("unexpected probe after rebuild: %s", db.idx.meta.probe)
+		}
+		check(t, db)
+	})
+}
+
+// 哈希值相同的 key 需要从 db 文件中校验
+func TestHashedKeysCollision(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 40, KeysLen: 16, HashedKeys: true, Options: Options{MaxLoad: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.SetString(ctx, "a", "va"); err != nil {
+		t.Fatal(err)
+	}
+	meta, ok, err := db.idx.getValueMeta(ctx, "a")
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+
+	// 伪造一个与 b 哈希值相同、但指向 a 的记录的 slot
+	slot, err := db.idx.hashKey(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &valueMeta{fp: keyFingerprint("b"), noKey: true, offset: meta.offset, length: meta.length}
+	if err := db.idx.writeSlots(ctx, []slotWrite{{slot: slot, meta: fake}}, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := db.Get(ctx, "b"); err != nil || ok {
+		t.Fatalf("b should not be found: %v %v", ok, err)
+	}
+
+	if err := db.SetString(ctx, "b", "vb"); err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range [][2]string{{"a", "va"}, {"b", "vb"}} {
+		val, ok, err := db.GetString(ctx, kv[0])
+		if err != nil || !ok || val != kv[1] {
+			t.Fatalf("get %s error: %q %v %v", kv[0], val, ok, err)
+		}
+	}
+}
+
+func TestHashedKeysRecover(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 40, KeysLen: 100, HashedKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kv := range [][2]string{{longKey(1), "v1"}, {longKey(2), "v2"}, {longKey(1), "v1-new"}} {
+		if err := db.SetString(ctx, kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 最后一条记录只写了一半，slot 指向 db 文件之外，无法读出其中的 key
+	dbFile := filepath.Join(dir, "diskv.db")
+	info, err := os.Stat(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(dbFile, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, kv := range [][2]string{{longKey(1), "v1"}, {longKey(2), "v2"}} {
+		val, ok, err := db.GetString(ctx, kv[0])
+		if err != nil || !ok || val != kv[1] {
+			t.Fatalf("get %s error: %q %v %v", kv[0], val, ok, err)
+		}
+	}
+	if db.idx.meta.count != 2 {
+		t.Fatalf("unexpected count: %d", db.idx.meta.count)
+	}
+}
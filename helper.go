@@ -2,22 +2,39 @@ package diskv
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 )
 
 // 迁移 idx 文件
 func (d *Diskv) MigrateIdx(ctx context.Context, toConfig *CreateConfig) error {
+	d.migrateMu.Lock()
+	defer d.migrateMu.Unlock()
+
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+
 	toConfig.Dir = d.dir
 	toIdxFile := d.idxFileName(d.dir) + ".tmp"
 
-	toIdx, err := d.createIdx(ctx, toIdxFile, *toConfig)
+	idxMeta, err := d.idx.getIdxMeta(ctx)
+	if err != nil {
+		return fmt.Errorf("get idx meta error: %s", err)
+	}
+
+	// idx 中 key 的存储形式不变，沿用原来的格式版本
+	toIdx, err := d.createIdx(ctx, toIdxFile, *toConfig, idxMeta.version)
 	if err != nil {
 		return fmt.Errorf("create idx file error: %s", err)
 	}
+	toIdx.store = d.dbstore
 
 	ferr := d.forEachKey(ctx, func(ctx context.Context, valMeta *valueMeta) (ok bool) {
 		err = toIdx.setValueMeta(ctx, valMeta)
@@ -49,16 +66,25 @@ func (d *Diskv) MigrateIdx(ctx context.Context, toConfig *CreateConfig) error {
 }
 
 // 迁移 value 文件，用于把 del 等操作去除掉
+// 迁移后的 db 和 idx 文件会升级为最新的格式版本
 func (d *Diskv) MigrateValue(ctx context.Context) error {
+	d.migrateMu.Lock()
+	defer d.migrateMu.Unlock()
+
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+
 	toValueFile := d.dbFileName(d.dir) + ".tmp"
 
 	dbstore, err := d.getOrCreateDBStore(toValueFile)
 	if err != nil {
 		return fmt.Errorf("create db file error: %s", err)
 	}
+	dbstore.version = currentFormatVersion
 
 	idxMeta, err := d.idx.getIdxMeta(ctx)
 	if err != nil {
@@ -66,21 +92,23 @@ func (d *Diskv) MigrateValue(ctx context.Context) error {
 	}
 
 	toValueIdxFile := d.idxFileName(d.dir) + ".tmp"
-	nidx, err := d.createIdx(ctx, toValueIdxFile, CreateConfig{
-		Dir: d.dir,
-		// KeySize:      idxMeta.keySize,
-		KeysLen: idxMeta.keysLen,
-		// OffsetSize:   idxMeta.offsetSize,
-		// ValueLenSize: idxMeta.valueLenSize,
-		MaxLen: idxMeta.maxLength,
-	})
+	toConfig := idxMeta.createConfig()
+	toConfig.Dir = d.dir
+	nidx, err := d.createIdx(ctx, toValueIdxFile, toConfig, currentFormatVersion)
 	if err != nil {
 		return fmt.Errorf("create idx file error: %s", err)
 	}
+	nidx.store = dbstore
+
+	ferr := d.forEachItem(ctx, func(ctx context.Context, item *valueItem) (ok bool) {
+		var key string
+		key, err = convertKey(idxMeta.version, item.key)
+		if err != nil {
+			return false
+		}
 
-	ferr := d.forEach(ctx, func(ctx context.Context, key string, value []byte) (ok bool) {
 		var valueMeta *valueMeta
-		valueMeta, err = dbstore.write(ctx, &valueItem{key: key, value: value})
+		valueMeta, err = dbstore.write(ctx, &valueItem{key: key, value: item.value, expire: item.expire})
 		if err != nil {
 			return false
 		}
@@ -100,21 +128,335 @@ func (d *Diskv) MigrateValue(ctx context.Context) error {
 		return fmt.Errorf("forEachKey error in func: %s", err)
 	}
 
-	err = migrateFile(ctx, toValueFile, d.dbFile, false)
+	err = d.swapFiles(ctx, dbstore, nidx)
 	if err != nil {
-		return fmt.Errorf("migrate file error: %s", err)
+		return fmt.Errorf("swap files error: %s", err)
 	}
 
-	err = migrateFile(ctx, toValueIdxFile, d.idxFile, false)
+	err = d.openDB(ctx, d.dir)
 	if err != nil {
-		return fmt.Errorf("migrate file error: %s", err)
+		return fmt.Errorf("reopen db file error: %s", err)
 	}
+	d.rebuildSortedKeysLater() // 去掉有序 key 文件中已删除的 key
 
-	err = d.openDB(ctx, d.dir)
+	return d.loadStats(ctx)
+}
+
+// 追赶时，剩余未回放的记录小于该值时，阻塞读写完成最后的回放
+const catchUpBytes = 64 * 1024
+
+// 在线迁移 idx，迁移过程中不阻塞读写，仅在最后切换文件时短暂阻塞
+// 1. 记录当前 db 文件的结尾，把当前 idx 中的所有 key 复制到新的 idx
+// 2. 复制期间的写入仍然写到旧的 idx，同时追加到了 db 文件中，回放这部分记录到新的 idx，直到追上
+// 3. 阻塞读写，回放剩余的记录后切换文件
+// newConfig 根据当前 idx 的配置生成新 idx 的配置，在 migrateMu 内调用，不会读到其他迁移之前的配置
+func (d *Diskv) migrateIdxOnline(ctx context.Context, newConfig func(meta *idxMeta) *CreateConfig) error {
+	d.migrateMu.Lock()
+	defer d.migrateMu.Unlock()
+
+	// 等待进行中的写入完成，保证 end 之前的记录都已经写入 idx
+	d.mu.Lock()
+	if err := d.checkWritable(); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	idxMeta, err := d.idx.getIdxMeta(ctx)
 	if err != nil {
-		return fmt.Errorf("reopen db file error: %s", err)
+		d.mu.Unlock()
+		return fmt.Errorf("get idx meta error: %s", err)
 	}
-	return nil
+	end, err := d.dbstore.end(ctx)
+	d.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("get db file size error: %s", err)
+	}
+
+	toConfig := newConfig(idxMeta)
+	toConfig.Dir = d.dir
+	toIdxFile := d.idxFileName(d.dir) + ".tmp"
+	err = os.RemoveAll(toIdxFile)
+	if err != nil {
+		return fmt.Errorf("remove old tmp idx file error: %s", err)
+	}
+
+	toIdx, err := d.createIdx(ctx, toIdxFile, *toConfig, idxMeta.version)
+	if err != nil {
+		return fmt.Errorf("create idx file error: %s", err)
+	}
+	defer toIdx.f.Close()
+	toIdx.store = d.dbstore
+
+	d.mu.RLock()
+	ferr := d.forEachKey(ctx, func(ctx context.Context, valMeta *valueMeta) (ok bool) {
+		if err = d.checkClosed(); err != nil {
+			return false
+		}
+		err = toIdx.setValueMeta(ctx, valMeta)
+		return err == nil
+	})
+	d.mu.RUnlock()
+	if ferr != nil {
+		return fmt.Errorf("forEachKey error: %s", ferr)
+	}
+	if err != nil {
+		return fmt.Errorf("forEachKey error in func: %w", err)
+	}
+
+	return d.catchUp(ctx, end, func(rec *logRecord) (err error) {
+		switch rec.op {
+		case opSet:
+			err = toIdx.setValueMeta(ctx, rec.valueMeta())
+		case opDel:
+			_, err = toIdx.delValueMeta(ctx, rec.item.key)
+		}
+		return err
+	}, func() error {
+		err := toIdx.sync(ctx)
+		if err != nil {
+			return fmt.Errorf("sync idx file error: %s", err)
+		}
+
+		err = migrateFile(ctx, toIdxFile, d.idxFile, false)
+		if err != nil {
+			return fmt.Errorf("migrate file error: %s", err)
+		}
+
+		err = d.openDB(ctx, d.dir)
+		if err != nil {
+			return fmt.Errorf("reopen db file error: %s", err)
+		}
+
+		return nil
+	})
+}
+
+// 在线迁移的追赶阶段: 回放 from 之后写入 db 文件的记录，剩余的记录不多时，阻塞读写完成最后的回放，然后执行 swap 切换文件
+func (d *Diskv) catchUp(ctx context.Context, from logPos, apply func(rec *logRecord) error, swap func() error) error {
+	end := from
+	for {
+		d.mu.RLock()
+		if err := d.checkClosed(); err != nil {
+			d.mu.RUnlock()
+			return err
+		}
+		next, err := d.replayLog(ctx, end, apply)
+		d.mu.RUnlock()
+		if err != nil {
+			return fmt.Errorf("replay db file error: %s", err)
+		}
+
+		done := next.seg == end.seg && next.offset-end.offset < catchUpBytes
+		end = next
+		if done {
+			break
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.checkClosed(); err != nil {
+		return err
+	}
+
+	_, err := d.replayLog(ctx, end, apply)
+	if err != nil {
+		return fmt.Errorf("replay db file error: %s", err)
+	}
+
+	return swap()
+}
+
+// 回放 db 文件中 from 之后的记录，返回回放到的位置
+// 尾部正在写入的记录不完整，留到下一次回放
+func (d *Diskv) replayLog(ctx context.Context, from logPos, apply func(rec *logRecord) error) (logPos, error) {
+	end := from
+
+	var err error
+	serr := d.dbstore.scan(ctx, from, func(rec *logRecord) bool {
+		if rec.err != nil {
+			if errors.Is(rec.err, errIncompleteRecord) {
+				return false
+			}
+
+			end = logPos{seg: rec.seg, offset: int64(rec.offset + rec.length)} // 损坏的记录，跳过
+			return true
+		}
+
+		err = apply(rec)
+		if err != nil {
+			return false
+		}
+
+		end = logPos{seg: rec.seg, offset: int64(rec.offset + rec.length)}
+		return true
+	})
+	if serr != nil {
+		return end, serr
+	}
+
+	return end, err
+}
+
+// 负载超过 MaxLoad 时，在后台在线扩容 idx，调用方需持有 d.mu 的读锁
+func (d *Diskv) maybeGrowIdx(ctx context.Context) {
+	if d.opts.MaxLoad < 0 || !d.overloaded(ctx) {
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&d.growing, 0, 1) {
+		return
+	}
+
+	d.bg.Add(1)
+	go func() {
+		defer d.bg.Done()
+		defer atomic.StoreInt32(&d.growing, 0)
+
+		ctx := context.Background()
+		for {
+			d.mu.RLock()
+			overloaded := d.overloaded(ctx)
+			d.mu.RUnlock()
+			if !overloaded {
+				return
+			}
+
+			err := d.growIdx(ctx)
+			if err != nil {
+				return // 下次写入时重试
+			}
+		}
+	}()
+}
+
+// 调用方需持有 d.mu 的读锁
+func (d *Diskv) overloaded(ctx context.Context) bool {
+	maxLoad := d.opts.MaxLoad
+	if maxLoad == 0 {
+		maxLoad = DefaultMaxLoad
+	}
+
+	load, err := d.idx.load(ctx)
+
+	return err == nil && load > maxLoad
+}
+
+// 把 idx 扩容到当前的两倍
+// 负载主要来自 tombstone (有效的 key 不到 MaxLoad 的一半) 时按原大小重建，只清掉 tombstone
+func (d *Diskv) growIdx(ctx context.Context) error {
+	maxLoad := d.opts.MaxLoad
+	if maxLoad == 0 {
+		maxLoad = DefaultMaxLoad
+	}
+
+	return d.migrateIdxOnline(ctx, func(meta *idxMeta) *CreateConfig {
+		config := meta.createConfig()
+		if meta.deleted == 0 || float64(meta.count)/float64(meta.keysLen) > maxLoad/2 {
+			config.KeysLen *= 2
+		}
+		return &config
+	})
+}
+
+// idx 文件中超出 keysLen 的 slot 数量
+// 旧版本探测到结尾时不回到第 0 个，冲突的 key 会写到 keysLen 之后
+func (idx *idx) overflowSlots(ctx context.Context) (int, error) {
+	meta, err := idx.getIdxMeta(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	err = idx.runWithFile(ctx, func(ctx context.Context, f *os.File) error {
+		fileInfo, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		size = fileInfo.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	end := int64(meta.getBlockStartOffset(meta.keysLen))
+	if size <= end {
+		return 0, nil
+	}
+
+	blockLen := int64(meta.getKeyBlockLength())
+	return int((size - end + blockLen - 1) / blockLen), nil
+}
+
+// 把旧版本写到 keysLen 之后的 key 移回表内，表内放不下时扩容 idx
+func (d *Diskv) fixOverflowSlots(ctx context.Context) error {
+	n, err := d.idx.overflowSlots(ctx)
+	if err != nil || n == 0 {
+		return err
+	}
+
+	meta, err := d.idx.getIdxMeta(ctx)
+	if err != nil {
+		return err
+	}
+	keysLen := meta.keysLen
+
+	metas := []*valueMeta{}
+	for slot := keysLen; slot < keysLen+n; slot++ {
+		valMeta, state, err := d.idx.getValueOfSlot(ctx, slot)
+		if err != nil {
+			return err
+		}
+		if state == slotUsed {
+			metas = append(metas, valMeta)
+		}
+	}
+
+	// 先把 key 写回表内并落盘，再截掉溢出的部分，中途崩溃时溢出的 key 仍在，下次打开时重新处理
+	// 表内探测不会越过 keysLen，已写回的 key 再次写入时原地覆盖，不重复计数
+	grown := false
+	for _, valMeta := range metas {
+		err = d.idx.setValueMeta(ctx, valMeta)
+		if errors.Is(err, ErrIndexFull) {
+			config := meta.createConfig()
+			config.KeysLen = keysLen * 2
+			err = d.MigrateIdx(ctx, &config)
+			if err != nil {
+				return fmt.Errorf("grow idx error: %s", err)
+			}
+			keysLen *= 2
+			grown = true
+
+			err = d.idx.setValueMeta(ctx, valMeta)
+		}
+		if err != nil {
+			return fmt.Errorf("move overflow key error: %s", err)
+		}
+	}
+
+	err = d.idx.sync(ctx)
+	if err != nil {
+		return err
+	}
+	if grown { // 新的 idx 从表内的 key 重建，没有溢出的部分，计数也不包含它们
+		return nil
+	}
+
+	// 溢出的 key 已在表内重新计数
+	err = d.idx.runWithFile(ctx, func(ctx context.Context, f *os.File) error {
+		err := f.Truncate(int64(meta.getBlockStartOffset(keysLen)))
+		if err != nil {
+			return fmt.Errorf("truncate idx file error: %s", err)
+		}
+
+		return d.idx.addCount(f, -len(metas))
+	})
+	if err != nil {
+		return err
+	}
+
+	return d.idx.sync(ctx)
 }
 
 func migrateFile(ctx context.Context, from string, to string, removeBak bool) error {
@@ -134,6 +476,11 @@ func migrateFile(ctx context.Context, from string, to string, removeBak bool) er
 		return fmt.Errorf("rename new file [%s => %s] error: %s", from, to, err)
 	}
 
+	err = syncDir(filepath.Dir(to))
+	if err != nil {
+		return fmt.Errorf("sync dir of [%s] error: %s", to, err)
+	}
+
 	if removeBak {
 		err = os.RemoveAll(toBackFile)
 		if err != nil {
@@ -0,0 +1,309 @@
+package diskv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 找出 n 个哈希到 slot 的 key
+func keysOfSlot(t *testing.T, db *Diskv, slot int, n int) []string {
+	ctx := context.Background()
+
+	keys := []string{}
+	for i := 0; len(keys) < n; i++ {
+		key := fmt.Sprintf("s%d", i)
+		s, err := db.idx.hashKey(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s == slot {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func idxFileSize(t *testing.T, dir string) int64 {
+	fileInfo, err := os.Stat(filepath.Join(dir, "diskv.idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fileInfo.Size()
+}
+
+func TestWraparound(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	keysLen := 16
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: keysLen, Options: Options{MaxLoad: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	// 哈希到最后一个 slot 的 key，冲突后回到第 0 个 slot
+	keys := keysOfSlot(t, db, keysLen-1, 3)
+	for _, key := range keys {
+		if err := db.SetString(ctx, key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	meta, state, err := db.idx.getValueOfSlot(ctx, 0)
+	if err != nil || state != slotUsed || meta.key != keys[1] {
+		t.Fatalf("unexpected slot 0: %+v %v %v", meta, state, err)
+	}
+
+	tableEnd := int64(dbMetaLen + 32*keysLen)
+	if size := idxFileSize(t, dir); size > tableEnd {
+		t.Fatalf("idx file written beyond the table: %d > %d", size, tableEnd)
+	}
+
+	// 删除链头后，回绕后的 key 仍然可以找到
+	if _, err := db.Del(ctx, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys[1:] {
+		val, ok, err := db.GetString(ctx, key)
+		if err != nil || !ok || val != key {
+			t.Fatalf("get %s error: %q %v %v", key, val, ok, err)
+		}
+	}
+
+	count := 0
+	err = db.ForEach(ctx, func(ctx context.Context, key string, value []byte) bool {
+		count++
+		return true
+	})
+	if err != nil || count != len(keys)-1 {
+		t.Fatalf("unexpected foreach: %d %v", count, err)
+	}
+}
+
+func TestIndexFull(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("no grow", func(t *testing.T) {
+		dir := t.TempDir()
+
+		keysLen := 8
+		db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: keysLen, Options: Options{MaxLoad: -1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for i := 0; i < keysLen; i++ {
+			if err := db.SetString(ctx, fmt.Sprintf("key%d", i), "v"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		size, err := db.dbstore.size(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.SetString(ctx, "more", "v")
+		if !errors.Is(err, ErrIndexFull) {
+			t.Fatalf("should get ErrIndexFull: %v", err)
+		}
+
+		// 写满时不写 db 文件
+		nsize, err := db.dbstore.size(ctx)
+		if err != nil || nsize != size {
+			t.Fatalf("db file should not change: %d => %d %v", size, nsize, err)
+		}
+
+		// 已有的 key 可以覆盖，找不到的 key 转一圈后结束
+		if err := db.SetString(ctx, "key3", "updated"); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok, err := db.Get(ctx, "more"); err != nil || ok {
+			t.Fatalf("get missing key error: %v %v", ok, err)
+		}
+
+		// 删除后空出的 slot 可以写入新的 key
+		if _, err := db.Del(ctx, "key0"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SetString(ctx, "more", "v"); err != nil {
+			t.Fatal(err)
+		}
+		val, ok, err := db.GetString(ctx, "more")
+		if err != nil || !ok || val != "v" {
+			t.Fatalf("get more error: %q %v %v", val, ok, err)
+		}
+	})
+
+	t.Run("grow when full", func(t *testing.T) {
+		dir := t.TempDir()
+
+		// MaxLoad 大于 1 时不会提前扩容，只在写满时扩容
+		db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 8, Options: Options{MaxLoad: 2}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for i := 0; i < 20; i++ {
+			if err := db.SetString(ctx, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		meta, err := db.idx.getIdxMeta(ctx)
+		if err != nil || meta.keysLen != 32 || meta.count != 20 {
+			t.Fatalf("unexpected idx meta: %+v %v", meta, err)
+		}
+		for i := 0; i < 20; i++ {
+			val, ok, err := db.GetString(ctx, fmt.Sprintf("key%d", i))
+			if err != nil || !ok || val != fmt.Sprintf("value%d", i) {
+				t.Fatalf("get key%d error: %q %v %v", i, val, ok, err)
+			}
+		}
+	})
+}
+
+// 旧版本写到 keysLen 之后的 key，打开时移回表内
+func TestOverflowSlots(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	keysLen := 4
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: keysLen, Options: Options{MaxLoad: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := keysOfSlot(t, db, keysLen-1, 6)
+	for _, key := range keys[:keysLen] {
+		if err := db.SetString(ctx, key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 模拟旧版本: 表已满，之后冲突的 key 写到 keysLen 之后
+	for i, key := range keys[keysLen:] {
+		meta, err := db.dbstore.write(ctx, &valueItem{key: key, value: []byte(key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := make([]byte, 32)
+		copy(data, formatValueMeta(meta))
+		err = db.idx.runWithFile(ctx, func(ctx context.Context, f *os.File) error {
+			if _, err := f.WriteAt(data, int64(db.idx.meta.getBlockStartOffset(keysLen+i))); err != nil {
+				return err
+			}
+			return db.idx.addCount(f, 1)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenReadOnly(ctx, dir); err == nil {
+		t.Fatal("read only open should fail with overflow slots")
+	}
+
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	meta, err := db.idx.getIdxMeta(ctx)
+	if err != nil || meta.count != len(keys) || meta.keysLen < len(keys) {
+		t.Fatalf("unexpected idx meta: %+v %v", meta, err)
+	}
+	if size := idxFileSize(t, dir); size > int64(meta.getBlockStartOffset(meta.keysLen)) {
+		t.Fatalf("idx file written beyond the table: %d", size)
+	}
+
+	for _, key := range keys {
+		val, ok, err := db.GetString(ctx, key)
+		if err != nil || !ok || val != key {
+			t.Fatalf("get %s error: %q %v %v", key, val, ok, err)
+		}
+	}
+}
+
+// 移回表内之后、截掉溢出部分之前崩溃，再次打开时不丢 key，也不重复计数
+func TestOverflowSlotsInterrupted(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	keysLen := 8
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: keysLen, Options: Options{MaxLoad: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := keysOfSlot(t, db, keysLen-1, 6)
+	for _, key := range keys[:4] {
+		if err := db.SetString(ctx, key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 溢出的 key 已写回表内 (计数增加)，溢出的部分和它的计数还在
+	for i, key := range keys[4:] {
+		meta, err := db.dbstore.write(ctx, &valueItem{key: key, value: []byte(key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := make([]byte, 32)
+		copy(data, formatValueMeta(meta))
+		err = db.idx.runWithFile(ctx, func(ctx context.Context, f *os.File) error {
+			if _, err := f.WriteAt(data, int64(db.idx.meta.getBlockStartOffset(keysLen+i))); err != nil {
+				return err
+			}
+			return db.idx.addCount(f, 1)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.idx.setValueMeta(ctx, meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	meta, err := db.idx.getIdxMeta(ctx)
+	if err != nil || meta.count != len(keys) || meta.keysLen != keysLen {
+		t.Fatalf("unexpected idx meta: %+v %v", meta, err)
+	}
+	if size := idxFileSize(t, dir); size > int64(meta.getBlockStartOffset(meta.keysLen)) {
+		t.Fatalf("idx file written beyond the table: %d", size)
+	}
+
+	for _, key := range keys {
+		val, ok, err := db.GetString(ctx, key)
+		if err != nil || !ok || val != key {
+			t.Fatalf("get %s error: %q %v %v", key, val, ok, err)
+		}
+	}
+}
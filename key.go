@@ -0,0 +1,119 @@
+package diskv
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInvalidKey = errors.New("invalid key")
+
+const (
+	formatVersion1 = 1 // key 原样存储，记录中没有 value 长度
+	formatVersion2 = 2 // key 转义后存储，记录中带有 value 长度
+
+	currentFormatVersion = formatVersion2
+)
+
+const hexDigits = "0123456789ABCDEF"
+
+// v2 中需要转义的字符: 转义符 % 本身、记录和 idx 中的分隔符、控制字符
+func needEscape(c byte) bool {
+	switch c {
+	case '%', '[', ']', ',', '|', ':':
+		return true
+	}
+
+	return c < 0x20 || c == 0x7f
+}
+
+// 把 key 转换为文件中存储的形式
+// v1: 不转义，包含分隔符的 key 直接拒绝
+// v2: 类似 url 编码，eg: a,b => a%2Cb
+func encodeKey(version int, key string) (string, error) {
+	if version < formatVersion2 {
+		if strings.ContainsAny(key, "],|\n") || (len(key) > 0 && key[0] == 0) {
+			return "", fmt.Errorf("%w: %q contains reserved characters", ErrInvalidKey, key)
+		}
+		return key, nil
+	}
+
+	n := 0
+	for i := 0; i < len(key); i++ {
+		if needEscape(key[i]) {
+			n++
+		}
+	}
+	if n == 0 {
+		return key, nil
+	}
+
+	var b strings.Builder
+	b.Grow(len(key) + 2*n)
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if needEscape(c) {
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0xf])
+			continue
+		}
+		b.WriteByte(c)
+	}
+
+	return b.String(), nil
+}
+
+func decodeKey(version int, key string) (string, error) {
+	if version < formatVersion2 || strings.IndexByte(key, '%') < 0 {
+		return key, nil
+	}
+
+	var b strings.Builder
+	b.Grow(len(key))
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+
+		if i+2 >= len(key) {
+			return "", fmt.Errorf("%w: bad escape in %q", ErrInvalidKey, key)
+		}
+
+		h, ok1 := unhex(key[i+1])
+		l, ok2 := unhex(key[i+2])
+		if !ok1 || !ok2 {
+			return "", fmt.Errorf("%w: bad escape in %q", ErrInvalidKey, key)
+		}
+
+		b.WriteByte(h<<4 | l)
+		i += 2
+	}
+
+	return b.String(), nil
+}
+
+// 把 version 格式存储的 key 转换为最新格式
+func convertKey(version int, key string) (string, error) {
+	key, err := decodeKey(version, key)
+	if err != nil {
+		return "", err
+	}
+
+	return encodeKey(currentFormatVersion, key)
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+
+	return 0, false
+}
@@ -3,6 +3,7 @@ package bboltkv
 import (
 	"context"
 	"errors"
+	"io"
 	"time"
 
 	"github.com/iamlongalong/diskv/kvstore"
@@ -10,6 +11,9 @@ import (
 )
 
 var _ kvstore.KVStorer = (*BboltStore)(nil)
+var _ kvstore.Scanner = (*BboltStore)(nil)
+var _ kvstore.KeyLister = (*BboltStore)(nil)
+var _ io.Closer = (*BboltStore)(nil)
 
 const (
 	DefaultBucketName = "_kvstore"
@@ -101,3 +105,56 @@ func (bs *BboltStore) ForEach(ctx context.Context, fn func(ctx context.Context,
 		})
 	})
 }
+
+// ForEachKey iterates over all the keys in ascending order, the values are not copied.
+func (bs *BboltStore) ForEachKey(ctx context.Context, fn func(ctx context.Context, key string) (ok bool)) error {
+	return bs.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(DefaultBucketName))
+		if bucket == nil {
+			return errors.New("bucket not found")
+		}
+
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if !fn(ctx, string(k)) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// NewIterator returns a pull-style iterator over the keys in ascending order, see kvstore.Iterator.
+func (bs *BboltStore) NewIterator(ctx context.Context, opts kvstore.IteratorOptions) *kvstore.Iterator {
+	return kvstore.NewIterator(ctx, bs, opts)
+}
+
+// Scan iterates over the keys with the prefix in ascending order.
+func (bs *BboltStore) Scan(ctx context.Context, prefix string, fn func(ctx context.Context, key string, value []byte) (ok bool)) error {
+	return bs.Range(ctx, prefix, kvstore.PrefixEnd(prefix), fn)
+}
+
+// Range iterates over the keys in [start, end) in ascending order, seeking to start with a bucket cursor.
+func (bs *BboltStore) Range(ctx context.Context, start, end string, fn func(ctx context.Context, key string, value []byte) (ok bool)) error {
+	return bs.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(DefaultBucketName))
+		if bucket == nil {
+			return errors.New("bucket not found")
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.Seek([]byte(start)); k != nil; k, v = c.Next() {
+			if end != "" && string(k) >= end {
+				break
+			}
+			if !fn(ctx, string(k), v) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *BboltStore) Close() error {
+	return bs.db.Close()
+}
@@ -2,8 +2,11 @@ package bboltkv
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"testing"
+
+	"github.com/iamlongalong/diskv/kvstore"
 )
 
 func TestBboltStore(t *testing.T) {
@@ -81,4 +84,70 @@ func TestBboltStore(t *testing.T) {
 			t.Errorf("missing keys: %v", expectedKeys)
 		}
 	})
+
+	t.Run("ForEachKey", func(t *testing.T) {
+		keys := []string{}
+		err := store.ForEachKey(ctx, func(ctx context.Context, key string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if err != nil {
+			t.Fatalf("failed to iterate over keys: %v", err)
+		}
+		if fmt.Sprint(keys) != "[key2 key3]" {
+			t.Errorf("unexpected keys: %v", keys)
+		}
+	})
+
+	t.Run("Scan and Range", func(t *testing.T) {
+		for _, key := range []string{"a1", "a2", "a*", "b1"} {
+			_ = store.Set(ctx, key, []byte("v-"+key))
+		}
+
+		collect := func(scan func(fn func(ctx context.Context, key string, value []byte) bool) error) string {
+			keys := []string{}
+			err := scan(func(ctx context.Context, key string, value []byte) bool {
+				keys = append(keys, key)
+				return true
+			})
+			if err != nil {
+				t.Fatalf("failed to scan: %v", err)
+			}
+			return fmt.Sprint(keys)
+		}
+
+		if got := collect(func(fn func(ctx context.Context, key string, value []byte) bool) error {
+			return store.Scan(ctx, "a", fn)
+		}); got != "[a* a1 a2]" {
+			t.Errorf("unexpected scan result: %s", got)
+		}
+		if got := collect(func(fn func(ctx context.Context, key string, value []byte) bool) error {
+			return store.Range(ctx, "a2", "key3", fn)
+		}); got != "[a2 b1 key2]" {
+			t.Errorf("unexpected range result: %s", got)
+		}
+		if got := collect(func(fn func(ctx context.Context, key string, value []byte) bool) error {
+			return store.Range(ctx, "b", "", fn)
+		}); got != "[b1 key2 key3]" {
+			t.Errorf("unexpected range result: %s", got)
+		}
+	})
+
+	t.Run("Iterator", func(t *testing.T) {
+		it := store.NewIterator(ctx, kvstore.IteratorOptions{Prefix: "a", PageSize: 2})
+		if !it.Next() || !it.Next() || it.Key() != "a1" {
+			t.Fatalf("unexpected key %q, error: %v", it.Key(), it.Err())
+		}
+		cursor := it.Cursor()
+		it.Close()
+
+		it = store.NewIterator(ctx, kvstore.IteratorOptions{Prefix: "a", Cursor: cursor, PageSize: 2})
+		defer it.Close()
+		if !it.Next() || it.Key() != "a2" || string(it.Value()) != "v-a2" || it.Next() {
+			t.Fatalf("unexpected key %q, error: %v", it.Key(), it.Err())
+		}
+		if it.Err() != nil || it.Cursor() != "" {
+			t.Errorf("iteration should finish: %v %q", it.Err(), it.Cursor())
+		}
+	})
 }
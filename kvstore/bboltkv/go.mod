@@ -10,3 +10,6 @@ require (
 )
 
 require golang.org/x/sys v0.4.0 // indirect
+
+// the backends use APIs that are not released yet, build them against this repository
+replace github.com/iamlongalong/diskv => ../..
@@ -3,6 +3,7 @@ package etcdkv
 import (
 	"context"
 	"fmt"
+	"io"
 	"time"
 
 	"github.com/iamlongalong/diskv/kvstore"
@@ -10,6 +11,9 @@ import (
 )
 
 var _ kvstore.KVStorer = (*EtcdStore)(nil)
+var _ kvstore.Scanner = (*EtcdStore)(nil)
+var _ kvstore.KeyLister = (*EtcdStore)(nil)
+var _ io.Closer = (*EtcdStore)(nil)
 
 type EtcdStore struct {
 	client *clientv3.Client
@@ -70,3 +74,78 @@ func (es *EtcdStore) ForEach(ctx context.Context, fn func(ctx context.Context, k
 	}
 	return nil
 }
+
+// ForEachKey iterates over all the keys with keys-only requests, the values are not transferred.
+// It pages through the keys like Range.
+func (es *EtcdStore) ForEachKey(ctx context.Context, fn func(ctx context.Context, key string) bool) error {
+	return es.rangeBatches(ctx, "", "", true, func(key string, _ []byte) bool {
+		return fn(ctx, key)
+	})
+}
+
+// NewIterator returns a pull-style iterator over the keys in ascending order, see kvstore.Iterator.
+func (es *EtcdStore) NewIterator(ctx context.Context, opts kvstore.IteratorOptions) *kvstore.Iterator {
+	return kvstore.NewIterator(ctx, es, opts)
+}
+
+// Scan iterates over the keys with the prefix in ascending order.
+func (es *EtcdStore) Scan(ctx context.Context, prefix string, fn func(ctx context.Context, key string, value []byte) bool) error {
+	return es.Range(ctx, prefix, kvstore.PrefixEnd(prefix), fn)
+}
+
+// rangeBatchSize is the number of keys Range fetches with one request, the same as an Iterator page.
+const rangeBatchSize = kvstore.DefaultPageSize
+
+// Range iterates over the keys in [start, end) in ascending order.
+// It fetches rangeBatchSize keys at a time and stops fetching once fn returns false,
+// all the batches are read at the revision of the first one.
+func (es *EtcdStore) Range(ctx context.Context, start, end string, fn func(ctx context.Context, key string, value []byte) bool) error {
+	return es.rangeBatches(ctx, start, end, false, func(key string, value []byte) bool {
+		return fn(ctx, key, value)
+	})
+}
+
+// rangeBatches implements Range and ForEachKey, an empty end means no upper bound.
+// With keysOnly the values are not transferred and fn gets nil values.
+func (es *EtcdStore) rangeBatches(ctx context.Context, start, end string, keysOnly bool, fn func(key string, value []byte) bool) error {
+	if start == "" {
+		start = "\x00" // etcd does not accept an empty key
+	}
+
+	var rev int64
+	for {
+		opts := []clientv3.OpOption{
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+			clientv3.WithLimit(rangeBatchSize),
+			clientv3.WithRev(rev),
+		}
+		if keysOnly {
+			opts = append(opts, clientv3.WithKeysOnly())
+		}
+		if end == "" {
+			opts = append(opts, clientv3.WithFromKey())
+		} else {
+			opts = append(opts, clientv3.WithRange(end))
+		}
+
+		resp, err := es.client.Get(ctx, start, opts...)
+		if err != nil {
+			return err
+		}
+		for _, kv := range resp.Kvs {
+			if !fn(string(kv.Key), kv.Value) {
+				return nil
+			}
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return nil
+		}
+
+		rev = resp.Header.Revision
+		start = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00" // the next key after the last one
+	}
+}
+
+func (es *EtcdStore) Close() error {
+	return es.client.Close()
+}
@@ -2,6 +2,8 @@ package etcdkv
 
 import (
 	"context"
+	"fmt"
+	"sort"
 	"testing"
 	"time"
 
@@ -79,4 +81,26 @@ func TestEtcdStore(t *testing.T) {
 	assert.Equal(t, 2, len(keys))
 	assert.Equal(t, []byte("value1"), keys["key1"])
 	assert.Equal(t, []byte("value2"), keys["key2"])
+
+	// Test ForEachKey across more than one page
+	for i := 0; i < rangeBatchSize+10; i++ {
+		err = store.Set(ctx, fmt.Sprintf("page%04d", i), []byte("v"))
+		assert.NoError(t, err)
+	}
+	listed := []string{}
+	err = store.ForEachKey(ctx, func(ctx context.Context, k string) bool {
+		listed = append(listed, k)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, rangeBatchSize+12, len(listed))
+	assert.True(t, sort.StringsAreSorted(listed))
+
+	listed = listed[:0]
+	err = store.ForEachKey(ctx, func(ctx context.Context, k string) bool {
+		listed = append(listed, k)
+		return len(listed) < 3
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(listed))
 }
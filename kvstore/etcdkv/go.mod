@@ -75,3 +75,6 @@ require (
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 	sigs.k8s.io/yaml v1.2.0 // indirect
 )
+
+// the backends use APIs that are not released yet, build them against this repository
+replace github.com/iamlongalong/diskv => ../..
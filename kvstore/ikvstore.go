@@ -1,6 +1,10 @@
 package kvstore
 
-import "context"
+import (
+	"context"
+	"io"
+	"sort"
+)
 
 // KVStorer is a simple key-value store interface.
 // It is used by the gkv package to store the values.
@@ -13,3 +17,115 @@ type KVStorer interface {
 	Del(ctx context.Context, key string) (ok bool, err error)
 	ForEach(ctx context.Context, fn func(ctx context.Context, key string, value []byte) (ok bool)) error
 }
+
+// Close closes the store if it implements io.Closer, otherwise it does nothing.
+// diskv and all the stores in this directory implement io.Closer.
+func Close(store KVStorer) error {
+	if c, ok := store.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// Scanner is an optional interface for stores that can iterate over the keys in order.
+// Use the Scan and Range functions to fall back to ForEach for the other stores.
+type Scanner interface {
+	// Scan iterates over the keys with the given prefix in ascending order.
+	Scan(ctx context.Context, prefix string, fn func(ctx context.Context, key string, value []byte) (ok bool)) error
+
+	// Range iterates over the keys in [start, end) in ascending order, an empty end means no upper bound.
+	Range(ctx context.Context, start, end string, fn func(ctx context.Context, key string, value []byte) (ok bool)) error
+}
+
+// Scan calls store.Scan if it implements Scanner,
+// otherwise it lists all the keys with ForEachKey and calls fn on the ones with the prefix in sorted order.
+func Scan(ctx context.Context, store KVStorer, prefix string, fn func(ctx context.Context, key string, value []byte) (ok bool)) error {
+	if s, ok := store.(Scanner); ok {
+		return s.Scan(ctx, prefix, fn)
+	}
+
+	return rangeByForEach(ctx, store, prefix, PrefixEnd(prefix), fn)
+}
+
+// Range calls store.Range if it implements Scanner,
+// otherwise it lists all the keys with ForEachKey and calls fn on the ones in [start, end) in sorted order.
+func Range(ctx context.Context, store KVStorer, start, end string, fn func(ctx context.Context, key string, value []byte) (ok bool)) error {
+	if s, ok := store.(Scanner); ok {
+		return s.Range(ctx, start, end, fn)
+	}
+
+	return rangeByForEach(ctx, store, start, end, fn)
+}
+
+// KeyLister is an optional interface for stores that can iterate over the keys without reading the values.
+// Use the ForEachKey function to fall back to ForEach for the other stores.
+type KeyLister interface {
+	// ForEachKey iterates over all the keys, in no particular order.
+	ForEachKey(ctx context.Context, fn func(ctx context.Context, key string) (ok bool)) error
+}
+
+// ForEachKey calls store.ForEachKey if it implements KeyLister, otherwise it calls ForEach and drops the values.
+func ForEachKey(ctx context.Context, store KVStorer, fn func(ctx context.Context, key string) (ok bool)) error {
+	if l, ok := store.(KeyLister); ok {
+		return l.ForEachKey(ctx, fn)
+	}
+
+	return store.ForEach(ctx, func(ctx context.Context, key string, value []byte) bool {
+		return fn(ctx, key)
+	})
+}
+
+// PrefixEnd returns the smallest key greater than all the keys with the prefix,
+// so that Scan(prefix) equals to Range(prefix, PrefixEnd(prefix)).
+// It returns "" (no upper bound) if there is no such key, eg: the prefix is empty or all \xff.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+
+	return ""
+}
+
+// InRange reports whether key is in [start, end), an empty end means no upper bound.
+func InRange(key, start, end string) bool {
+	return key >= start && (end == "" || key < end)
+}
+
+// rangeByForEach lists all the keys of the store to find the ones in [start, end), so each call costs a full pass over the keys.
+// Only the keys in range are kept, the values are read with Get while fn asks for more,
+// keys deleted after the listing are skipped.
+func rangeByForEach(ctx context.Context, store KVStorer, start, end string, fn func(ctx context.Context, key string, value []byte) (ok bool)) error {
+	keys := []string{}
+	err := ForEachKey(ctx, store, func(ctx context.Context, key string) bool {
+		if InRange(key, start, end) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, ok, err := store.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		if !fn(ctx, key, value) {
+			break
+		}
+	}
+
+	return nil
+}
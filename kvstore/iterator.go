@@ -0,0 +1,177 @@
+package kvstore
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+)
+
+// DefaultPageSize is the number of keys an Iterator fetches from the store at a time.
+const DefaultPageSize = 256
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// IteratorOptions configures NewIterator.
+type IteratorOptions struct {
+	Prefix string // only iterate over the keys with the prefix
+
+	// Cursor resumes the iteration after the key it was taken at, see Iterator.Cursor.
+	// The prefix should be the same as the one the cursor was taken with.
+	Cursor string
+
+	PageSize int // defaults to DefaultPageSize
+}
+
+// Iterator is a pull-style iterator over the keys of a store in ascending order.
+//
+//	it := kvstore.NewIterator(ctx, store, kvstore.IteratorOptions{Prefix: "user:"})
+//	defer it.Close()
+//	for it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil { ... }
+//
+// It fetches a page of keys with Range at a time and holds nothing of the store between the pages,
+// so it can be paused for as long as needed, and resumed later (eg: in the next http request) with Cursor.
+// Keys written during the iteration are seen if they are after the current page.
+// An Iterator is not safe for concurrent use.
+type Iterator struct {
+	ctx   context.Context
+	store KVStorer
+	opts  IteratorOptions
+
+	start string // start of the next page
+	end   string
+	page  []iterEntry
+	pos   int
+	last  bool // no more keys after the current page
+
+	key    string
+	value  []byte
+	cursor string // last key returned by Next, kept after the iteration stops
+	moved  bool   // Next has returned a key
+	done   bool   // no more keys
+	closed bool
+	err    error
+}
+
+type iterEntry struct {
+	key   string
+	value []byte
+}
+
+// NewIterator returns an iterator over the keys of store, using the Range of the store if it implements Scanner.
+func NewIterator(ctx context.Context, store KVStorer, opts IteratorOptions) *Iterator {
+	if opts.PageSize <= 0 {
+		opts.PageSize = DefaultPageSize
+	}
+
+	it := &Iterator{ctx: ctx, store: store, opts: opts, start: opts.Prefix, end: PrefixEnd(opts.Prefix)}
+	if opts.Cursor != "" {
+		key, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			it.err = err
+			return it
+		}
+
+		if after := key + "\x00"; after > it.start {
+			it.start = after
+		}
+	}
+
+	return it
+}
+
+// Next moves to the next key, it returns false when there are no more keys or an error occurs.
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.done || it.closed {
+		return false
+	}
+
+	if it.pos >= len(it.page) {
+		if !it.last {
+			it.err = it.fetch()
+		}
+		if it.err != nil || it.pos >= len(it.page) {
+			it.done = it.err == nil
+			it.key, it.value = "", nil
+			return false
+		}
+	}
+
+	e := it.page[it.pos]
+	it.page[it.pos] = iterEntry{}
+	it.pos++
+
+	it.key, it.value = e.key, e.value
+	it.cursor, it.moved = e.key, true
+	return true
+}
+
+func (it *Iterator) fetch() error {
+	if err := it.ctx.Err(); err != nil {
+		return err
+	}
+
+	page := make([]iterEntry, 0, it.opts.PageSize)
+	err := Range(it.ctx, it.store, it.start, it.end, func(ctx context.Context, key string, value []byte) bool {
+		page = append(page, iterEntry{key: key, value: append([]byte{}, value...)})
+		return len(page) < it.opts.PageSize
+	})
+	if err != nil {
+		return err
+	}
+
+	it.page, it.pos = page, 0
+	it.last = len(page) < it.opts.PageSize
+	if len(page) > 0 {
+		it.start = page[len(page)-1].key + "\x00"
+	}
+
+	return nil
+}
+
+// Key returns the current key.
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns the value of the current key, it is not changed by the following calls to Next.
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the fetched page, Next returns false after Close, Cursor is still valid.
+func (it *Iterator) Close() error {
+	it.closed = true
+	it.page, it.key, it.value = nil, "", nil
+	return nil
+}
+
+// Cursor returns an opaque token to resume the iteration after the current key with IteratorOptions.Cursor.
+// It is safe to use in urls, and it is "" once the iteration has finished (no more keys).
+// After an error, it still resumes after the last key returned by Next.
+func (it *Iterator) Cursor() string {
+	if it.done {
+		return ""
+	}
+	if !it.moved {
+		return it.opts.Cursor
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(it.cursor))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+
+	return string(key), nil
+}
@@ -18,3 +18,6 @@ require (
 )
 
 replace google.golang.org/grpc/naming => google.golang.org/grpc v1.29.1
+
+// the backends use APIs that are not released yet, build them against this repository
+replace github.com/iamlongalong/diskv => ../..
@@ -3,12 +3,18 @@ package rediskv
 import (
 	"context"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/iamlongalong/diskv/kvstore"
 )
 
 var _ kvstore.KVStorer = (*RedisStore)(nil)
+var _ kvstore.Scanner = (*RedisStore)(nil)
+var _ kvstore.KeyLister = (*RedisStore)(nil)
+var _ io.Closer = (*RedisStore)(nil)
 
 // RedisStore represents a Redis key-value store with a prefix.
 type RedisStore struct {
@@ -77,3 +83,83 @@ func (rs *RedisStore) ForEach(ctx context.Context, fn func(ctx context.Context,
 	}
 	return iter.Err()
 }
+
+// ForEachKey iterates over all keys with the given prefix in the Redis store with SCAN only, the values are not read.
+// SCAN may return a key more than once.
+func (rs *RedisStore) ForEachKey(ctx context.Context, fn func(ctx context.Context, key string) bool) error {
+	pattern := fmt.Sprintf("%s:*", rs.prefix)
+	iter := rs.client.Scan(ctx, 0, pattern, 0).Iterator()
+	for iter.Next(ctx) {
+		if !fn(ctx, iter.Val()[len(rs.prefix)+1:]) {
+			break
+		}
+	}
+	return iter.Err()
+}
+
+// NewIterator returns a pull-style iterator over the keys in ascending order, see kvstore.Iterator.
+func (rs *RedisStore) NewIterator(ctx context.Context, opts kvstore.IteratorOptions) *kvstore.Iterator {
+	return kvstore.NewIterator(ctx, rs, opts)
+}
+
+// Scan iterates over the keys with the prefix in ascending order.
+// Only the keys matching the prefix are returned by SCAN, they are sorted on the client side.
+func (rs *RedisStore) Scan(ctx context.Context, prefix string, fn func(ctx context.Context, key string, value []byte) bool) error {
+	pattern := fmt.Sprintf("%s:%s*", rs.prefix, escapePattern(prefix))
+	return rs.scanSorted(ctx, pattern, prefix, kvstore.PrefixEnd(prefix), fn)
+}
+
+// Range iterates over the keys in [start, end) in ascending order.
+// Redis keeps no order of the keys, so all the keys of the store are scanned and sorted on the client side.
+func (rs *RedisStore) Range(ctx context.Context, start, end string, fn func(ctx context.Context, key string, value []byte) bool) error {
+	pattern := fmt.Sprintf("%s:*", rs.prefix)
+	return rs.scanSorted(ctx, pattern, start, end, fn)
+}
+
+func (rs *RedisStore) scanSorted(ctx context.Context, pattern string, start, end string, fn func(ctx context.Context, key string, value []byte) bool) error {
+	keys := []string{}
+	iter := rs.client.Scan(ctx, 0, pattern, 0).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()[len(rs.prefix)+1:]
+		if kvstore.InRange(key, start, end) {
+			keys = append(keys, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	sort.Strings(keys)
+
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] { // SCAN may return a key more than once
+			continue
+		}
+
+		value, ok, err := rs.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if ok && !fn(ctx, key, value) {
+			break
+		}
+	}
+	return nil
+}
+
+// escapePattern escapes the glob-style special characters of SCAN MATCH.
+func escapePattern(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Close closes the Redis client.
+func (rs *RedisStore) Close() error {
+	return rs.client.Close()
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis/v8"
+	"github.com/iamlongalong/diskv/kvstore"
 )
 
 var mr *miniredis.Miniredis
@@ -149,3 +150,105 @@ func TestForEach(t *testing.T) {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 }
+
+func TestForEachKey(t *testing.T) {
+	store := setup()
+	ctx := context.Background()
+
+	for _, key := range []string{"key7", "key8"} {
+		if err := store.Set(ctx, key, []byte("value")); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	keys := map[string]bool{}
+	err := store.ForEachKey(ctx, func(ctx context.Context, key string) bool {
+		keys[key] = true
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !keys["key7"] || !keys["key8"] {
+		t.Errorf("Missing keys: %v", keys)
+	}
+}
+
+func TestScanAndRange(t *testing.T) {
+	store := setup()
+	ctx := context.Background()
+
+	for _, key := range []string{"b1", "a2", "a*", "a1", "c1"} {
+		err := store.Set(ctx, key, []byte("v-"+key))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	collect := func(scan func(fn func(ctx context.Context, key string, value []byte) bool) error) string {
+		keys := []string{}
+		err := scan(func(ctx context.Context, key string, value []byte) bool {
+			if string(value) != "v-"+key {
+				t.Errorf("Unexpected key-value pair: %s=%s", key, value)
+			}
+			keys = append(keys, key)
+			return true
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return fmt.Sprint(keys)
+	}
+
+	// * in the prefix is matched literally
+	if got := collect(func(fn func(ctx context.Context, key string, value []byte) bool) error {
+		return store.Scan(ctx, "a*", fn)
+	}); got != "[a*]" {
+		t.Fatalf("Unexpected scan result: %s", got)
+	}
+	if got := collect(func(fn func(ctx context.Context, key string, value []byte) bool) error {
+		return store.Scan(ctx, "a", fn)
+	}); got != "[a* a1 a2]" {
+		t.Fatalf("Unexpected scan result: %s", got)
+	}
+	if got := collect(func(fn func(ctx context.Context, key string, value []byte) bool) error {
+		return store.Range(ctx, "a2", "c1", fn)
+	}); got != "[a2 b1]" {
+		t.Fatalf("Unexpected range result: %s", got)
+	}
+}
+
+func TestIterator(t *testing.T) {
+	store := setup()
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("key%d", i)
+		err := store.Set(ctx, key, []byte(key))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	keys := []string{}
+	cursor := ""
+	for {
+		it := store.NewIterator(ctx, kvstore.IteratorOptions{Cursor: cursor, PageSize: 2})
+		for i := 0; i < 2 && it.Next(); i++ { // 2 keys per request
+			keys = append(keys, it.Key())
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		cursor = it.Cursor()
+		it.Close()
+
+		if cursor == "" {
+			break
+		}
+	}
+
+	if fmt.Sprint(keys) != "[key0 key1 key2 key3 key4]" {
+		t.Fatalf("Unexpected keys: %v", keys)
+	}
+}
@@ -7,3 +7,6 @@ require github.com/mattn/go-sqlite3 v1.14.24
 require github.com/iamlongalong/diskv v0.1.0
 
 replace google.golang.org/grpc/naming => google.golang.org/grpc v1.29.1
+
+// the backends use APIs that are not released yet, build them against this repository
+replace github.com/iamlongalong/diskv => ../..
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 
 	_ "github.com/mattn/go-sqlite3"
 
@@ -12,6 +13,9 @@ import (
 )
 
 var _ kvstore.KVStorer = (*SqliteStore)(nil)
+var _ kvstore.Scanner = (*SqliteStore)(nil)
+var _ kvstore.KeyLister = (*SqliteStore)(nil)
+var _ io.Closer = (*SqliteStore)(nil)
 
 // SqliteStore represents a key-value store implemented with SQLite.
 type SqliteStore struct {
@@ -86,7 +90,79 @@ func (ss *SqliteStore) ForEach(ctx context.Context, fn func(ctx context.Context,
 	if err != nil {
 		return err
 	}
-	defer func() { err = rows.Close() }()
+	defer func() {
+		// keep the Scan or Err error, report the Close error only if there is none
+		if cerr := rows.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err = rows.Scan(&key, &value); err != nil {
+			return err
+		}
+
+		if !fn(ctx, key, value) {
+			break
+		}
+	}
+
+	return rows.Err()
+}
+
+// ForEachKey iterates over each key in the store without reading the values.
+func (ss *SqliteStore) ForEachKey(ctx context.Context, fn func(ctx context.Context, key string) (ok bool)) (err error) {
+	var rows *sql.Rows
+	rows, err = ss.db.QueryContext(ctx, `SELECT key FROM kv`)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// keep the Scan or Err error, report the Close error only if there is none
+		if cerr := rows.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return err
+		}
+
+		if !fn(ctx, key) {
+			break
+		}
+	}
+
+	return rows.Err()
+}
+
+// NewIterator returns a pull-style iterator over the keys in ascending order, see kvstore.Iterator.
+func (ss *SqliteStore) NewIterator(ctx context.Context, opts kvstore.IteratorOptions) *kvstore.Iterator {
+	return kvstore.NewIterator(ctx, ss, opts)
+}
+
+// Scan iterates over the keys with the prefix in ascending order.
+func (ss *SqliteStore) Scan(ctx context.Context, prefix string, fn func(ctx context.Context, key string, value []byte) (ok bool)) error {
+	return ss.Range(ctx, prefix, kvstore.PrefixEnd(prefix), fn)
+}
+
+// Range iterates over the keys in [start, end) in ascending order.
+// Keys are compared with the default BINARY collation, which is the same as comparing Go strings.
+func (ss *SqliteStore) Range(ctx context.Context, start, end string, fn func(ctx context.Context, key string, value []byte) (ok bool)) error {
+	query, args := `SELECT key, value FROM kv WHERE key >= ? ORDER BY key`, []interface{}{start}
+	if end != "" {
+		query, args = `SELECT key, value FROM kv WHERE key >= ? AND key < ? ORDER BY key`, append(args, end)
+	}
+
+	rows, err := ss.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var key string
@@ -102,3 +178,8 @@ func (ss *SqliteStore) ForEach(ctx context.Context, fn func(ctx context.Context,
 
 	return rows.Err()
 }
+
+// Close closes the underlying database.
+func (ss *SqliteStore) Close() error {
+	return ss.db.Close()
+}
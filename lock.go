@@ -0,0 +1,57 @@
+package diskv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// 目录已被其他进程 (或同一进程中未关闭的 db) 打开
+var ErrLocked = errors.New("db is locked by another process")
+
+func (d *Diskv) lockFileName(dir string) string {
+	return filepath.Join(dir, "diskv.lock")
+}
+
+// 对 db 目录加锁，防止多个进程同时写入
+// exclusive 为 false 时加共享锁，可以有多个只读的进程同时打开
+// 只读打开不创建锁文件，目录中没有锁文件时 (如只读的备份目录) 不加锁
+func (d *Diskv) lockDir(dir string, exclusive bool) error {
+	flag := os.O_CREATE | os.O_RDWR
+	if !exclusive {
+		flag = os.O_RDONLY
+	}
+
+	f, err := os.OpenFile(d.lockFileName(dir), flag, 0666)
+	if err != nil {
+		if !exclusive && os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("open lock file error: %s", err)
+	}
+
+	err = lockFile(f, exclusive)
+	if err != nil {
+		f.Close()
+		if errors.Is(err, ErrLocked) {
+			return fmt.Errorf("%w: %s", ErrLocked, dir)
+		}
+		return fmt.Errorf("lock db dir error: %s", err)
+	}
+
+	d.lock = f
+
+	return nil
+}
+
+// 关闭文件即释放锁
+func (d *Diskv) unlockDir() error {
+	if d.lock == nil {
+		return nil
+	}
+
+	err := d.lock.Close()
+	d.lock = nil
+	return err
+}
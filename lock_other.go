@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+
+package diskv
+
+import "os"
+
+// 没有 flock 的平台 (windows、solaris、aix 等) 暂不加锁
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
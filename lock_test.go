@@ -0,0 +1,58 @@
+package diskv
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+)
+
+func TestLockDir(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd", "netbsd", "openbsd", "dragonfly":
+	default:
+		t.Skip("flock is not supported")
+	}
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flock 按打开的文件加锁，同一进程中重复打开也会冲突
+	_, err = OpenDB(ctx, dir)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expect ErrLocked, got %v", err)
+	}
+
+	_, err = CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 100})
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expect ErrLocked, got %v", err)
+	}
+
+	_, err = RebuildIndex(ctx, &CreateConfig{Dir: dir})
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expect ErrLocked, got %v", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// 共享锁与排他锁互斥
+	other := &Diskv{}
+	err = other.lockDir(dir, false)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expect ErrLocked, got %v", err)
+	}
+}
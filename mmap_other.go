@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !dragonfly
+
+package diskv
+
+import (
+	"errors"
+	"os"
+)
+
+// 暂不支持 mmap 的平台不映射，idx 仍按文件读写
+func mmapFile(f *os.File, length int, writable bool) ([]byte, error) {
+	return nil, nil
+}
+
+func munmap(data []byte) error {
+	return nil
+}
+
+func msync(data []byte) error {
+	return errors.New("mmap not supported")
+}
@@ -0,0 +1,153 @@
+package diskv
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestMmap(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 40, KeysLen: 64, Options: Options{Mmap: true, Sync: SyncAlways}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	if db.idx.mm == nil {
+		t.Fatal("idx should be mapped")
+	}
+
+	keys := 200 // 超过 KeysLen，期间自动扩容后重新映射
+	for i := 0; i < keys; i++ {
+		if err := db.SetString(ctx, fmt.Sprintf("key%d", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < keys; i += 4 {
+		if _, err := db.Del(ctx, fmt.Sprintf("key%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.bg.Wait()
+
+	check := func(t *testing.T, db *Diskv) {
+		for i := 0; i < keys; i++ {
+			val, ok, err := db.GetString(ctx, fmt.Sprintf("key%d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != (i%4 != 0) || (ok && val != fmt.Sprint(i)) {
+				t.Fatalf("get key%d error: %q %v", i, val, ok)
+			}
+		}
+
+		if db.idx.meta.count != keys-keys/4 {
+			t.Fatalf("unexpected count: %d", db.idx.meta.count)
+		}
+	}
+	check(t, db)
+
+	if db.idx.mm == nil || len(db.idx.mm) != db.idx.meta.getBlockStartOffset(db.idx.meta.keysLen) {
+		t.Fatal("idx should be mapped after grow")
+	}
+
+	// 映射中的写入关闭后已写回文件，不用 mmap 也能读到
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenDB(ctx, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.idx.mm != nil {
+			t.Fatal("idx should not be mapped")
+		}
+		check(t, db)
+	})
+
+	t.Run("read only", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenDBWithConfig(ctx, &OpenConfig{Dir: dir, ReadOnly: true, Options: Options{Mmap: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.idx.mm == nil {
+			t.Fatal("idx should be mapped")
+		}
+		check(t, db)
+	})
+
+	t.Run("migrate", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenDBWithConfig(ctx, &OpenConfig{Dir: dir, Options: Options{Mmap: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.MigrateIdx(ctx, &CreateConfig{MaxLen: 40, KeysLen: 512, Probe: ProbeRobinHood})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+
+		if err := db.MigrateValue(ctx); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+		if db.idx.mm == nil {
+			t.Fatal("idx should be mapped after migrate")
+		}
+	})
+}
+
+// 并发读写映射中的 slot，用 -race 检查
+func TestMmapConcurrent(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: t.TempDir(), MaxLen: 40, KeysLen: 1000, Options: Options{Mmap: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	keys := 100
+	for i := 0; i < keys; i++ {
+		if err := db.SetString(ctx, fmt.Sprintf("key%d", i), "0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("key%d", (i*7+w)%keys)
+				if w%2 == 0 {
+					if err := db.SetString(ctx, key, fmt.Sprint(i)); err != nil {
+						t.Error(err)
+						return
+					}
+					continue
+				}
+
+				if _, ok, err := db.Get(ctx, key); err != nil || !ok {
+					t.Errorf("get %s error: %v %v", key, ok, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
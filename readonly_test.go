@@ -0,0 +1,155 @@
+package diskv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		err = db.SetString(ctx, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := func() map[string][]byte {
+		files := map[string][]byte{}
+		for _, name := range []string{"diskv.db", "diskv.idx"} {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[name] = data
+		}
+		return files
+	}
+	before := snapshot()
+
+	rdb, err := OpenReadOnly(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 多个只读的 db 可以同时打开，但不能再以读写方式打开
+	rdb2, err := OpenReadOnly(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenDB(ctx, dir)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expect ErrLocked, got %v", err)
+	}
+
+	val, ok, err := rdb.GetString(ctx, "key1")
+	if err != nil || !ok || val != "value1" {
+		t.Fatalf("get key1 error: %q %v %v", val, ok, err)
+	}
+	has, err := rdb2.Has(ctx, "key9")
+	if err != nil || !has {
+		t.Fatalf("key9 should exist: %v %v", has, err)
+	}
+
+	count := 0
+	err = rdb.ForEach(ctx, func(ctx context.Context, key string, value []byte) bool {
+		count++
+		return true
+	})
+	if err != nil || count != 10 {
+		t.Fatalf("foreach error: %d %v", count, err)
+	}
+
+	if err = rdb.Set(ctx, "key1", nil); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expect ErrReadOnly, got %v", err)
+	}
+	if _, err = rdb.Del(ctx, "key1"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expect ErrReadOnly, got %v", err)
+	}
+	if err = rdb.MigrateIdx(ctx, &CreateConfig{MaxLen: 32, KeysLen: 200}); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expect ErrReadOnly, got %v", err)
+	}
+	if err = rdb.MigrateValue(ctx); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expect ErrReadOnly, got %v", err)
+	}
+	if err = rdb.MigrateValueOnline(ctx, nil); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expect ErrReadOnly, got %v", err)
+	}
+
+	for _, d := range []*Diskv{rdb, rdb2} {
+		err = d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, data := range snapshot() {
+		if !bytes.Equal(data, before[name]) {
+			t.Fatalf("%s is modified by read only db", name)
+		}
+	}
+
+	// 只读打开不在目录中创建任何文件，包括锁文件
+	t.Run("no lock file", func(t *testing.T) {
+		listDir := func() []string {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			return names
+		}
+
+		err := os.Remove(filepath.Join(dir, "diskv.lock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := listDir()
+
+		rdb, err := OpenReadOnly(ctx, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		val, ok, err := rdb.GetString(ctx, "key1")
+		if err != nil || !ok || val != "value1" {
+			t.Fatalf("get key1 error: %q %v %v", val, ok, err)
+		}
+		err = rdb.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := listDir(); fmt.Sprint(got) != fmt.Sprint(names) {
+			t.Fatalf("dir is modified by read only db: %v => %v", names, got)
+		}
+	})
+
+	t.Run("missing idx", func(t *testing.T) {
+		dir := t.TempDir()
+		_, err := OpenDBWithConfig(ctx, &OpenConfig{Dir: dir, ReadOnly: true, RebuildIdx: true})
+		if err == nil {
+			t.Fatal("should not create files in read only mode")
+		}
+		if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+			t.Fatalf("no file should be created: %v %v", entries, err)
+		}
+	})
+}
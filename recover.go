@@ -0,0 +1,533 @@
+package diskv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// 记录不完整，一般出现在 db 文件的尾部 (写入过程中进程退出)
+var errIncompleteRecord = errors.New("incomplete record")
+
+// db 文件中的一条记录
+type logRecord struct {
+	op     string
+	seg    int
+	offset int
+	length int
+	item   *valueItem
+
+	version int // 记录的格式版本
+
+	err error // 记录无法解析 (损坏或不完整) 时不为空
+}
+
+func (r *logRecord) valueMeta() *valueMeta {
+	return &valueMeta{
+		key:    r.item.key,
+		seg:    r.seg,
+		offset: r.offset,
+		length: r.length,
+		expire: r.item.expire,
+	}
+}
+
+type RebuildResult struct {
+	Records int // 回放的记录数
+	Keys    int // 重建后有效的 key 数量
+
+	MaxLen  int // 重建后 idx 的 block 长度
+	KeysLen int // 重建后 idx 预分配的 key 数量
+}
+
+// 判断是否为一条记录的开头, eg: _set[ _del[ _set: _bat:
+func isRecordStart(data []byte) bool {
+	if len(data) < len(opSet)+1 {
+		return false
+	}
+
+	switch string(data[:len(opSet)]) {
+	case opSet, opDel, opBatch, opCommit:
+	default:
+		return false
+	}
+
+	return data[len(opSet)] == '[' || data[len(opSet)] == ':'
+}
+
+// 从 from 开始顺序读取 db 文件中的记录
+// v2 的记录带有 value 的长度，直接按长度读取
+// v1 的记录没有 value 的长度，value 中也可能包含 '\n'，因此以 "'\n' + 下一条记录的开头" 或文件结尾作为一条记录的结束
+// 无法解析的记录也会回调，rec.err 不为空，由调用方决定如何处理
+// batch 的一组记录读到提交标记后才回调，没有提交的一组记录作为一条无法解析的记录回调，见 readBatch
+func scanLog(ctx context.Context, f *os.File, from int64, fn func(rec *logRecord) bool) (end int64, err error) {
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return from, err
+	}
+
+	r := bufio.NewReaderSize(io.NewSectionReader(f, from, fileInfo.Size()-from), 64*1024)
+	offset := from
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return offset, err
+		}
+
+		rec, err := readLogRecord(r, offset)
+		if err != nil {
+			return offset, err
+		}
+		if rec == nil { // 正常结束
+			return offset, nil
+		}
+
+		recs := []*logRecord{rec}
+		if rec.op == opBatch {
+			recs, err = readBatch(r, rec)
+			if err != nil {
+				return offset, err
+			}
+		}
+
+		for _, rec := range recs {
+			if !fn(rec) {
+				return int64(rec.offset + rec.length), nil
+			}
+
+			offset = int64(rec.offset + rec.length)
+		}
+
+		if rec := recs[len(recs)-1]; errors.Is(rec.err, errIncompleteRecord) {
+			return offset, nil
+		}
+	}
+}
+
+// 读取并解析 offset 处的一条记录，读到文件结尾时返回 nil
+// 不完整的记录 rec.err 为 errIncompleteRecord，之后不再有记录
+func readLogRecord(r *bufio.Reader, offset int64) (*logRecord, error) {
+	data, err := readRecord(r)
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		if len(data) == 0 {
+			return nil, nil
+		}
+
+		return &logRecord{offset: int(offset), length: len(data), err: errIncompleteRecord}, nil
+	}
+
+	rec := &logRecord{offset: int(offset), length: len(data)}
+	rec.op, rec.item, rec.err = decodeRecord(data)
+	if rec.err != nil {
+		rec.op, rec.item = "", nil
+	}
+
+	rec.version = formatVersion1
+	if i := bytes.IndexByte(data, '['); i > 0 {
+		if head, err := parseRecordHead(string(data[:i])); err == nil && head.valueLen >= 0 {
+			rec.version = formatVersion2
+		}
+	}
+
+	return rec, nil
+}
+
+// 读取一条记录的原始数据，数据不完整时返回 io.EOF
+func readRecord(r *bufio.Reader) ([]byte, error) {
+	data, err := r.ReadBytes(']') // op 头部 + [key]
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = io.EOF
+		}
+		return data, err
+	}
+
+	if i := bytes.IndexByte(data, '['); i > 0 {
+		head, err := parseRecordHead(string(data[:i]))
+		if err == nil && head.valueLen >= 0 {
+			rest := make([]byte, head.valueLen+1)
+			n, err := io.ReadFull(r, rest)
+			data = append(data, rest[:n]...)
+			if err != nil {
+				if errors.Is(err, io.ErrUnexpectedEOF) {
+					err = io.EOF
+				}
+				return data, err
+			}
+
+			return data, nil
+		}
+	}
+
+	for {
+		line, err := r.ReadBytes(splitOp)
+		data = append(data, line...)
+		if err != nil {
+			return data, err
+		}
+
+		next, err := r.Peek(len(opSet) + 1)
+		if err != nil || isRecordStart(next) {
+			return data, nil
+		}
+	}
+}
+
+// 从 db 文件重建 idx 文件，旧的 idx 文件 (若存在) 会以 `._bak` 的后缀保存
+// config 中的 MaxLen 和 KeysLen 为 0 时，沿用旧 idx 的配置或 DefaultCreateConfig，并按需扩大
+func RebuildIndex(ctx context.Context, config *CreateConfig) (*RebuildResult, error) {
+	if config == nil {
+		config = &DefaultCreateConfig
+	}
+
+	d := &Diskv{dir: config.Dir}
+
+	err := d.lockDir(config.Dir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer d.unlockDir()
+
+	return d.rebuildIdx(ctx, *config)
+}
+
+// 检查 idx 文件是否存在且 meta 可以正常解析
+func (d *Diskv) checkIdx(ctx context.Context, dir string) (bool, error) {
+	idx, ok, err := d.getIdx(d.idxFileName(dir))
+	if err != nil {
+		return false, fmt.Errorf("open idx file error: %s", err)
+	}
+	if !ok {
+		return false, nil
+	}
+	defer idx.f.Close()
+
+	meta, err := idx.getIdxMeta(ctx)
+	if err != nil || meta.maxLength <= 0 || meta.keysLen <= 0 {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (d *Diskv) rebuildIdx(ctx context.Context, config CreateConfig) (*RebuildResult, error) {
+	dir := config.Dir
+	idxFile := d.idxFileName(dir)
+
+	version := 0 // 由旧 idx 或 db 文件中的记录格式决定
+
+	// 尽量沿用旧 idx 的配置
+	if config.MaxLen <= 0 || config.KeysLen <= 0 {
+		config.MaxLen, config.KeysLen = DefaultCreateConfig.MaxLen, DefaultCreateConfig.KeysLen
+
+		oidx, ok, err := d.getIdx(idxFile)
+		if err == nil && ok {
+			meta, err := oidx.getIdxMeta(ctx)
+			if err == nil && meta.maxLength > 0 && meta.keysLen > 0 {
+				config.MaxLen, config.KeysLen = meta.maxLength, meta.keysLen
+				config.Hash, config.HashSeed, config.Probe = meta.hash, meta.hashSeed, meta.probe
+				config.HashedKeys = meta.hashedKeys
+				version = meta.version
+			}
+			oidx.f.Close()
+		}
+	}
+
+	res := &RebuildResult{}
+	metas := map[string]*valueMeta{}
+
+	ids, err := listSegments(d.dbFileName(dir))
+	if err != nil {
+		return nil, fmt.Errorf("list db file error: %s", err)
+	}
+	var dbstore *dbsotre
+	if len(ids) > 0 {
+		dbstore, err = d.getOrCreateDBStore(d.dbFileName(dir))
+		if err != nil {
+			return nil, fmt.Errorf("open db file error: %s", err)
+		}
+		defer dbstore.close()
+
+		err = dbstore.scan(ctx, logPos{}, func(rec *logRecord) bool {
+			if rec.err != nil || rec.batchMarker() { // 损坏或不完整的记录直接忽略
+				return true
+			}
+
+			res.Records++
+
+			if version == 0 {
+				version = formatVersion1
+				if rec.version >= formatVersion2 {
+					version = formatVersion2
+				}
+			}
+
+			switch rec.op {
+			case opSet:
+				metas[rec.item.key] = rec.valueMeta()
+			case opDel:
+				delete(metas, rec.item.key)
+			}
+
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("scan db file error: %s", err)
+		}
+	}
+
+	// 负载不超过 75%
+	if minKeysLen := len(metas)*4/3 + 1; config.KeysLen < minKeysLen {
+		config.KeysLen = minKeysLen
+	}
+
+	// block 需要放得下最长的 value meta，按 8 字节对齐
+	slotMeta := &idxMeta{probe: config.Probe, hashedKeys: config.HashedKeys}
+	for _, meta := range metas {
+		m := *meta
+		m.dist = config.KeysLen // 距离不会超过 KeysLen
+		if l := len(formatSlot(&m, slotMeta)); l > config.MaxLen {
+			config.MaxLen = (l + 7) / 8 * 8
+		}
+	}
+
+	if version == 0 { // 空的 db 文件
+		version = currentFormatVersion
+	}
+
+	toIdxFile := idxFile + ".tmp"
+	err = os.RemoveAll(toIdxFile)
+	if err != nil {
+		return nil, fmt.Errorf("remove old tmp idx file error: %s", err)
+	}
+
+	nidx, err := d.createIdx(ctx, toIdxFile, config, version)
+	if err != nil {
+		return nil, fmt.Errorf("create idx file error: %s", err)
+	}
+	nidx.store = dbstore
+
+	for _, meta := range metas {
+		err = nidx.setValueMeta(ctx, meta)
+		if err != nil {
+			nidx.f.Close()
+			return nil, fmt.Errorf("set value meta of key [%s] error: %s", meta.key, err)
+		}
+	}
+
+	err = nidx.f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("close idx file error: %s", err)
+	}
+
+	if _, err := os.Stat(idxFile); err == nil {
+		err = migrateFile(ctx, toIdxFile, idxFile, false)
+	} else {
+		err = os.Rename(toIdxFile, idxFile)
+		if err == nil {
+			err = syncDir(dir)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("migrate file error: %s", err)
+	}
+
+	res.Keys = len(metas)
+	res.MaxLen = config.MaxLen
+	res.KeysLen = config.KeysLen
+
+	return res, nil
+}
+
+// 打开时的恢复:
+// 1. 截断 db 文件尾部损坏或不完整的记录 (写入过程中崩溃)，没有提交的 batch 整组截断
+// 2. 修正指向 db 文件之外的 idx slot，指回该 key 最后一条有效的记录，没有则删除
+// 3. 重新统计 key 的数量
+// 4. 重新应用写入 idx 过程中崩溃的 batch
+// 已写满的 segment 不会再写入，只检查当前写入的 segment，上次关闭时记录了 checkpoint 时从 checkpoint 开始
+func (d *Diskv) recover(ctx context.Context) error {
+	active, err := d.dbstore.end(ctx)
+	if err != nil {
+		return err
+	}
+
+	// checkpoint 之后只会追加，替换 db 文件的迁移同时会替换 idx，新的 idx 中没有 checkpoint
+	from := logPos{seg: active.seg}
+	if cp := d.idx.meta.checkpoint; cp.seg == active.seg && cp.offset <= active.offset {
+		from = cp
+	}
+
+	end := from.offset // 当前 segment 中最后一条有效记录的结尾
+	batches := newBatchTracker()
+	err = d.dbstore.scan(ctx, from, func(rec *logRecord) bool {
+		if rec.err == nil {
+			end = int64(rec.offset + rec.length)
+			batches.add(rec)
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("scan db file error: %s", err)
+	}
+
+	if end < active.offset {
+		err = d.dbstore.truncate(ctx, end)
+		if err != nil {
+			return fmt.Errorf("truncate db file error: %s", err)
+		}
+	}
+
+	sizes, err := d.dbstore.segmentSizes(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Robin Hood 的插入和删除会移动多个 slot，中途崩溃时可能留下重复的 key
+	if d.idx.meta.probe == ProbeRobinHood {
+		_, err = d.idx.rhDedupe(ctx)
+		if err != nil {
+			return fmt.Errorf("dedupe idx error: %s", err)
+		}
+	}
+
+	err = d.fixBadSlots(ctx, sizes)
+	if err != nil {
+		return err
+	}
+
+	return d.redoBatches(ctx, batches)
+}
+
+// 记录 db 文件当前的末尾为 checkpoint，下次打开时从这里开始检查，调用方需持有 d.mu 且 db 和 idx 已落盘
+// 有 batch 没有应用到 idx 时不记录，由下次打开时的 redoBatches 补齐
+func (d *Diskv) saveCheckpoint(ctx context.Context) error {
+	if atomic.LoadInt32(&d.unapplied) != 0 {
+		return nil
+	}
+
+	pos, err := d.dbstore.end(ctx)
+	if err != nil {
+		return fmt.Errorf("get db file end error: %s", err)
+	}
+
+	err = d.idx.setCheckpoint(ctx, pos)
+	if err != nil {
+		return fmt.Errorf("save checkpoint error: %s", err)
+	}
+
+	return d.idx.sync(ctx)
+}
+
+// 修正指向 db 文件之外的 slot，并重新统计 key 和 tombstone 的数量
+func (d *Diskv) fixBadSlots(ctx context.Context, sizes map[int]int64) error {
+	bad := func(valMeta *valueMeta) bool {
+		size, ok := sizes[valMeta.seg]
+		return !ok || int64(valMeta.offset+valMeta.length) > size
+	}
+
+	meta, err := d.idx.getIdxMeta(ctx)
+	if err != nil {
+		return err
+	}
+
+	count, deleted := 0, 0
+	latest := map[string]*valueMeta{} // 以 slotID 区分 key
+	bads := []slotWrite{}             // 遍历时找到的 slot 和其中的内容
+	for slot := 0; slot < meta.keysLen; slot++ {
+		valMeta, state, err := d.idx.getValueOfSlot(ctx, slot)
+		if err != nil {
+			return fmt.Errorf("check idx error: %s", err)
+		}
+
+		switch state {
+		case slotUsed:
+			count++
+			if bad(valMeta) {
+				latest[d.idx.slotID(valMeta)] = nil
+				bads = append(bads, slotWrite{slot: slot, meta: valMeta})
+			}
+		case slotDeleted:
+			deleted++
+		}
+	}
+
+	// 修正文件头中 key 和 tombstone 的数量 (旧文件中没有记录，文件头放不下，或崩溃前没有写入)
+	if d.idx.meta.count != count || d.idx.meta.deleted != deleted {
+		err = d.idx.setCount(ctx, count, deleted)
+		if err != nil {
+			return fmt.Errorf("set idx key count error: %s", err)
+		}
+	}
+
+	if len(latest) == 0 {
+		return nil
+	}
+
+	err = d.dbstore.scan(ctx, logPos{}, func(rec *logRecord) bool {
+		if rec.err != nil || rec.batchMarker() {
+			return true
+		}
+
+		id := d.idx.slotID(rec.valueMeta())
+		if _, ok := latest[id]; !ok {
+			return true
+		}
+
+		switch rec.op {
+		case opSet:
+			latest[id] = rec.valueMeta()
+		case opDel:
+			latest[id] = nil
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("scan db file error: %s", err)
+	}
+
+	// 先按位置删除这些 slot (hashedKeys 时无法从 db 文件中读出其中的 key)，再写回最后一条有效的记录
+	// Robin Hood 删除时会把之后的 key 往前移，需在冲突链上找到它们当前的位置
+	for _, b := range bads {
+		slot := b.slot
+		if d.idx.robinHood(ctx) {
+			id := d.idx.slotID(b.meta)
+			slots, err := d.idx.rhFindInChain(ctx, b.slot, b.meta, func(valMeta *valueMeta) bool {
+				return d.idx.slotID(valMeta) == id && bad(valMeta)
+			})
+			if err != nil {
+				return fmt.Errorf("check idx error: %s", err)
+			}
+			if len(slots) == 0 {
+				continue
+			}
+			slot = slots[len(slots)-1]
+		}
+
+		err = d.idx.removeSlot(ctx, slot)
+		if err != nil {
+			return fmt.Errorf("remove slot [%d] error: %s", slot, err)
+		}
+	}
+
+	for id, meta := range latest {
+		if meta == nil {
+			continue
+		}
+
+		err = d.idx.setValueMeta(ctx, meta)
+		if err != nil {
+			return fmt.Errorf("fix idx of key [%s] error: %s", id, err)
+		}
+	}
+
+	return nil
+}
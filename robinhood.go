@@ -0,0 +1,293 @@
+package diskv
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// idx 处理哈希冲突的方式，创建时指定，记录在 idx 文件头中
+type ProbeMode int
+
+const (
+	ProbeLinear    ProbeMode = iota // 线性探测，删除时留下 tombstone
+	ProbeRobinHood                  // Robin Hood，高负载时查找的探测长度仍然较短
+)
+
+func (p ProbeMode) String() string {
+	switch p {
+	case ProbeLinear:
+		return "linear"
+	case ProbeRobinHood:
+		return "robinhood"
+	}
+
+	return fmt.Sprintf("ProbeMode(%d)", int(p))
+}
+
+func (p ProbeMode) valid() bool {
+	return p == ProbeLinear || p == ProbeRobinHood
+}
+
+// Robin Hood:
+// 每个 slot 记录 key 到其哈希位置的距离 (dist)，eg: longtest,12,3456,0,2|
+// 插入时，若当前 slot 中 key 的距离比要插入的 key 近，则抢占这个 slot，被挤出的 key 继续往后找位置
+// 这样冲突链按距离有序，查找时遇到距离比当前探测距离近的 key，即可确定 key 不存在
+// 删除时不留 tombstone，把之后距离不为 0 的 key 依次往前移一个 slot
+
+// idx 是否使用 ProbeRobinHood，读取 idx 文件头出错时由之后的操作返回错误
+func (idx *idx) robinHood(ctx context.Context) bool {
+	meta, err := idx.getIdxMeta(ctx)
+	return err == nil && meta.probe == ProbeRobinHood
+}
+
+// 按 Robin Hood 的规则查找 key 所在的 slot
+// 不持有 idx.wmu 时，查找期间 key 可能被移过查找的位置，见 retryMiss
+func (idx *idx) rhFindSlot(ctx context.Context, key string) (slot int, meta *valueMeta, ok bool, err error) {
+	slot, err = idx.hashKey(ctx, key)
+	if err != nil {
+		return 0, nil, false, fmt.Errorf("hash key error: %s", err)
+	}
+
+	keysLen := idx.meta.keysLen
+	for dist := 0; dist < keysLen; dist++ {
+		valueMeta, state, err := idx.getValueOfSlot(ctx, slot)
+		if err != nil {
+			return 0, nil, false, err
+		}
+
+		if state != slotUsed {
+			return 0, nil, false, nil
+		}
+
+		match, err := idx.matchKey(ctx, valueMeta, key)
+		if err != nil {
+			return 0, nil, false, err
+		}
+		if match {
+			return slot, valueMeta, true, nil
+		}
+
+		if valueMeta.dist < dist { // key 若存在，应该已经抢占了这个 slot
+			return 0, nil, false, nil
+		}
+
+		slot = (slot + 1) % keysLen
+	}
+
+	return 0, nil, false, nil
+}
+
+type slotWrite struct {
+	slot int
+	meta *valueMeta // nil 时清空
+}
+
+// 调用方需持有 idx.wmu
+func (idx *idx) rhReplaceValueMeta(ctx context.Context, valueMeta *valueMeta) (old *valueMeta, err error) {
+	slot, old, ok, err := idx.rhFindSlot(ctx, valueMeta.key)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok { // 已有的 key，原地覆盖，距离不变
+		cur := *valueMeta
+		cur.dist = old.dist
+		return old, idx.writeSlots(ctx, []slotWrite{{slot: slot, meta: &cur}}, 0)
+	}
+
+	slot, err = idx.hashKey(ctx, valueMeta.key)
+	if err != nil {
+		return nil, err
+	}
+
+	keysLen := idx.meta.keysLen
+	writes := []slotWrite{}
+
+	cur := *valueMeta
+	cur.dist = 0
+	for probes := 0; ; probes++ {
+		if probes == keysLen {
+			return nil, ErrIndexFull
+		}
+
+		slotmeta, state, err := idx.getValueOfSlot(ctx, slot)
+		if err != nil {
+			return nil, err
+		}
+
+		if state != slotUsed {
+			placed := cur
+			writes = append(writes, slotWrite{slot: slot, meta: &placed})
+			break
+		}
+
+		if slotmeta.dist < cur.dist { // 抢占距离更近的 key
+			placed := cur
+			writes = append(writes, slotWrite{slot: slot, meta: &placed})
+			cur = *slotmeta
+		}
+
+		slot = (slot + 1) % keysLen
+		cur.dist++
+	}
+
+	// 从最后一个被挤出的 key 开始往前写，中途崩溃时只会出现重复的 key，不会丢失 key，见 rhDedupe
+	for i, j := 0, len(writes)-1; i < j; i, j = i+1, j-1 {
+		writes[i], writes[j] = writes[j], writes[i]
+	}
+
+	return nil, idx.writeSlots(ctx, writes, 1)
+}
+
+// 调用方需持有 idx.wmu
+func (idx *idx) rhRemoveValueMeta(ctx context.Context, key string) (old *valueMeta, err error) {
+	slot, old, ok, err := idx.rhFindSlot(ctx, key)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	return old, idx.rhRemoveSlot(ctx, slot)
+}
+
+// 删除 slot 中的 key，之后距离不为 0 的 key 依次往前移，调用方需持有 idx.wmu
+// 从前往后写，中途崩溃时只会出现重复的 key
+func (idx *idx) rhRemoveSlot(ctx context.Context, slot int) error {
+	keysLen := idx.meta.keysLen
+	writes := []slotWrite{}
+
+	cur := slot
+	for i := 1; i < keysLen; i++ {
+		next := (cur + 1) % keysLen
+
+		valueMeta, state, err := idx.getValueOfSlot(ctx, next)
+		if err != nil {
+			return err
+		}
+		if state != slotUsed || valueMeta.dist == 0 {
+			break
+		}
+
+		valueMeta.dist--
+		writes = append(writes, slotWrite{slot: cur, meta: valueMeta})
+		cur = next
+	}
+	writes = append(writes, slotWrite{slot: cur})
+
+	return idx.writeSlots(ctx, writes, -1)
+}
+
+// 按顺序写入多个 slot，并调整 key 的数量，调用方需持有 idx.wmu
+func (idx *idx) writeSlots(ctx context.Context, writes []slotWrite, delta int) error {
+	blockLen := idx.meta.getKeyBlockLength()
+
+	datas := make([][]byte, len(writes))
+	for i, w := range writes {
+		datas[i] = make([]byte, blockLen)
+		if w.meta == nil {
+			continue
+		}
+
+		data := idx.formatSlot(w.meta)
+		if len(data) > blockLen {
+			return fmt.Errorf("value too long, max is %d", blockLen)
+		}
+		copy(datas[i], data)
+	}
+
+	// 移动多个 slot 时，并发的查找可能错过被移动的 key
+	if len(writes) > 1 {
+		idx.beginMove()
+		defer idx.endMove()
+	}
+
+	return idx.runWithFileShared(ctx, func(ctx context.Context, f *os.File) error {
+		for i, w := range writes {
+			err := idx.writeBlock(f, w.slot, datas[i])
+			if err != nil {
+				return fmt.Errorf("write idx file error: %s", err)
+			}
+		}
+
+		if delta != 0 {
+			return idx.addCount(f, delta)
+		}
+		return nil
+	})
+}
+
+// 删除插入或删除中途崩溃留下的重复的 key，保留冲突链上靠前 (距离小) 的一个
+// 先遍历一次找出所有重复的 key 再逐个删除，删除靠后的一个时会把之后的 key 前移，相当于完成中断的删除
+func (idx *idx) rhDedupe(ctx context.Context) (removed int, err error) {
+	idx.wmu.Lock()
+	defer idx.wmu.Unlock()
+
+	keysLen := idx.meta.keysLen
+
+	first := map[string]slotWrite{}
+	dups := []slotWrite{} // 遍历时重复的 key 靠后的一个所在的 slot 和其中的内容
+	for slot := 0; slot < keysLen; slot++ {
+		valueMeta, state, err := idx.getValueOfSlot(ctx, slot)
+		if err != nil {
+			return removed, err
+		}
+		if state != slotUsed {
+			continue
+		}
+
+		id := idx.slotID(valueMeta)
+		cur := slotWrite{slot: slot, meta: valueMeta}
+		prev, ok := first[id]
+		if !ok {
+			first[id] = cur
+			continue
+		}
+
+		if valueMeta.dist < prev.meta.dist { // 冲突链回绕，先遍历到的在链上靠后
+			first[id], cur = cur, prev
+		}
+		dups = append(dups, cur)
+	}
+
+	for _, dup := range dups {
+		id := idx.slotID(dup.meta)
+		slots, err := idx.rhFindInChain(ctx, dup.slot, dup.meta, func(valueMeta *valueMeta) bool {
+			return idx.slotID(valueMeta) == id
+		})
+		if err != nil {
+			return removed, err
+		}
+		if len(slots) < 2 {
+			continue
+		}
+
+		err = idx.rhRemoveSlot(ctx, slots[len(slots)-1])
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// 在冲突链上从哈希位置到 slot 按顺序找出 match 的 key 当前所在的 slot，meta 为之前在 slot 中读到的内容
+// 删除 key 时之后的 key 往前移，距离减一、哈希位置不变，因此之前读到的 key 仍在这个范围内
+func (idx *idx) rhFindInChain(ctx context.Context, slot int, meta *valueMeta, match func(valueMeta *valueMeta) bool) ([]int, error) {
+	keysLen := idx.meta.keysLen
+	home := ((slot-meta.dist)%keysLen + keysLen) % keysLen
+
+	slots := []int{}
+	for i := 0; i <= meta.dist && i < keysLen; i++ {
+		s := (home + i) % keysLen
+		valueMeta, state, err := idx.getValueOfSlot(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		if state == slotUsed && match(valueMeta) {
+			slots = append(slots, s)
+		}
+	}
+
+	return slots, nil
+}
@@ -0,0 +1,336 @@
+package diskv
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// 检查 Robin Hood 的不变式: slot 中记录的距离正确，且冲突链上距离每次最多增加 1
+func checkRobinHood(t *testing.T, db *Diskv) {
+	ctx := context.Background()
+	keysLen := db.idx.meta.keysLen
+
+	for slot := 0; slot < keysLen; slot++ {
+		meta, state, err := db.idx.getValueOfSlot(ctx, slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != slotUsed {
+			continue
+		}
+		if err := db.idx.resolveKey(ctx, meta); err != nil {
+			t.Fatal(err)
+		}
+
+		home, err := db.idx.hashKey(ctx, meta.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dist := (slot - home + keysLen) % keysLen; dist != meta.dist {
+			t.Fatalf("slot %d key %s: dist %d, expect %d", slot, meta.key, meta.dist, dist)
+		}
+
+		if meta.dist > 0 {
+			prev, state, err := db.idx.getValueOfSlot(ctx, (slot-1+keysLen)%keysLen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state != slotUsed || prev.dist < meta.dist-1 {
+				t.Fatalf("slot %d key %s: broken chain before dist %d", slot, meta.key, meta.dist)
+			}
+		}
+	}
+}
+
+func TestRobinHood(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	keysLen := 64
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 40, KeysLen: keysLen, Probe: ProbeRobinHood, Options: Options{MaxLoad: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	// 一部分 key 哈希到同一个 slot，其余随机，写到接近满
+	keys := collidingKeys(t, db, 16)
+	for i := 0; len(keys) < keysLen-4; i++ {
+		keys = append(keys, fmt.Sprintf("r%d", i))
+	}
+
+	r := rand.New(rand.NewSource(1))
+	model := map[string]string{}
+
+	check := func(t *testing.T, db *Diskv) {
+		if db.idx.meta.probe == ProbeRobinHood {
+			checkRobinHood(t, db)
+		}
+
+		for _, key := range keys {
+			val, ok, err := db.GetString(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect, has := model[key]
+			if ok != has || val != expect {
+				t.Fatalf("get %s error: %q %v, expect %q %v", key, val, ok, expect, has)
+			}
+		}
+
+		meta, err := db.idx.getIdxMeta(ctx)
+		if err != nil || meta.count != len(model) {
+			t.Fatalf("unexpected idx count: %+v %v, expect %d", meta, err, len(model))
+		}
+	}
+
+	for i := 0; i < 3000; i++ {
+		key := keys[r.Intn(len(keys))]
+
+		if r.Intn(3) > 0 {
+			val := fmt.Sprintf("%d", i)
+			if err := db.SetString(ctx, key, val); err != nil {
+				t.Fatal(err)
+			}
+			model[key] = val
+		} else {
+			has, err := db.Del(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := model[key]; ok != has {
+				t.Fatalf("del %s: got %v, expect %v", key, has, ok)
+			}
+			delete(model, key)
+		}
+
+		if i%200 == 0 {
+			check(t, db)
+		}
+	}
+	check(t, db)
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenDB(ctx, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		meta, err := db.idx.getIdxMeta(ctx)
+		if err != nil || meta.probe != ProbeRobinHood {
+			t.Fatalf("unexpected idx meta: %+v %v", meta, err)
+		}
+		check(t, db)
+	})
+
+	t.Run("migrate", func(t *testing.T) {
+		err := db.MigrateIdx(ctx, &CreateConfig{MaxLen: 40, KeysLen: keysLen * 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.idx.meta.probe != ProbeLinear {
+			t.Fatalf("unexpected probe: %s", db.idx.meta.probe)
+		}
+		check(t, db)
+
+		err = db.MigrateIdx(ctx, &CreateConfig{MaxLen: 40, KeysLen: keysLen, Probe: ProbeRobinHood})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+
+		if err := db.MigrateValue(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if db.idx.meta.probe != ProbeRobinHood {
+			t.Fatalf("unexpected probe after migrate value: %s", db.idx.meta.probe)
+		}
+		check(t, db)
+	})
+
+	t.Run("rebuild", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := RebuildIndex(ctx, &CreateConfig{Dir: dir}); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenDB(ctx, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.idx.meta.probe != ProbeRobinHood {
+			t.Fatalf("unexpected probe after rebuild: %s", db.idx.meta.probe)
+		}
+		check(t, db)
+	})
+}
+
+// 模拟插入过程中崩溃: 被挤出的 key 已写到新的位置，原来的位置还没有被覆盖
+func TestRobinHoodDedupe(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 40, KeysLen: 32, Probe: ProbeRobinHood, Options: Options{MaxLoad: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := collidingKeys(t, db, 4)
+	for _, key := range keys {
+		if err := db.SetString(ctx, key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	slot, ok, err := db.idx.findSlot(ctx, keys[len(keys)-1])
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	meta, _, err := db.idx.getValueOfSlot(ctx, slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.dist++
+	err = db.idx.writeSlots(ctx, []slotWrite{{slot: (slot + 1) % 32, meta: meta}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	checkRobinHood(t, db)
+	if db.idx.meta.count != len(keys) {
+		t.Fatalf("unexpected count after dedupe: %d", db.idx.meta.count)
+	}
+	for _, key := range keys {
+		val, ok, err := db.GetString(ctx, key)
+		if err != nil || !ok || val != key {
+			t.Fatalf("get %s error: %q %v %v", key, val, ok, err)
+		}
+	}
+}
+
+// 一次遍历找出所有重复的 key 和指向 db 文件之外的 slot 后逐个删除，之前的删除把 key 前移后仍能找到它们
+func TestRobinHoodRecoverMoved(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	keysLen := 32
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 40, KeysLen: keysLen, Probe: ProbeRobinHood, Options: Options{MaxLoad: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := keysOfSlot(t, db, 10, 4)
+	c := keysOfSlot(t, db, keysLen-1, 1)
+	keys := append(append([]string{}, a...), c...)
+	for _, key := range keys {
+		if err := db.SetString(ctx, key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write := func(key string, f func(slot int, meta *valueMeta) int) {
+		slot, ok, err := db.idx.findSlot(ctx, key)
+		if err != nil || !ok {
+			t.Fatal(ok, err)
+		}
+		meta, _, err := db.idx.getValueOfSlot(ctx, slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slot = f(slot, meta)
+		if err := db.idx.writeSlots(ctx, []slotWrite{{slot: slot, meta: meta}}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 重复的 key: 复制到冲突链的结尾，c 的冲突链回绕到第 0 个
+	for _, key := range []string{a[3], c[0]} {
+		write(key, func(slot int, meta *valueMeta) int {
+			meta.dist++
+			return (slot + 1) % keysLen
+		})
+	}
+	// 相邻的两个 slot 指向 db 文件之外，删除第一个时第二个前移
+	for _, key := range a[:2] {
+		write(key, func(slot int, meta *valueMeta) int {
+			meta.offset += 1 << 20
+			return slot
+		})
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	checkRobinHood(t, db)
+	if db.idx.meta.count != len(keys) {
+		t.Fatalf("unexpected count after recover: %d", db.idx.meta.count)
+	}
+	for _, key := range keys {
+		val, ok, err := db.GetString(ctx, key)
+		if err != nil || !ok || val != key {
+			t.Fatalf("get %s error: %q %v %v", key, val, ok, err)
+		}
+	}
+}
+
+// 对比线性探测和 Robin Hood 在不同负载下的查找，一半为不存在的 key
+// go test -run ^$ -bench BenchmarkProbe -benchmem
+func BenchmarkProbe(b *testing.B) {
+	ctx := context.Background()
+	keysLen := 10000
+
+	for _, probe := range []ProbeMode{ProbeLinear, ProbeRobinHood} {
+		for _, load := range []int{50, 80, 95} {
+			b.Run(fmt.Sprintf("%s/load-%d", probe, load), func(b *testing.B) {
+				dir, err := os.MkdirTemp("", "diskv-bench")
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+
+				db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 48, KeysLen: keysLen, Probe: probe, Options: Options{MaxLoad: -1}})
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer db.Close()
+
+				n := keysLen * load / 100
+				for i := 0; i < n; i++ {
+					if err := db.SetString(ctx, fmt.Sprintf("user:%06d", i), "value"); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					key := fmt.Sprintf("user:%06d", i%(n*2)) // 后一半不存在
+					if _, _, err := db.Get(ctx, key); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package diskv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/iamlongalong/diskv/kvstore"
+)
+
+var _ kvstore.Scanner = (*Diskv)(nil)
+
+// 只实现了 KVStorer 的存储，kvstore.Scan 时遍历后排序
+type forEachOnly struct {
+	kvstore.KVStorer
+}
+
+// 按 Scan/Range 的顺序收集 key，同时检查 value
+func collectRange(t *testing.T, scan func(f func(ctx context.Context, key string, value []byte) bool) error) []string {
+	keys := []string{}
+	err := scan(func(ctx context.Context, key string, value []byte) bool {
+		if string(value) != key {
+			t.Errorf("unexpected value of %s: %q", key, value)
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
+
+func inRange(keys map[string]bool, start, end string) []string {
+	res := []string{}
+	for key, live := range keys {
+		if live && kvstore.InRange(key, start, end) {
+			res = append(res, key)
+		}
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+func TestScan(t *testing.T) {
+	ctx := context.Background()
+
+	for _, c := range concurrentConfigs {
+		for _, sorted := range []bool{false, true} {
+			name := c.name
+			if sorted {
+				name += "-sorted"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				advance := fakeClock(t)
+
+				config := c.config
+				config.Dir = t.TempDir()
+				config.SortedKeys = sorted
+
+				db, err := CreateDB(ctx, &config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer db.Close()
+
+				keys := map[string]bool{}
+				set := func(key string) {
+					if err := db.SetString(ctx, key, key); err != nil {
+						t.Fatal(err)
+					}
+					keys[key] = true
+				}
+
+				for i := 0; i < 100; i += 2 {
+					set(fmt.Sprintf("k%03d", i))
+				}
+				for _, key := range []string{"a", "a,b", "a%", "ab"} { // 转义后的顺序与原来不同
+					set(key)
+				}
+
+				db.bg.Wait() // 等待后台生成有序的 key 文件
+				if sorted && db.sorted.f == nil {
+					t.Fatal("keys file should be built")
+				}
+
+				// 之后的写入记录在 delta 中，删除和过期的 key 仍在文件中
+				for i := 1; i < 100; i += 2 {
+					set(fmt.Sprintf("k%03d", i))
+				}
+				for _, key := range []string{"k010", "k011"} {
+					if _, err := db.Del(ctx, key); err != nil {
+						t.Fatal(err)
+					}
+					keys[key] = false
+				}
+				if err := db.SetStringWithTTL(ctx, "k020", "k020", time.Minute); err != nil {
+					t.Fatal(err)
+				}
+				keys["k020"] = false
+				advance(2 * time.Minute)
+
+				for _, r := range [][2]string{{"", ""}, {"k015", "k042"}, {"k090", ""}, {"a", "b"}, {"a,", "k001"}, {"x", ""}} {
+					got := collectRange(t, func(f func(ctx context.Context, key string, value []byte) bool) error {
+						return db.Range(ctx, r[0], r[1], f)
+					})
+					if fmt.Sprint(got) != fmt.Sprint(inRange(keys, r[0], r[1])) {
+						t.Fatalf("range [%q, %q): %v", r[0], r[1], got)
+					}
+				}
+
+				for _, prefix := range []string{"a", "k01", "k1", ""} {
+					got := collectRange(t, func(f func(ctx context.Context, key string, value []byte) bool) error {
+						return db.Scan(ctx, prefix, f)
+					})
+					want := inRange(keys, prefix, kvstore.PrefixEnd(prefix))
+					if fmt.Sprint(got) != fmt.Sprint(want) {
+						t.Fatalf("scan %q: %v", prefix, got)
+					}
+
+					fallback := collectRange(t, func(f func(ctx context.Context, key string, value []byte) bool) error {
+						return kvstore.Scan(ctx, forEachOnly{db}, prefix, f)
+					})
+					if fmt.Sprint(fallback) != fmt.Sprint(want) {
+						t.Fatalf("kvstore scan %q: %v", prefix, fallback)
+					}
+				}
+
+				n := 0
+				err = db.Scan(ctx, "k", func(ctx context.Context, key string, value []byte) bool {
+					n++
+					return n < 3
+				})
+				if err != nil || n != 3 {
+					t.Fatalf("scan should stop: %d %v", n, err)
+				}
+			})
+		}
+	}
+}
+
+// 有序的 key 文件在 Close 时合并 delta 并标记为 clean，打开时不可用则重新生成
+func TestSortedKeys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	opts := Options{SortedKeys: true}
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 48, KeysLen: 100, Options: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	keys := map[string]bool{}
+	set := func(key string) {
+		if err := db.SetString(ctx, key, key); err != nil {
+			t.Fatal(err)
+		}
+		keys[key] = true
+	}
+	check := func(t *testing.T) {
+		got := collectRange(t, func(f func(ctx context.Context, key string, value []byte) bool) error {
+			return db.Scan(ctx, "", f)
+		})
+		if fmt.Sprint(got) != fmt.Sprint(inRange(keys, "", "")) {
+			t.Fatalf("unexpected keys: %v", got)
+		}
+	}
+	reopen := func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenDBWithConfig(ctx, &OpenConfig{Dir: dir, Options: opts})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	readHead := func(t *testing.T) *keysHead {
+		data, err := os.ReadFile(db.keysFileName(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := parseKeysHead(string(data[:keysHeadLen]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	for i := 0; i < 40; i++ {
+		set(fmt.Sprintf("key%02d", i))
+	}
+	db.bg.Wait()
+
+	t.Run("reuse", func(t *testing.T) {
+		set("delta")
+		reopen(t)
+
+		// 直接使用 Close 时合并过 delta 的文件，打开后去掉 clean 标记
+		if db.sorted.f == nil || db.sorted.count != 41 || len(db.sorted.delta) != 0 {
+			t.Fatalf("keys file should be loaded: %d %d", db.sorted.count, len(db.sorted.delta))
+		}
+		if readHead(t).clean {
+			t.Fatal("keys file should not be clean after open")
+		}
+		check(t)
+	})
+
+	t.Run("crash", func(t *testing.T) {
+		set("crash")
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// 模拟崩溃: 文件没有标记为 clean
+		f, err := os.OpenFile(db.keysFileName(dir), os.O_WRONLY, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte("0"), keysHeadCleanOffset)
+		f.Close()
+
+		db, err = OpenDBWithConfig(ctx, &OpenConfig{Dir: dir, Options: opts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t) // 重新生成完成之前遍历 idx
+
+		db.bg.Wait()
+		if db.sorted.f == nil || db.sorted.count != 42 {
+			t.Fatal("keys file should be rebuilt")
+		}
+		check(t)
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		// 不开启 SortedKeys 时的写入不会记录到文件中
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenDB(ctx, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set("stale")
+
+		reopen(t)
+		db.bg.Wait()
+		if db.sorted.count != 43 {
+			t.Fatalf("stale keys file should be rebuilt: %d", db.sorted.count)
+		}
+		check(t)
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		for i := 0; i < 30; i++ {
+			key := fmt.Sprintf("key%02d", i)
+			if _, err := db.Del(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+			keys[key] = false
+		}
+		if err := db.MigrateValue(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		// 迁移后重新生成，去掉已删除的 key
+		db.bg.Wait()
+		if db.sorted.count != 13 {
+			t.Fatalf("unexpected keys in file: %d", db.sorted.count)
+		}
+		check(t)
+
+		reopen(t)
+		if h := readHead(t); h.count != 13 || len(db.sorted.marks) != 1 {
+			t.Fatalf("unexpected keys head: %+v", h)
+		}
+		check(t)
+	})
+}
+
+// 分页读取: 暂停后用 cursor 继续，期间的写入在 cursor 之后的能读到
+func TestIterator(t *testing.T) {
+	ctx := context.Background()
+
+	for _, sorted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sorted-%v", sorted), func(t *testing.T) {
+			db, err := CreateDB(ctx, &CreateConfig{Dir: t.TempDir(), MaxLen: 48, KeysLen: 100, Options: Options{SortedKeys: sorted}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			for i := 0; i < 30; i++ {
+				key := fmt.Sprintf("k%02d", i*2)
+				if err := db.SetString(ctx, key, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.SetString(ctx, "other", "other"); err != nil {
+				t.Fatal(err)
+			}
+
+			page := func(cursor string, n int) ([]string, string) {
+				it := db.NewIterator(ctx, kvstore.IteratorOptions{Prefix: "k", Cursor: cursor, PageSize: 7})
+				defer it.Close()
+
+				keys := []string{}
+				for len(keys) < n && it.Next() {
+					if string(it.Value()) != it.Key() {
+						t.Fatalf("unexpected value of %s: %q", it.Key(), it.Value())
+					}
+					keys = append(keys, it.Key())
+				}
+				if err := it.Err(); err != nil {
+					t.Fatal(err)
+				}
+				return keys, it.Cursor()
+			}
+
+			keys, cursor := page("", 10)
+			if len(keys) != 10 || keys[9] != "k18" || cursor == "" {
+				t.Fatalf("unexpected first page: %v %q", keys, cursor)
+			}
+
+			// 暂停期间的写入
+			for _, key := range []string{"k01", "k19", "k99"} {
+				if err := db.SetString(ctx, key, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := db.Del(ctx, "k20"); err != nil {
+				t.Fatal(err)
+			}
+
+			all := []string{}
+			for cursor != "" {
+				keys, cursor = page(cursor, 10)
+				all = append(all, keys...)
+			}
+			if len(all) != 21 || all[0] != "k19" || all[1] != "k22" || all[20] != "k99" {
+				t.Fatalf("unexpected rest pages: %v", all)
+			}
+
+			it := db.NewIterator(ctx, kvstore.IteratorOptions{Cursor: "%%"})
+			if it.Next() || !errors.Is(it.Err(), kvstore.ErrInvalidCursor) {
+				t.Fatalf("expect ErrInvalidCursor, got %v", it.Err())
+			}
+
+			it = db.NewIterator(ctx, kvstore.IteratorOptions{})
+			if !it.Next() || it.Close() != nil || it.Next() {
+				t.Fatal("iterator should stop after close")
+			}
+			if it.Cursor() == "" {
+				t.Fatal("cursor should be kept after close")
+			}
+		})
+	}
+}
@@ -0,0 +1,448 @@
+package diskv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 切分后，已写满的 segment 不会再被修改 (迁移时整体删除)，备份时只需复制新增的 segment 和当前写入的 segment
+// 第 0 个 segment 为 diskv.db，之后的为 diskv.db.000001、diskv.db.000002 ...
+
+// 已写满的 segment 尾部出现不完整的记录，只能是文件损坏
+var errCorruptRecord = errors.New("corrupt record")
+
+// db 文件中的位置
+type logPos struct {
+	seg    int
+	offset int64
+}
+
+const segmentSuffixLen = 6
+
+func segmentFileName(dbFile string, seg int) string {
+	if seg == 0 {
+		return dbFile
+	}
+
+	return fmt.Sprintf("%s.%0*d", dbFile, segmentSuffixLen, seg)
+}
+
+// 列出 db 文件已存在的所有 segment，从小到大
+func listSegments(dbFile string) ([]int, error) {
+	ids := []int{}
+
+	if _, err := os.Stat(dbFile); err == nil {
+		ids = append(ids, 0)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(dbFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ids, nil
+		}
+		return nil, err
+	}
+
+	prefix := filepath.Base(dbFile) + "."
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		suffix := name[len(prefix):]
+		if len(suffix) != segmentSuffixLen {
+			continue // eg: diskv.db.tmp diskv.db._bak
+		}
+
+		seg, err := strconv.Atoi(suffix)
+		if err != nil || seg <= 0 {
+			continue
+		}
+
+		ids = append(ids, seg)
+	}
+
+	sort.Ints(ids)
+
+	return ids, nil
+}
+
+// 删除 db 文件第 0 个之后的所有 segment，用于迁移后清理旧的 segment
+func removeSegments(dbFile string) error {
+	ids, err := listSegments(dbFile)
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range ids {
+		if seg == 0 {
+			continue
+		}
+
+		err = os.Remove(segmentFileName(dbFile, seg))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove segment [%d] error: %s", seg, err)
+		}
+	}
+
+	return nil
+}
+
+// 当前 segment 写满时切换到新的 segment，调用方需持有 d.mu
+// 返回写入用的文件和当前的写入位置
+func (d *dbsotre) rollIfFull(f *os.File) (*os.File, int64, error) {
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size := fileInfo.Size()
+	if d.segmentSize <= 0 || size == 0 || size < d.segmentSize || d.applying > 0 {
+		return f, size, nil
+	}
+
+	// 写满的 segment 先落盘，之后不再修改
+	err = f.Sync()
+	if err != nil {
+		return nil, 0, fmt.Errorf("sync segment [%d] error: %s", d.seg, err)
+	}
+
+	seg := d.seg + 1
+	nf, err := os.OpenFile(segmentFileName(d.filePath, seg), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, 0, fmt.Errorf("create segment [%d] error: %s", seg, err)
+	}
+
+	d.segs[d.seg] = f
+	d.seg, d.f = seg, nf
+	d.ids = append(d.ids, seg)
+
+	return nf, 0, nil
+}
+
+// 在指定的 segment 文件上执行，执行时不持有 d.mu，只能做 ReadAt、Stat 等按位置的读操作
+// segment 文件只在 Diskv 持有 d.mu 写锁时 (替换、删除 segment) 才会被关闭
+func (d *dbsotre) runWithSegment(ctx context.Context, seg int, rf func(ctx context.Context, f *os.File) error) error {
+	d.mu.RLock()
+	f, ok := d.openedSegment(seg)
+	d.mu.RUnlock()
+
+	if !ok {
+		var err error
+		d.mu.Lock()
+		f, err = d.segmentFile(seg)
+		d.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return rf(ctx, f)
+}
+
+// 已经打开的 segment 文件，调用方需持有 d.mu
+func (d *dbsotre) openedSegment(seg int) (*os.File, bool) {
+	if seg == d.seg && d.f != nil {
+		return d.f, true
+	}
+
+	f, ok := d.segs[seg]
+	return f, ok
+}
+
+// 调用方需持有 d.mu
+func (d *dbsotre) segmentFile(seg int) (*os.File, error) {
+	f, ok := d.openedSegment(seg)
+	if !ok {
+		var err error
+		f, err = os.Open(segmentFileName(d.filePath, seg))
+		if err != nil {
+			return nil, fmt.Errorf("open segment [%d] error: %s", seg, err)
+		}
+		d.segs[seg] = f
+	}
+
+	return f, nil
+}
+
+func (d *dbsotre) segments() []int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return append([]int(nil), d.ids...)
+}
+
+// 各个 segment 的大小
+func (d *dbsotre) segmentSizes(ctx context.Context) (map[int]int64, error) {
+	sizes := map[int]int64{}
+
+	for _, seg := range d.segments() {
+		err := d.runWithSegment(ctx, seg, func(ctx context.Context, f *os.File) error {
+			fileInfo, err := f.Stat()
+			if err != nil {
+				return err
+			}
+
+			sizes[seg] = fileInfo.Size()
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sizes, nil
+}
+
+// 从 from 开始按顺序读取所有 segment 中的记录，见 scanLog
+// 只有最后一个 segment 的尾部会出现不完整的记录，之前 segment 中的视为损坏的记录
+func (d *dbsotre) scan(ctx context.Context, from logPos, fn func(rec *logRecord) bool) error {
+	ids := d.segments()
+
+	for i, seg := range ids {
+		if seg < from.seg {
+			continue
+		}
+
+		offset := int64(0)
+		if seg == from.seg {
+			offset = from.offset
+		}
+
+		// 读取时不持有 d.mu，fn 中可以继续写入
+		d.mu.Lock()
+		f, err := d.segmentFile(seg)
+		d.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		last := i == len(ids)-1
+		stop := false
+
+		_, err = scanLog(ctx, f, offset, func(rec *logRecord) bool {
+			rec.seg = seg
+			if !last && errors.Is(rec.err, errIncompleteRecord) {
+				rec.err = errCorruptRecord
+			}
+
+			stop = !fn(rec)
+			return !stop
+		})
+		if err != nil {
+			return fmt.Errorf("scan segment [%d] error: %s", seg, err)
+		}
+
+		if stop {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// 截断当前写入的 segment
+func (d *dbsotre) truncate(ctx context.Context, size int64) error {
+	return d.runWithFile(ctx, func(ctx context.Context, f *os.File) error {
+		return f.Truncate(size)
+	})
+}
+
+// 删除一个已写满的 segment，第 0 个 segment 保留为空文件
+func (d *dbsotre) removeSegment(ctx context.Context, seg int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if seg == d.seg {
+		return errors.New("can not remove the active segment")
+	}
+
+	if f, ok := d.segs[seg]; ok {
+		f.Close()
+		delete(d.segs, seg)
+	}
+
+	file := segmentFileName(d.filePath, seg)
+	if seg == 0 { // 用空文件替换，而不是截断，快照打开的文件仍然可以读，见 Snapshot
+		return replaceWithEmpty(file)
+	}
+
+	err := os.Remove(file)
+	if err != nil {
+		return err
+	}
+
+	for i, id := range d.ids {
+		if id == seg {
+			d.ids = append(d.ids[:i], d.ids[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// 原子地把文件替换为空文件，已打开的文件仍指向原来的内容
+func replaceWithEmpty(file string) error {
+	tmp := file + ".empty" // 不与迁移用的 .tmp 文件混淆
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+func (d *dbsotre) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var err error
+	for seg, f := range d.segs {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(d.segs, seg)
+	}
+
+	if d.f != nil {
+		if cerr := d.f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		d.f = nil
+	}
+
+	return err
+}
+
+// 压缩一个已写满的 segment: 把其中仍然有效的记录追加到当前的 segment，然后删除该 segment
+// 只阻塞一个 segment 的处理时间，可以逐个压缩较冷的 segment，而不必像 MigrateValue 一样重写整个 db
+func (d *Diskv) CompactSegment(ctx context.Context, seg int) error {
+	d.migrateMu.Lock()
+	defer d.migrateMu.Unlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+
+	ids := d.dbstore.segments()
+	if seg == ids[len(ids)-1] {
+		return fmt.Errorf("segment [%d] is being written", seg)
+	}
+
+	found := false
+	for _, id := range ids {
+		if id == seg {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("segment [%d] not found", seg)
+	}
+
+	// 更早的 segment 中可能有被该 segment 中的 _del 覆盖的记录，需保留 _del，否则重建 idx 时会复活
+	sizes, err := d.dbstore.segmentSizes(ctx)
+	if err != nil {
+		return fmt.Errorf("get segment size error: %s", err)
+	}
+	keepDel := false
+	for id, size := range sizes {
+		if id < seg && size > 0 {
+			keepDel = true
+		}
+	}
+
+	now := timeNow()
+
+	var ferr error
+	err = d.dbstore.scan(ctx, logPos{seg: seg}, func(rec *logRecord) bool {
+		if rec.seg != seg {
+			return false
+		}
+		if rec.err != nil || rec.batchMarker() {
+			return true
+		}
+
+		meta, ok, err := d.idx.getValueMeta(ctx, rec.item.key)
+		if err != nil {
+			ferr = err
+			return false
+		}
+
+		switch rec.op {
+		case opSet:
+			if !ok || meta.seg != seg || meta.offset != rec.offset {
+				return true // 已被覆盖或删除
+			}
+
+			if meta.expired(now) { // 已过期，不再复制，与 _del 一样按需保留删除记录
+				if keepDel {
+					_, err = d.dbstore.del(ctx, rec.item.key)
+				}
+				if err == nil {
+					_, err = d.idx.removeValueMeta(ctx, rec.item.key)
+					d.invalidateCache(rec.item.key)
+				}
+				break
+			}
+
+			meta, err = d.dbstore.write(ctx, rec.item)
+			if err == nil {
+				err = d.idx.setValueMeta(ctx, meta)
+				d.invalidateCache(rec.item.key) // 缓存中的位置在要删除的 segment 中
+			}
+		case opDel:
+			if ok || !keepDel {
+				return true
+			}
+
+			_, err = d.dbstore.del(ctx, rec.item.key)
+		}
+		if err != nil {
+			ferr = err
+			return false
+		}
+
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("scan segment error: %s", err)
+	}
+	if ferr != nil {
+		return fmt.Errorf("copy record error: %s", ferr)
+	}
+
+	// 先落盘复制的记录和 idx，再删除旧的 segment
+	err = d.dbstore.sync(ctx)
+	if err == nil {
+		err = d.idx.sync(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("sync file error: %s", err)
+	}
+
+	err = d.dbstore.removeSegment(ctx, seg)
+	if err != nil {
+		return fmt.Errorf("remove segment error: %s", err)
+	}
+
+	return d.loadStats(ctx)
+}
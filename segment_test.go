@@ -0,0 +1,190 @@
+package diskv
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSegments(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	opts := Options{MaxLoad: -1, SegmentSize: 1024}
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 48, KeysLen: 1000, Options: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			err = db.Set(ctx, fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d-%d", i, round)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if _, err = db.Del(ctx, fmt.Sprintf("key%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(t *testing.T, db *Diskv) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			val, ok, err := db.GetString(ctx, fmt.Sprintf("key%d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i < 10 {
+				if ok {
+					t.Fatalf("key%d should be deleted", i)
+				}
+				continue
+			}
+			if !ok || val != fmt.Sprintf("value%d-2", i) {
+				t.Fatalf("key%d: %q %v", i, val, ok)
+			}
+		}
+	}
+
+	ids, err := listSegments(filepath.Join(dir, "diskv.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) < 3 {
+		t.Fatalf("expect several segments, got %v", ids)
+	}
+	for _, seg := range ids[:len(ids)-1] {
+		info, err := os.Stat(segmentFileName(filepath.Join(dir, "diskv.db"), seg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > opts.SegmentSize+128 {
+			t.Fatalf("segment %d is too large: %d", seg, info.Size())
+		}
+	}
+	check(t, db)
+
+	t.Run("reopen", func(t *testing.T) {
+		err := db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = OpenDBWithConfig(ctx, &OpenConfig{Dir: dir, Options: opts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+
+		if stats := db.Stats(); stats.Segments != len(ids) {
+			t.Fatalf("expect %d segments, got %+v", len(ids), stats)
+		}
+	})
+
+	t.Run("compact segment", func(t *testing.T) {
+		before := db.Stats()
+
+		err := db.CompactSegment(ctx, ids[len(ids)-1])
+		if err == nil {
+			t.Fatal("should not compact the active segment")
+		}
+
+		for _, seg := range ids[:len(ids)-1] {
+			err = db.CompactSegment(ctx, seg)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		check(t, db)
+
+		after := db.Stats()
+		if after.GarbageBytes >= before.GarbageBytes {
+			t.Fatalf("garbage not reclaimed: %+v => %+v", before, after)
+		}
+
+		// 重建 idx 后的结果一致
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = RebuildIndex(ctx, &CreateConfig{Dir: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenDBWithConfig(ctx, &OpenConfig{Dir: dir, Options: opts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+	})
+
+	t.Run("migrate value", func(t *testing.T) {
+		err := db.MigrateValueOnline(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+
+		ids, err := listSegments(filepath.Join(dir, "diskv.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 1 || ids[0] != 0 {
+			t.Fatalf("expect only segment 0 after migrate, got %v", ids)
+		}
+	})
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 压缩 segment 移动了 value 的位置，缓存中的旧位置需失效
+func TestCompactSegmentCache(t *testing.T) {
+	ctx := context.Background()
+
+	for _, withValue := range []bool{false, true} {
+		t.Run(fmt.Sprintf("value=%v", withValue), func(t *testing.T) {
+			opts := Options{MaxLoad: -1, SegmentSize: 1024, CacheBytes: 1 << 20, CacheValues: withValue}
+			db, err := CreateDB(ctx, &CreateConfig{Dir: t.TempDir(), MaxLen: 48, KeysLen: 1000, Options: opts})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			for i := 0; i < 100; i++ {
+				if err := db.SetString(ctx, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			check := func() {
+				t.Helper()
+				for i := 0; i < 100; i++ {
+					val, ok, err := db.GetString(ctx, fmt.Sprintf("key%d", i))
+					if err != nil || !ok || val != fmt.Sprintf("value%d", i) {
+						t.Fatalf("key%d: %q %v %v", i, val, ok, err)
+					}
+				}
+			}
+			check() // 填充缓存
+
+			ids := db.dbstore.segments()
+			if len(ids) < 2 {
+				t.Fatalf("expect several segments, got %v", ids)
+			}
+			for _, seg := range ids[:len(ids)-1] {
+				if err := db.CompactSegment(ctx, seg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			check()
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package diskv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrSnapshotReleased = errors.New("snapshot is released")
+
+// Snapshot 是 db 在创建时刻的只读视图，之后的写入、删除、过期、迁移都不影响快照中读到的内容
+// 适合备份、统计等需要一致状态的长时间读取，读取快照不阻塞写入:
+//   - idx 写时复制: 快照不复制 idx，写入修改 slot 前才把原来的内容复制给快照，快照占用的内存与期间修改的 slot 数量成正比
+//   - db 文件: 快照打开创建时的所有 segment，之后迁移、压缩替换或删除的文件仍可以通过打开的文件读取
+//
+// 快照在 Release 之前一直占用内存和文件，用完需调用 Release；db Close 之后快照的读取返回 ErrClosed
+// Snapshot 实现了 kvstore.KVStorer，写操作返回 ErrReadOnly，可以交给 gkv 读取
+type Snapshot struct {
+	d *Diskv
+
+	idx      *idx      // 创建时的 idx 的视图，store 为快照打开的 db 文件
+	end      logPos    // 创建时 db 文件的末尾，快照中的记录都在之前
+	now      time.Time // 创建的时间，之后才过期的 key 在快照中仍然有效
+	released int32
+}
+
+// 快照看到的 idx: 没有修改过的 slot 从 base 中读，修改过的读修改前复制的内容
+type idxView struct {
+	base *idx
+
+	mu    sync.Mutex
+	saved map[int][]byte // slot -> 创建快照时的内容
+}
+
+// 创建快照，只在登记时短暂阻塞 idx 的修改，进行中的 batch 应用完之后才创建
+func (d *Diskv) Snapshot(ctx context.Context) (*Snapshot, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if err := d.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	base := d.idx
+	meta, err := base.getIdxMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	view := &idxView{base: base, saved: map[int][]byte{}}
+
+	d.applyMu.Lock()
+	base.wmu.Lock()
+	vmeta := *meta
+	// 登记时取 db 文件的末尾: idx 中已有的记录都先写入了 db 文件，在 end 之前
+	end, err := d.dbstore.end(ctx)
+	if err == nil {
+		if base.views == nil {
+			base.views = map[*idxView]bool{}
+		}
+		base.views[view] = true
+	}
+	now := timeNow()
+	base.wmu.Unlock()
+	d.applyMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// 持有 d.mu 的读锁，期间不会替换或删除 segment
+	s := &Snapshot{d: d, idx: &idx{meta: &vmeta, filePath: base.filePath, view: view}, end: end, now: now}
+	err = s.openStore()
+	if err != nil {
+		s.Release()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// 打开 end 之前的所有 segment 文件，快照只从这些文件中读取
+func (s *Snapshot) openStore() error {
+	store := s.d.dbstore
+
+	vstore := &dbsotre{version: s.idx.meta.version, filePath: store.filePath, seg: -1, segs: map[int]*os.File{}}
+	s.idx.store = vstore
+
+	for _, seg := range store.segments() {
+		if seg > s.end.seg {
+			break
+		}
+
+		f, err := os.Open(segmentFileName(store.filePath, seg))
+		if err != nil {
+			return err
+		}
+		vstore.segs[seg] = f
+		vstore.ids = append(vstore.ids, seg)
+	}
+
+	return nil
+}
+
+// 释放快照占用的内存和文件，之后的读取返回 ErrSnapshotReleased；可以重复调用
+func (s *Snapshot) Release() error {
+	if !atomic.CompareAndSwapInt32(&s.released, 0, 1) {
+		return nil
+	}
+
+	var err error
+	if s.idx.store != nil {
+		err = s.idx.store.close()
+	}
+
+	if cerr := s.idx.view.release(); cerr != nil && err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// 快照创建时 db 文件的末尾: segment 和其中的偏移量，快照中的记录都在之前
+func (s *Snapshot) End() (seg int, offset int64) {
+	return s.end.seg, s.end.offset
+}
+
+func (s *Snapshot) Get(ctx context.Context, key string) (data []byte, ok bool, err error) {
+	err = s.run(func() error {
+		key, err = encodeKey(s.idx.meta.version, key)
+		if err != nil {
+			return err
+		}
+
+		meta, found, err := s.lookup(ctx, key)
+		if err != nil || !found {
+			return err
+		}
+
+		val, err := s.idx.store.read(ctx, meta)
+		if err != nil {
+			return err
+		}
+
+		data, ok = val.value, true
+		return nil
+	})
+
+	return data, ok, err
+}
+
+func (s *Snapshot) GetString(ctx context.Context, key string) (data string, ok bool, err error) {
+	bs, ok, err := s.Get(ctx, key)
+	return string(bs), ok, err
+}
+
+func (s *Snapshot) Has(ctx context.Context, key string) (has bool, err error) {
+	err = s.run(func() error {
+		key, err = encodeKey(s.idx.meta.version, key)
+		if err != nil {
+			return err
+		}
+
+		_, has, err = s.lookup(ctx, key)
+		return err
+	})
+
+	return has, err
+}
+
+// 快照是只读的
+func (s *Snapshot) Set(ctx context.Context, key string, val []byte) error {
+	return ErrReadOnly
+}
+
+// 快照是只读的
+func (s *Snapshot) Del(ctx context.Context, key string) (ok bool, err error) {
+	return false, ErrReadOnly
+}
+
+// 遍历快照中所有的 key 和 value，无序
+func (s *Snapshot) ForEach(ctx context.Context, f func(ctx context.Context, key string, value []byte) (ok bool)) error {
+	return s.forEachKey(ctx, func(ctx context.Context, key string, meta *valueMeta) (bool, error) {
+		val, err := s.idx.store.read(ctx, meta)
+		if err != nil {
+			return false, err
+		}
+
+		return f(ctx, key, val.value), nil
+	})
+}
+
+// 遍历快照中所有的 key，不读取 value，无序，见 Diskv.ForEachKey
+func (s *Snapshot) ForEachKey(ctx context.Context, f func(ctx context.Context, key string) (ok bool)) error {
+	return s.forEachKey(ctx, func(ctx context.Context, key string, meta *valueMeta) (bool, error) {
+		return f(ctx, key), nil
+	})
+}
+
+// 返回快照中所有的 key，无序
+func (s *Snapshot) Keys(ctx context.Context) ([]string, error) {
+	keys := []string{}
+	err := s.ForEachKey(ctx, func(ctx context.Context, key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// 在 d.mu 的读锁中执行，db 关闭或快照释放后返回错误
+func (s *Snapshot) run(f func() error) error {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	if err := s.d.checkClosed(); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&s.released) != 0 {
+		return ErrSnapshotReleased
+	}
+
+	return f()
+}
+
+// 查找快照中的 key，key 为文件中存储的形式，创建时已过期的 key 视为不存在
+func (s *Snapshot) lookup(ctx context.Context, key string) (*valueMeta, bool, error) {
+	meta, ok, err := s.idx.getValueMeta(ctx, key)
+	if err != nil || !ok || meta.expired(s.now) {
+		return nil, false, err
+	}
+
+	return meta, true, nil
+}
+
+// 遍历快照中有效的 key，f 返回错误时停止遍历并返回该错误
+func (s *Snapshot) forEachKey(ctx context.Context, f func(ctx context.Context, key string, meta *valueMeta) (bool, error)) error {
+	return s.run(func() error {
+		var err error
+		ferr := s.idx.forEachSlot(ctx, func(slot int, meta *valueMeta) bool {
+			if meta.expired(s.now) {
+				return true
+			}
+
+			err = s.idx.resolveKey(ctx, meta)
+			if err != nil {
+				return false
+			}
+
+			var key string
+			key, err = decodeKey(s.idx.meta.version, meta.key)
+			if err != nil {
+				return false
+			}
+
+			var ok bool
+			ok, err = f(ctx, key, meta)
+			return ok && err == nil
+		})
+		if ferr != nil {
+			return ferr
+		}
+
+		return err
+	})
+}
+
+// 读取快照中 slot 的内容: 修改过的 slot 读复制的内容，否则读 base
+// 持有 base 的 stripe 读锁，检查和读取之间 slot 不会被修改
+func (v *idxView) readBlock(ctx context.Context, slot int, data []byte) (n int, err error) {
+	base := v.base
+	offset := int64(base.meta.getBlockStartOffset(slot))
+
+	err = base.runWithFileShared(ctx, func(ctx context.Context, f *os.File) error {
+		mu := base.stripe(slot)
+		mu.RLock()
+		defer mu.RUnlock()
+
+		v.mu.Lock()
+		saved, ok := v.saved[slot]
+		v.mu.Unlock()
+		if ok {
+			n = copy(data, saved)
+			return nil
+		}
+
+		n, err = base.readAt(f, data, offset)
+		return err
+	})
+
+	return n, err
+}
+
+// 从 base 中注销，base 已被替换时由最后一个快照关闭
+func (v *idxView) release() error {
+	base := v.base
+
+	base.wmu.Lock()
+	defer base.wmu.Unlock()
+
+	delete(base.views, v)
+	if base.retired && len(base.views) == 0 {
+		return base.close()
+	}
+
+	return nil
+}
+
+// 把 slot 原来的内容复制给还没有复制过的快照，调用方需持有 idx.wmu、idx.mu 的读锁和 slot 的 stripe 写锁
+func (idx *idx) saveBlock(f *os.File, slot int, offset int64, length int) error {
+	var data []byte
+	for v := range idx.views {
+		v.mu.Lock()
+		_, ok := v.saved[slot]
+		if !ok {
+			if data == nil {
+				data = make([]byte, length)
+				_, err := idx.readAt(f, data, offset)
+				if err != nil && !errors.Is(err, io.EOF) { // 文件末尾之后的 slot 为空
+					v.mu.Unlock()
+					return err
+				}
+			}
+			v.saved[slot] = data
+		}
+		v.mu.Unlock()
+	}
+
+	return nil
+}
+
+// 替换下来的 idx: 没有快照时直接关闭，否则由最后一个释放的快照关闭，见 idxView.release
+func (idx *idx) retire() error {
+	idx.wmu.Lock()
+	defer idx.wmu.Unlock()
+
+	if len(idx.views) > 0 {
+		idx.retired = true
+		return nil
+	}
+
+	return idx.close()
+}
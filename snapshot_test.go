@@ -0,0 +1,317 @@
+package diskv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iamlongalong/diskv/kvstore"
+)
+
+var _ kvstore.KVStorer = (*Snapshot)(nil)
+
+// 快照中的 key 和 value，按 key 排序后格式化，便于比较
+func dumpSnapshot(t *testing.T, s kvstore.KVStorer) string {
+	kvs := []string{}
+	err := s.ForEach(context.Background(), func(ctx context.Context, key string, value []byte) bool {
+		kvs = append(kvs, key+"="+string(value))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(kvs)
+
+	return fmt.Sprint(kvs)
+}
+
+// 快照之后的写入、删除、过期都不影响快照
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+
+	for _, c := range concurrentConfigs {
+		t.Run(c.name, func(t *testing.T) {
+			advance := fakeClock(t)
+
+			config := c.config
+			config.Dir = t.TempDir()
+
+			db, err := CreateDB(ctx, &config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("k%02d", i)
+				if err := db.SetString(ctx, key, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.SetStringWithTTL(ctx, "ttl", "ttl", time.Minute); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := db.Snapshot(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Release()
+			want := dumpSnapshot(t, db)
+
+			// 覆盖、删除、新增 (Robin Hood 会移动其他 key)、过期
+			for i := 0; i < 50; i += 2 {
+				key := fmt.Sprintf("k%02d", i)
+				if _, err := db.Del(ctx, key); err != nil {
+					t.Fatal(err)
+				}
+				if err := db.SetString(ctx, fmt.Sprintf("k%02d", i+1), "new"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 50; i < 100; i++ {
+				if err := db.SetString(ctx, fmt.Sprintf("k%02d", i), "new"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			advance(2 * time.Minute)
+
+			if got := dumpSnapshot(t, s); got != want {
+				t.Fatalf("snapshot changed:\n%s\n%s", got, want)
+			}
+			if got := dumpSnapshot(t, db); got == want {
+				t.Fatal("db should be changed")
+			}
+
+			for key, expect := range map[string]string{"k00": "k00", "k01": "k01", "ttl": "ttl", "k99": ""} {
+				val, ok, err := s.GetString(ctx, key)
+				if err != nil || ok != (expect != "") || val != expect {
+					t.Fatalf("get %s from snapshot: %q %v %v", key, val, ok, err)
+				}
+			}
+			keys, err := s.Keys(ctx)
+			if err != nil || len(keys) != 51 {
+				t.Fatalf("unexpected keys in snapshot: %d %v", len(keys), err)
+			}
+
+			if err := s.Set(ctx, "k00", nil); !errors.Is(err, ErrReadOnly) {
+				t.Fatalf("expect ErrReadOnly, got %v", err)
+			}
+
+			// 释放后不再复制修改的 slot
+			if err := s.Release(); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := s.Get(ctx, "k00"); !errors.Is(err, ErrSnapshotReleased) {
+				t.Fatalf("expect ErrSnapshotReleased, got %v", err)
+			}
+			if len(db.idx.views) != 0 {
+				t.Fatal("view should be removed after release")
+			}
+		})
+	}
+}
+
+// 并发提交的 batch 在快照中要么全部可见，要么全部不可见
+func TestSnapshotBatch(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: t.TempDir(), MaxLen: 48, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	keys := []string{}
+	for i := 0; i < 32; i++ {
+		keys = append(keys, fmt.Sprintf("k%02d", i))
+	}
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			b := db.NewBatch()
+			for _, key := range keys {
+				b.SetString(key, strconv.Itoa(i))
+			}
+			if err := b.Commit(ctx); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for n := 0; n < 500; n++ {
+		s, err := db.Snapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		vals := map[string]bool{}
+		err = s.ForEach(ctx, func(ctx context.Context, key string, value []byte) bool {
+			vals[string(value)] = true
+			return true
+		})
+		s.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(vals) > 1 {
+			t.Fatalf("snapshot has part of a batch: %v", vals)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+// 登记快照时写入 db 文件的记录在登记之后才写入 idx，不在快照中，也不应在 End 之前
+func TestSnapshotEnd(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: t.TempDir(), MaxLen: 48, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.SetString(ctx, fmt.Sprintf("k%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 登记时会调用 timeNow，此时写入一条记录，与并发的 Set 在登记期间写入 db 文件一样
+	var late *valueMeta
+	timeNow = func() time.Time {
+		timeNow = time.Now
+		var err error
+		late, err = db.dbstore.write(ctx, &valueItem{key: "late", value: []byte("v")})
+		if err != nil {
+			t.Error(err)
+		}
+		return time.Now()
+	}
+	t.Cleanup(func() { timeNow = time.Now })
+
+	s, err := db.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Release()
+	if late == nil {
+		t.Fatal("no record written while registering the snapshot")
+	}
+	if _, err := db.idx.replaceValueMeta(ctx, late); err != nil {
+		t.Fatal(err)
+	}
+
+	// End 之前的记录都在快照中
+	seg, offset := s.End()
+	err = db.dbstore.scan(ctx, logPos{}, func(rec *logRecord) bool {
+		if rec.seg > seg || (rec.seg == seg && int64(rec.offset+rec.length) > offset) {
+			return false
+		}
+		if rec.err == nil && rec.op == opSet {
+			if has, err := s.Has(ctx, rec.item.key); err != nil || !has {
+				t.Errorf("%s is before the snapshot end but not in the snapshot: %v", rec.item.key, err)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if has, err := db.Has(ctx, "late"); err != nil || !has {
+		t.Fatalf("late should be in db: %v %v", has, err)
+	}
+}
+
+// 迁移、扩容、压缩 segment 替换了文件之后，快照仍然读取原来的文件
+func TestSnapshotMigrate(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: t.TempDir(), MaxLen: 48, KeysLen: 100, Options: Options{SegmentSize: 1024}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	set := func(prefix string) {
+		for i := 0; i < 60; i++ {
+			if err := db.SetString(ctx, fmt.Sprintf("k%02d", i), prefix+strconv.Itoa(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	set("v")
+
+	s, err := db.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Release()
+	want := dumpSnapshot(t, s)
+	base := db.idx
+
+	check := func(t *testing.T) {
+		if got := dumpSnapshot(t, s); got != want {
+			t.Fatalf("snapshot changed:\n%s\n%s", got, want)
+		}
+	}
+
+	t.Run("compact segment", func(t *testing.T) {
+		set("x")
+		if err := db.CompactSegment(ctx, 0); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+
+	t.Run("migrate value", func(t *testing.T) {
+		set("y")
+		if err := db.MigrateValue(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if db.idx == base || !base.retired || base.f == nil {
+			t.Fatal("old idx should be kept for the snapshot")
+		}
+		check(t)
+	})
+
+	t.Run("grow idx", func(t *testing.T) {
+		for i := 0; i < 200; i++ {
+			if err := db.SetString(ctx, fmt.Sprintf("new%03d", i), "z"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.bg.Wait()
+		if db.Stats().KeysLen <= 100 {
+			t.Fatal("idx should be grown")
+		}
+		check(t)
+	})
+
+	// 最后一个快照释放时关闭被替换的 idx
+	if err := s.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if base.f != nil {
+		t.Fatal("old idx should be closed after release")
+	}
+}
@@ -0,0 +1,767 @@
+package diskv
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/iamlongalong/diskv/kvstore"
+)
+
+// 有序的 key 文件 diskv.keys，Options.SortedKeys 时用于 Scan/Range 定位起点:
+// [keys:2,clean:1,end:0000000000:00000000000000012345,count:00000000000000000003]\n
+// a\n
+// b%2Cc\n
+// d\n
+// 每行一个文件中存储的形式的 key，按解码后的 key 排序；文件生成之后新写入的 key 记录在内存的 delta 中
+// 删除的 key 不从文件和 delta 中移除，遍历时查 idx 过滤，因此文件 + delta 始终包含所有有效的 key
+// 迁移 value 文件后、delta 过大时在后台重新生成；Close 时把 delta 合并进文件，标记为 clean 并记录 db 文件的结尾
+// 打开时只使用 clean 且结尾与 db 文件一致的文件，并立即去掉 clean 标记，崩溃后打开时重新生成
+const (
+	sortedKeysMarkEvery = 32   // 每隔多少个 key 在内存中记录一次位置，用于定位 Range 的起点
+	minSortedKeysDelta  = 1024 // delta 超过该值且超过文件中 key 数量的 1/4 时在后台重新生成
+)
+
+var (
+	keysHeadLen         = len(formatKeysHead(&keysHead{}))
+	keysHeadCleanOffset = int64(len("[keys:0,clean:"))
+
+	errKeysNotClean = errors.New("keys file is not clean")
+)
+
+type sortedKeys struct {
+	mu sync.Mutex
+
+	f       *os.File  // 为 nil 时没有可用的文件，Scan/Range 遍历 idx 后排序
+	version int       // 文件中 key 的格式版本，与 idx 不一致时 (迁移升级了格式) 不可用
+	size    int64     // 文件大小
+	count   int       // 文件中 key 的数量
+	marks   []keyMark // 每 sortedKeysMarkEvery 个 key 的位置
+
+	delta    map[string]bool // 文件生成之后写入的 key (文件中存储的形式)
+	next     map[string]bool // 重新生成期间写入的 key，完成后作为新的 delta
+	building bool            // 正在后台重新生成
+}
+
+type keyMark struct {
+	key    string // 解码后的 key
+	offset int64
+}
+
+// key 文件中的 key，key 为解码后的形式，用于排序
+type sortedKey struct {
+	key  string
+	ekey string
+}
+
+type keysHead struct {
+	version int
+	clean   bool
+	end     logPos // clean 时 db 文件的结尾
+	count   int
+}
+
+func formatKeysHead(h *keysHead) []byte {
+	clean := 0
+	if h.clean {
+		clean = 1
+	}
+
+	return []byte(fmt.Sprintf("[keys:%d,clean:%d,end:%010d:%020d,count:%020d]\n", h.version, clean, h.end.seg, h.end.offset, h.count))
+}
+
+func parseKeysHead(data string) (*keysHead, error) {
+	if len(data) != keysHeadLen || !strings.HasPrefix(data, "[keys:") || !strings.HasSuffix(data, "]\n") {
+		return nil, fmt.Errorf("invalid keys head: %q", data)
+	}
+
+	fields := strings.Split(data[1:len(data)-2], ",")
+	values := map[string]string{}
+	for _, field := range fields {
+		kv := strings.SplitN(field, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid keys head: %q", data)
+		}
+		values[kv[0]] = kv[1]
+	}
+
+	h := &keysHead{clean: values["clean"] == "1"}
+	end := strings.Split(values["end"], ":")
+	if len(end) != 2 {
+		return nil, fmt.Errorf("invalid keys head: %q", data)
+	}
+
+	var err error
+	var offset, count int64
+	h.version, err = strconv.Atoi(values["keys"])
+	if err == nil {
+		h.end.seg, err = strconv.Atoi(end[0])
+	}
+	if err == nil {
+		offset, err = strconv.ParseInt(end[1], 10, 64)
+	}
+	if err == nil {
+		count, err = strconv.ParseInt(values["count"], 10, 64)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid keys head: %q", data)
+	}
+	h.end.offset = offset
+	h.count = int(count)
+
+	return h, nil
+}
+
+func (d *Diskv) keysFileName(dir string) string {
+	return filepath.Join(dir, "diskv.keys")
+}
+
+func (d *Diskv) initSortedKeys() {
+	if d.opts.SortedKeys {
+		d.sorted = &sortedKeys{}
+	}
+}
+
+// 打开 db 时加载有序的 key 文件，不可用时在后台重新生成
+func (d *Diskv) openSortedKeys(ctx context.Context) {
+	if d.sorted == nil {
+		return
+	}
+
+	err := d.loadSortedKeys(ctx)
+	if err != nil {
+		d.rebuildSortedKeysLater()
+	}
+}
+
+func (d *Diskv) loadSortedKeys(ctx context.Context) error {
+	flag := os.O_RDWR
+	if d.readOnly {
+		flag = os.O_RDONLY
+	}
+
+	f, err := os.OpenFile(d.keysFileName(d.dir), flag, 0666)
+	if err != nil {
+		return err
+	}
+
+	loaded := false
+	defer func() {
+		if !loaded {
+			f.Close()
+		}
+	}()
+
+	r := bufio.NewReader(f)
+	data, err := r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("read keys head error: %s", err)
+	}
+	h, err := parseKeysHead(data)
+	if err != nil {
+		return err
+	}
+	if !h.clean {
+		return errKeysNotClean
+	}
+
+	idxMeta, err := d.idx.getIdxMeta(ctx)
+	if err != nil {
+		return err
+	}
+	end, err := d.dbstore.end(ctx)
+	if err != nil {
+		return err
+	}
+	if h.version != idxMeta.version || h.end != end {
+		return errors.New("keys file is stale")
+	}
+
+	marks := []keyMark{}
+	offset, count := int64(len(data)), 0
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read keys file error: %s", err)
+		}
+
+		if count%sortedKeysMarkEvery == 0 {
+			key, err := decodeKey(h.version, line[:len(line)-1])
+			if err != nil {
+				return err
+			}
+			marks = append(marks, keyMark{key: key, offset: offset})
+		}
+
+		offset += int64(len(line))
+		count++
+	}
+	if count != h.count {
+		return fmt.Errorf("keys count not match: %d != %d", count, h.count)
+	}
+
+	// 之后的写入只记录在内存中，先去掉 clean 标记，崩溃后不再使用这个文件
+	if !d.readOnly {
+		_, err = f.WriteAt([]byte("0"), keysHeadCleanOffset)
+		if err == nil {
+			err = f.Sync()
+		}
+		if err != nil {
+			return fmt.Errorf("mark keys file error: %s", err)
+		}
+	}
+
+	sk := d.sorted
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+
+	sk.f, sk.version, sk.size, sk.count, sk.marks = f, h.version, offset, count, marks
+	sk.delta = map[string]bool{}
+	loaded = true
+
+	return nil
+}
+
+// 记录写入 idx 的 key，调用方需持有 d.mu 的读锁，在写入 idx 之后调用
+func (d *Diskv) addSortedKey(key string) {
+	sk := d.sorted
+	if sk == nil {
+		return
+	}
+
+	sk.mu.Lock()
+	if sk.f != nil {
+		sk.delta[key] = true
+	}
+	if sk.next != nil {
+		sk.next[key] = true
+	}
+	rebuild := sk.f != nil && len(sk.delta) > minSortedKeysDelta && len(sk.delta) > sk.count/4
+	sk.mu.Unlock()
+
+	if rebuild {
+		d.rebuildSortedKeysLater()
+	}
+}
+
+// 在后台重新生成有序的 key 文件，调用方需持有 d.mu (读锁或写锁)
+// 失败时仍使用原来的文件 (或遍历 idx)，之后 delta 过大或迁移时再次重新生成
+func (d *Diskv) rebuildSortedKeysLater() {
+	sk := d.sorted
+	if sk == nil || d.readOnly {
+		return
+	}
+
+	sk.mu.Lock()
+	if sk.building {
+		sk.mu.Unlock()
+		return
+	}
+	sk.building = true
+	sk.mu.Unlock()
+
+	d.bg.Add(1)
+	go func() {
+		defer d.bg.Done()
+
+		d.rebuildSortedKeys(context.Background())
+
+		sk.mu.Lock()
+		sk.building = false
+		sk.next = nil
+		sk.mu.Unlock()
+	}()
+}
+
+func (d *Diskv) rebuildSortedKeys(ctx context.Context) error {
+	for {
+		keys, version, err := d.collectSortedKeys(ctx)
+		if err != nil {
+			return err
+		}
+
+		tmpFile := d.keysFileName(d.dir) + ".tmp"
+		w, err := createKeysFile(tmpFile, version)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err = w.add(key); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = w.finish()
+		}
+		if err != nil {
+			w.f.Close()
+			os.Remove(tmpFile)
+			return err
+		}
+
+		installed, err := d.installSortedKeys(ctx, w, tmpFile)
+		if err != nil || installed {
+			return err
+		}
+		// 生成期间迁移升级了格式，重新生成
+	}
+}
+
+// 收集 idx 中所有未过期的 key 并排序，之后写入的 key 记录到 next 中
+func (d *Diskv) collectSortedKeys(ctx context.Context) ([]sortedKey, int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if err := d.checkClosed(); err != nil {
+		return nil, 0, err
+	}
+
+	idxMeta, err := d.idx.getIdxMeta(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// 先开始记录，再读取 idx，两者之间写入的 key 会同时出现在 next 和 idx 中
+	sk := d.sorted
+	sk.mu.Lock()
+	sk.next = map[string]bool{}
+	sk.mu.Unlock()
+
+	metas, err := d.idx.usedSlots(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	now := timeNow()
+	keys := make([]sortedKey, 0, len(metas))
+	for _, meta := range metas {
+		if meta.expired(now) {
+			continue
+		}
+
+		err = d.idx.resolveKey(ctx, meta)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		key, err := decodeKey(idxMeta.version, meta.key)
+		if err != nil {
+			return nil, 0, err
+		}
+		keys = append(keys, sortedKey{key: key, ekey: meta.key})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].key < keys[j].key })
+
+	return keys, idxMeta.version, nil
+}
+
+// 持有 idx.wmu 读取所有有效的 slot，期间 key 不会被移动，不会漏掉 key
+// 只阻塞对 idx 的修改，不阻塞读取；hashedKeys 时 valMeta 中没有 key
+func (idx *idx) usedSlots(ctx context.Context) ([]*valueMeta, error) {
+	idx.wmu.Lock()
+	defer idx.wmu.Unlock()
+
+	metas := []*valueMeta{}
+	err := idx.forEachSlot(ctx, func(slot int, valMeta *valueMeta) bool {
+		metas = append(metas, valMeta)
+		return true
+	})
+
+	return metas, err
+}
+
+// 阻塞读写，用生成的文件替换当前的文件；期间迁移升级了格式时丢弃生成的文件，返回 false
+func (d *Diskv) installSortedKeys(ctx context.Context, w *keysWriter, tmpFile string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	discard := func() {
+		w.f.Close()
+		os.Remove(tmpFile)
+	}
+
+	if err := d.checkClosed(); err != nil {
+		discard()
+		return false, err
+	}
+
+	idxMeta, err := d.idx.getIdxMeta(ctx)
+	if err != nil {
+		discard()
+		return false, err
+	}
+	if idxMeta.version != w.version {
+		discard()
+		return false, nil
+	}
+
+	err = os.Rename(tmpFile, d.keysFileName(d.dir))
+	if err != nil {
+		discard()
+		return false, fmt.Errorf("rename keys file error: %s", err)
+	}
+
+	sk := d.sorted
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+
+	if sk.f != nil {
+		sk.f.Close()
+	}
+	sk.f, sk.version, sk.size, sk.count, sk.marks = w.f, w.version, w.offset, w.count, w.marks
+	sk.delta = sk.next
+	sk.next = nil
+
+	return true, nil
+}
+
+// 关闭时把 delta 合并进文件，标记为 clean，下次打开时直接使用，调用方需持有 d.mu 的写锁
+// 失败时文件保持非 clean，下次打开时重新生成
+func (d *Diskv) closeSortedKeys(ctx context.Context) error {
+	sk := d.sorted
+	if sk == nil || sk.f == nil || d.readOnly {
+		return nil
+	}
+
+	idxMeta, err := d.idx.getIdxMeta(ctx)
+	if err != nil {
+		return err
+	}
+	if sk.version != idxMeta.version { // 迁移升级了格式，还没重新生成
+		return nil
+	}
+
+	if len(sk.delta) > 0 {
+		err = d.mergeSortedKeys(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	end, err := d.dbstore.end(ctx)
+	if err != nil {
+		return err
+	}
+
+	head := formatKeysHead(&keysHead{version: sk.version, clean: true, end: end, count: sk.count})
+	_, err = sk.f.WriteAt(head, 0)
+	if err != nil {
+		return err
+	}
+
+	return sk.f.Sync()
+}
+
+// 把 delta 合并进文件
+func (d *Diskv) mergeSortedKeys(ctx context.Context) error {
+	sk := d.sorted
+
+	delta, err := sk.deltaKeys(sk.version, "", "")
+	if err != nil {
+		return err
+	}
+
+	tmpFile := d.keysFileName(d.dir) + ".tmp"
+	w, err := createKeysFile(tmpFile, sk.version)
+	if err != nil {
+		return err
+	}
+
+	r := newKeysReader(sk.f, int64(keysHeadLen), sk.size, sk.version)
+	err = mergeKeys(r, delta, func(key sortedKey) (bool, error) {
+		return true, w.add(key)
+	})
+	if err == nil {
+		err = w.finish()
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, d.keysFileName(d.dir))
+	}
+	if err != nil {
+		w.f.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+
+	sk.f.Close()
+	sk.f, sk.size, sk.count, sk.marks = w.f, w.offset, w.count, w.marks
+	sk.delta = map[string]bool{}
+
+	return nil
+}
+
+// delta 中 [start, end) 范围内的 key，排好序，调用方需持有 sk.mu 或 d.mu 的写锁
+func (sk *sortedKeys) deltaKeys(version int, start, end string) ([]sortedKey, error) {
+	keys := []sortedKey{}
+	for ekey := range sk.delta {
+		key, err := decodeKey(version, ekey)
+		if err != nil {
+			return nil, err
+		}
+
+		if kvstore.InRange(key, start, end) {
+			keys = append(keys, sortedKey{key: key, ekey: ekey})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].key < keys[j].key })
+
+	return keys, nil
+}
+
+// 文件中 start 之前最近的记录位置，从这里开始读取，跳过小于 start 的 key
+func (sk *sortedKeys) seek(start string) int64 {
+	i := sort.Search(len(sk.marks), func(i int) bool { return sk.marks[i].key >= start })
+	if i == 0 {
+		return int64(keysHeadLen)
+	}
+
+	return sk.marks[i-1].offset
+}
+
+// 按顺序读取 key 文件中的 key
+type keysReader struct {
+	r       *bufio.Reader
+	version int
+}
+
+func newKeysReader(f *os.File, offset int64, size int64, version int) *keysReader {
+	return &keysReader{r: bufio.NewReader(io.NewSectionReader(f, offset, size-offset)), version: version}
+}
+
+// 读完时 ok 为 false
+func (r *keysReader) next() (key sortedKey, ok bool, err error) {
+	line, err := r.r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return sortedKey{}, false, nil
+	}
+	if err != nil {
+		return sortedKey{}, false, fmt.Errorf("read keys file error: %s", err)
+	}
+
+	key.ekey = line[:len(line)-1]
+	key.key, err = decodeKey(r.version, key.ekey)
+	if err != nil {
+		return sortedKey{}, false, err
+	}
+
+	return key, true, nil
+}
+
+// 按顺序合并文件和 delta 中的 key，同一个 key 只返回一次；f 返回 false 时停止
+func mergeKeys(r *keysReader, delta []sortedKey, f func(key sortedKey) (bool, error)) error {
+	cur, ok, err := r.next()
+	if err != nil {
+		return err
+	}
+
+	for ok || len(delta) > 0 {
+		var key sortedKey
+		switch {
+		case !ok || (len(delta) > 0 && delta[0].key < cur.key):
+			key, delta = delta[0], delta[1:]
+		default:
+			if len(delta) > 0 && delta[0].key == cur.key {
+				delta = delta[1:]
+			}
+			key = cur
+			cur, ok, err = r.next()
+			if err != nil {
+				return err
+			}
+		}
+
+		next, err := f(key)
+		if err != nil || !next {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 写入新的 key 文件，key 需按顺序写入
+type keysWriter struct {
+	f       *os.File
+	w       *bufio.Writer
+	version int
+	offset  int64
+	count   int
+	marks   []keyMark
+}
+
+func createKeysFile(name string, version int) (*keysWriter, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("create keys file error: %s", err)
+	}
+
+	w := &keysWriter{f: f, w: bufio.NewWriter(f), version: version, offset: int64(keysHeadLen)}
+	_, err = w.w.Write(formatKeysHead(&keysHead{version: version}))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *keysWriter) add(key sortedKey) error {
+	if w.count%sortedKeysMarkEvery == 0 {
+		w.marks = append(w.marks, keyMark{key: key.key, offset: w.offset})
+	}
+
+	n, err := w.w.WriteString(key.ekey + "\n")
+	w.offset += int64(n)
+	w.count++
+
+	return err
+}
+
+// 写入 key 的数量，文件保持非 clean
+func (w *keysWriter) finish() error {
+	err := w.w.Flush()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.f.WriteAt(formatKeysHead(&keysHead{version: w.version, count: w.count}), 0)
+	return err
+}
+
+// Scan 遍历 key 以 prefix 开头的 key，同 Range(ctx, prefix, kvstore.PrefixEnd(prefix), f)
+func (d *Diskv) Scan(ctx context.Context, prefix string, f func(ctx context.Context, key string, value []byte) (ok bool)) error {
+	return d.Range(ctx, prefix, kvstore.PrefixEnd(prefix), f)
+}
+
+// 按 key 的顺序逐个读取的迭代器，每次用 Range 读取一页 key，两页之间不持有任何锁，不阻塞迁移
+// 可以随时暂停，之后 (如下一次 http 请求) 用 it.Cursor() 继续；分页读取时建议开启 Options.SortedKeys，否则每一页都要遍历整个 idx
+func (d *Diskv) NewIterator(ctx context.Context, opts kvstore.IteratorOptions) *kvstore.Iterator {
+	return kvstore.NewIterator(ctx, d, opts)
+}
+
+// 按 key 的字典序遍历 [start, end) 中的 key，end 为空时不限制上界，已过期的 key 不会遍历到
+// 开启 Options.SortedKeys 时从有序的 key 文件中定位起点，否则每次遍历整个 idx 后排序
+// 与 ForEach 一样，遍历期间写入的 key 不一定能遍历到
+func (d *Diskv) Range(ctx context.Context, start, end string, f func(ctx context.Context, key string, value []byte) (ok bool)) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if err := d.checkClosed(); err != nil {
+		return err
+	}
+
+	return d.rangeKeys(ctx, start, end, func(key sortedKey) (bool, error) {
+		_, value, ok, err := d.lookup(ctx, key.ekey, true)
+		if err != nil || !ok { // 已删除或已过期
+			return true, err
+		}
+
+		return f(ctx, key.key, value), nil
+	})
+}
+
+// 按顺序遍历 [start, end) 中的 key，可能包含已删除或已过期的 key，调用方需持有 d.mu 的读锁
+func (d *Diskv) rangeKeys(ctx context.Context, start, end string, f func(key sortedKey) (bool, error)) error {
+	idxMeta, err := d.idx.getIdxMeta(ctx)
+	if err != nil {
+		return err
+	}
+
+	r, delta, ok, err := d.sorted.snapshot(idxMeta.version, start, end)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		delta, err = d.sortKeys(ctx, idxMeta.version, start, end)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r == nil {
+		for _, key := range delta {
+			next, err := f(key)
+			if err != nil || !next {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return mergeKeys(r, delta, func(key sortedKey) (bool, error) {
+		if key.key < start {
+			return true, nil
+		}
+		if end != "" && key.key >= end {
+			return false, nil
+		}
+
+		return f(key)
+	})
+}
+
+// 可用时返回从 start 之前开始读取文件的 reader 和 delta 中范围内的 key，调用方需持有 d.mu 的读锁
+func (sk *sortedKeys) snapshot(version int, start, end string) (r *keysReader, delta []sortedKey, ok bool, err error) {
+	if sk == nil {
+		return nil, nil, false, nil
+	}
+
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+
+	if sk.f == nil || sk.version != version {
+		return nil, nil, false, nil
+	}
+
+	delta, err = sk.deltaKeys(version, start, end)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	// 持有 d.mu 的读锁期间文件不会被替换
+	return newKeysReader(sk.f, sk.seek(start), sk.size, version), delta, true, nil
+}
+
+// 没有可用的有序 key 文件时，遍历 idx 收集范围内未过期的 key 后排序
+func (d *Diskv) sortKeys(ctx context.Context, version int, start, end string) ([]sortedKey, error) {
+	now := timeNow()
+	keys := []sortedKey{}
+
+	var err error
+	ferr := d.forEachKey(ctx, func(ctx context.Context, valMeta *valueMeta) bool {
+		if valMeta.expired(now) {
+			return true
+		}
+
+		var key string
+		key, err = decodeKey(version, valMeta.key)
+		if err != nil {
+			return false
+		}
+
+		if kvstore.InRange(key, start, end) {
+			keys = append(keys, sortedKey{key: key, ekey: valMeta.key})
+		}
+		return true
+	})
+	if ferr != nil {
+		return nil, ferr
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].key < keys[j].key })
+
+	return keys, nil
+}
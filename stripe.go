@@ -0,0 +1,150 @@
+package diskv
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// 锁的顺序 (从外到内):
+//   d.mu (RLock 数据操作 / Lock 替换文件)
+//   -> key 锁 (同一个 key 的 Set/Del 依次进行，db 文件中记录的顺序与 idx 中的一致)
+//   -> d.applyMu (RLock 把 batch 应用到 idx / Lock 创建快照)
+//   -> idx.wmu (修改 idx: 查找空的 slot、移动冲突链、调整 key 的数量)
+//   -> idx.mu (RLock 读写 slot / Lock 打开、映射、截断、关闭 idx 文件)
+//   -> idx 的 stripe 锁 (读写 slot 所在的区间)
+// dbsotre.mu 只在 dbsotre 内部持有，持有时不再获取其他锁；读取记录时只在取文件时短暂持有
+// 读 idx 只持有 idx.mu 和 stripe 的读锁，不同区间的读写互不阻塞
+
+const (
+	keyLockStripes = 64 // key 锁的数量，按 key 的哈希值分配
+	idxStripes     = 64 // idx 按 slot 分成的区间数量
+)
+
+// 同一个 key 的写入依次进行，返回解锁函数
+func (d *Diskv) lockKey(key string) func() {
+	mu := &d.keyLocks[fnv1aSum32([]byte(key), 0)%keyLockStripes]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// 同时锁住多个 key，按锁的下标从小到大加锁，避免互相等待，返回解锁函数
+func (d *Diskv) lockKeys(keys []string) func() {
+	locked := map[uint32]bool{}
+	ids := []int{}
+	for _, key := range keys {
+		id := fnv1aSum32([]byte(key), 0) % keyLockStripes
+		if !locked[id] {
+			locked[id] = true
+			ids = append(ids, int(id))
+		}
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		d.keyLocks[id].Lock()
+	}
+	return func() {
+		for i := len(ids) - 1; i >= 0; i-- {
+			d.keyLocks[ids[i]].Unlock()
+		}
+	}
+}
+
+// slot 所在的区间的锁，相邻的 slot 在同一个区间
+func (idx *idx) stripe(slot int) *sync.RWMutex {
+	return &idx.stripes[slot*idxStripes/idx.meta.keysLen%idxStripes]
+}
+
+// 读取 slot 的 block，不在映射中时从文件读取
+func (idx *idx) readBlock(ctx context.Context, slot int, data []byte) (n int, err error) {
+	if idx.view != nil {
+		return idx.view.readBlock(ctx, slot, data)
+	}
+
+	offset := int64(idx.meta.getBlockStartOffset(slot))
+
+	err = idx.runWithFileShared(ctx, func(ctx context.Context, f *os.File) error {
+		mu := idx.stripe(slot)
+		mu.RLock()
+		defer mu.RUnlock()
+
+		n, err = idx.readAt(f, data, offset)
+		return err
+	})
+
+	return n, err
+}
+
+// 读取 idx 文件，在映射范围内时从映射中读，调用方需持有 idx.mu，读 slot 时还需持有 stripe 锁
+func (idx *idx) readAt(f *os.File, data []byte, offset int64) (int, error) {
+	if idx.mm != nil && offset+int64(len(data)) <= int64(len(idx.mm)) {
+		return copy(data, idx.mm[offset:]), nil
+	}
+
+	return f.ReadAt(data, offset)
+}
+
+// 写入 slot 的 block，调用方需持有 idx.wmu 和 idx.mu 的读锁
+// 有未释放的快照时，先把 slot 原来的内容复制给快照，见 Snapshot
+func (idx *idx) writeBlock(f *os.File, slot int, data []byte) error {
+	mu := idx.stripe(slot)
+	mu.Lock()
+	defer mu.Unlock()
+
+	offset := int64(idx.meta.getBlockStartOffset(slot))
+	if len(idx.views) > 0 {
+		err := idx.saveBlock(f, slot, offset, len(data))
+		if err != nil {
+			return err
+		}
+	}
+
+	return idx.writeAt(f, data, offset)
+}
+
+// 共享地使用 idx 文件，读写 slot 时使用，slot 之间由 stripe 锁保护
+func (idx *idx) runWithFileShared(ctx context.Context, rf func(ctx context.Context, f *os.File) error) error {
+	for {
+		idx.mu.RLock()
+		if idx.f != nil {
+			defer idx.mu.RUnlock()
+			return rf(ctx, idx.f)
+		}
+		idx.mu.RUnlock()
+
+		// 文件还没有打开，加写锁打开
+		err := idx.runWithFile(ctx, func(ctx context.Context, f *os.File) error { return nil })
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Robin Hood 移动多个 slot 前后各调用一次，moves 为奇数时正在移动
+func (idx *idx) beginMove() { atomic.AddUint64(&idx.moves, 1) }
+func (idx *idx) endMove()   { atomic.AddUint64(&idx.moves, 1) }
+
+// 查找期间有 slot 被移动时，没找到的 key 可能是被移过了查找的位置，需要重新查找
+func (idx *idx) retryMiss(ctx context.Context, find func() (slot int, meta *valueMeta, ok bool, err error)) (int, *valueMeta, bool, error) {
+	for {
+		start := atomic.LoadUint64(&idx.moves)
+
+		slot, meta, ok, err := find()
+		if err != nil || ok {
+			return slot, meta, ok, err
+		}
+
+		if start%2 == 0 && atomic.LoadUint64(&idx.moves) == start {
+			return 0, nil, false, nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return 0, nil, false, err
+		}
+		runtime.Gosched()
+	}
+}
@@ -0,0 +1,352 @@
+package diskv
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// 找出 n 个哈希到同一个 slot 的 key
+func collidingKeys(t *testing.T, db *Diskv, n int) []string {
+	ctx := context.Background()
+
+	slot := -1
+	keys := []string{}
+	for i := 0; len(keys) < n; i++ {
+		key := fmt.Sprintf("c%d", i)
+		ekey, err := db.encodeKey(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := db.idx.hashKey(ctx, ekey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slot < 0 {
+			slot = s
+		}
+		if s == slot {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func TestTombstone(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 64, Options: Options{MaxLoad: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	keys := collidingKeys(t, db, 8)
+	for _, key := range keys {
+		if err := db.SetString(ctx, key, "v-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkCount := func(t *testing.T, expect int) {
+		meta, err := db.idx.getIdxMeta(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.count != expect {
+			t.Fatalf("unexpected idx count: %d, expect %d", meta.count, expect)
+		}
+	}
+
+	t.Run("del in chain", func(t *testing.T) {
+		// 删除冲突链上间隔的 key，之后的 key 仍然可以找到
+		for i := 0; i < len(keys); i += 2 {
+			has, err := db.Del(ctx, keys[i])
+			if err != nil || !has {
+				t.Fatalf("del %s error: %v %v", keys[i], has, err)
+			}
+		}
+
+		for i, key := range keys {
+			val, ok, err := db.GetString(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i%2 == 0 {
+				if ok {
+					t.Fatalf("%s should be deleted", key)
+				}
+				continue
+			}
+			if !ok || val != "v-"+key {
+				t.Fatalf("get %s error: %q %v", key, val, ok)
+			}
+		}
+
+		// 再次删除不存在的 key
+		has, err := db.Del(ctx, keys[0])
+		if err != nil || has {
+			t.Fatalf("del deleted key error: %v %v", has, err)
+		}
+
+		checkCount(t, len(keys)/2)
+	})
+
+	t.Run("update after tombstone", func(t *testing.T) {
+		// 更新位于 tombstone 之后的 key，不能在 tombstone 上产生重复的 key
+		if err := db.SetString(ctx, keys[1], "updated"); err != nil {
+			t.Fatal(err)
+		}
+
+		found := 0
+		err := db.forEachKey(ctx, func(ctx context.Context, meta *valueMeta) bool {
+			if meta.key == keys[1] {
+				found++
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != 1 {
+			t.Fatalf("%s found %d times in idx", keys[1], found)
+		}
+
+		val, ok, err := db.GetString(ctx, keys[1])
+		if err != nil || !ok || val != "updated" {
+			t.Fatalf("get %s error: %q %v %v", keys[1], val, ok, err)
+		}
+
+		checkCount(t, len(keys)/2)
+	})
+
+	t.Run("reuse tombstone", func(t *testing.T) {
+		home, err := db.idx.hashKey(ctx, keys[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.SetString(ctx, keys[0], "again"); err != nil {
+			t.Fatal(err)
+		}
+
+		// 重新写入的 key 复用冲突链上第一个 tombstone
+		meta, state, err := db.idx.getValueOfSlot(ctx, home)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != slotUsed || meta.key != keys[0] {
+			t.Fatalf("tombstone not reused: %v %+v", state, meta)
+		}
+
+		checkCount(t, len(keys)/2+1)
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		expect := map[string]string{keys[0]: "again", keys[1]: "updated"}
+		for i := 3; i < len(keys); i += 2 {
+			expect[keys[i]] = "v-" + keys[i]
+		}
+
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenDB(ctx, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := map[string]string{}
+		err = db.ForEach(ctx, func(ctx context.Context, key string, value []byte) bool {
+			got[key] = string(value)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expect) {
+			t.Fatalf("unexpected keys after reopen: %v, expect %v", got, expect)
+		}
+	})
+}
+
+// 在很小的 idx 上随机写入和删除，和 map 的结果对比
+func TestTombstoneRandom(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 32, Options: Options{MaxLoad: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	// 一半的 key 哈希到同一个 slot，形成很长的冲突链
+	keys := collidingKeys(t, db, 12)
+	for i := 0; i < 12; i++ {
+		keys = append(keys, fmt.Sprintf("r%d", i))
+	}
+
+	r := rand.New(rand.NewSource(1))
+	model := map[string]string{}
+
+	check := func(t *testing.T, db *Diskv) {
+		for _, key := range keys {
+			val, ok, err := db.GetString(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect, has := model[key]
+			if ok != has || val != expect {
+				t.Fatalf("get %s error: %q %v, expect %q %v", key, val, ok, expect, has)
+			}
+		}
+
+		got := []string{}
+		err := db.ForEach(ctx, func(ctx context.Context, key string, value []byte) bool {
+			got = append(got, key)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(model) {
+			sort.Strings(got)
+			t.Fatalf("unexpected keys: %v, expect %d keys", got, len(model))
+		}
+
+		meta, err := db.idx.getIdxMeta(ctx)
+		if err != nil || meta.count != len(model) {
+			t.Fatalf("unexpected idx count: %+v %v, expect %d", meta, err, len(model))
+		}
+	}
+
+	for i := 0; i < 2000; i++ {
+		key := keys[r.Intn(len(keys))]
+
+		if r.Intn(2) == 0 {
+			val := fmt.Sprintf("%s-%d", key, i)
+			if err := db.SetString(ctx, key, val); err != nil {
+				t.Fatal(err)
+			}
+			model[key] = val
+		} else {
+			has, err := db.Del(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := model[key]; ok != has {
+				t.Fatalf("del %s: got %v, expect %v", key, has, ok)
+			}
+			delete(model, key)
+		}
+
+		if i%100 == 0 {
+			check(t, db)
+		}
+	}
+	check(t, db)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, db)
+}
+
+// 不断新增和删除不同的 key，tombstone 计入负载，超过 MaxLoad 时重建 idx，探测的长度不会超过负载
+func TestTombstoneChurn(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	const keysLen, live = 64, 8
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: keysLen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	// 查找不存在的 key 时，从每个 slot 开始探测到空的 slot 为止，返回最长的探测长度和 tombstone 的数量
+	probes := func(t *testing.T) (maxProbes, deleted int) {
+		meta, err := db.idx.getIdxMeta(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		states := make([]slotState, meta.keysLen)
+		for slot := range states {
+			_, states[slot], err = db.idx.getValueOfSlot(ctx, slot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if states[slot] == slotDeleted {
+				deleted++
+			}
+		}
+		for slot := range states {
+			n := 1
+			for n < meta.keysLen && states[(slot+n-1)%meta.keysLen] != slotEmpty {
+				n++
+			}
+			if n > maxProbes {
+				maxProbes = n
+			}
+		}
+		return maxProbes, deleted
+	}
+
+	for i := 0; i < 2000; i++ {
+		if err := db.SetString(ctx, fmt.Sprintf("k%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+		if i >= live {
+			if _, err := db.Del(ctx, fmt.Sprintf("k%d", i-live)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	db.bg.Wait()
+
+	meta, err := db.idx.getIdxMeta(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.keysLen != keysLen || meta.count != live {
+		t.Fatalf("idx should be rebuilt in place: keysLen %d, count %d", meta.keysLen, meta.count)
+	}
+
+	maxProbes, deleted := probes(t)
+	if meta.deleted != deleted {
+		t.Fatalf("unexpected tombstones in idx meta: %d, expect %d", meta.deleted, deleted)
+	}
+	if bound := int(DefaultMaxLoad*keysLen) + 1; maxProbes > bound {
+		t.Fatalf("probe %d slots to find a missing key, expect at most %d", maxProbes, bound)
+	}
+
+	// 文件头中记录了 tombstone 的数量，重新打开后不变
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err = db.idx.getIdxMeta(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.deleted != deleted {
+		t.Fatalf("unexpected tombstones after reopen: %d, expect %d", meta.deleted, deleted)
+	}
+	for i := 2000 - live; i < 2000; i++ {
+		if ok, err := db.Has(ctx, fmt.Sprintf("k%d", i)); err != nil || !ok {
+			t.Fatalf("k%d should exist: %v %v", i, ok, err)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package diskv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 读取当前时间，测试中替换以模拟时间流逝
+var timeNow = time.Now
+
+// 一次最多记录的待删除的过期 key，超过时不再记录，由 ReapExpired 或下次读到时删除
+const maxPendingReaps = 4096
+
+var errTTLUnsupported = errors.New("ttl is not supported by format v1, migrate value first")
+
+// 是否已过期
+func (m *valueMeta) expired(now time.Time) bool {
+	return m.expire > 0 && now.UnixMilli() >= m.expire
+}
+
+// 写入 key，ttl 之后过期: Get/Has/ForEach 不再返回该 key，之后在后台写入 _del 删除，迁移时不再复制
+// 过期时间 (unix 毫秒) 记录在 db 文件的记录和 idx 中；再次 Set 同一个 key 时清除过期时间
+// 过期时间在 slot 中占用约 15 字节 (",e" + 13 位毫秒)，slot 放不下时返回错误，不写入 db 文件
+func (d *Diskv) SetWithTTL(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid ttl: %s", ttl)
+	}
+
+	if d.formatVersion(ctx) < formatVersion2 {
+		return errTTLUnsupported
+	}
+
+	return d.setWithExpire(ctx, key, val, expireAt(ttl))
+}
+
+// ttl 之后的过期时间，ttl 不大于 0 时为 -1，写入时由 checkExpire 返回错误
+func expireAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return -1
+	}
+	return timeNow().Add(ttl).UnixMilli()
+}
+
+// 检查 Batch/Tx 中的过期时间，调用方需持有 d.mu 的读锁
+func (d *Diskv) checkExpire(ctx context.Context, expire int64) error {
+	if expire == 0 {
+		return nil
+	}
+	if expire < 0 {
+		return errors.New("invalid ttl")
+	}
+
+	idxMeta, err := d.idx.getIdxMeta(ctx)
+	if err != nil {
+		return err
+	}
+	if idxMeta.version < formatVersion2 {
+		return errTTLUnsupported
+	}
+
+	return nil
+}
+
+func (d *Diskv) SetStringWithTTL(ctx context.Context, key string, val string, ttl time.Duration) error {
+	return d.SetWithTTL(ctx, key, []byte(val), ttl)
+}
+
+func (d *Diskv) formatVersion(ctx context.Context) int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.checkClosed() != nil {
+		return currentFormatVersion // 由之后的写入返回 ErrClosed
+	}
+
+	idxMeta, err := d.idx.getIdxMeta(ctx)
+	if err != nil {
+		return currentFormatVersion
+	}
+
+	return idxMeta.version
+}
+
+// 删除所有已过期的 key，返回删除的数量；Options.ReapInterval 大于 0 时在后台定期执行
+func (d *Diskv) ReapExpired(ctx context.Context) (n int, err error) {
+	keys, err := d.expiredKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		ok, err := d.reapKey(ctx, key)
+		if err != nil {
+			return n, fmt.Errorf("reap key [%s] error: %w", key, err)
+		}
+		if ok {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// idx 中已过期的 key (文件中存储的形式)
+func (d *Diskv) expiredKeys(ctx context.Context) ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	now := timeNow()
+	keys := []string{}
+
+	var err error
+	ferr := d.idx.forEachSlot(ctx, func(slot int, valMeta *valueMeta) bool {
+		if !valMeta.expired(now) {
+			return true
+		}
+
+		err = d.idx.resolveKey(ctx, valMeta) // hashedKeys 时只为过期的 key 读取 db 文件
+		if err != nil {
+			return false
+		}
+
+		keys = append(keys, valMeta.key)
+		return true
+	})
+	if ferr != nil {
+		return nil, ferr
+	}
+
+	return keys, err
+}
+
+// 删除已过期的 key: 写入 _del 记录，删除索引；期间被重新写入则不删除
+func (d *Diskv) reapKey(ctx context.Context, key string) (bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if err := d.checkWritable(); err != nil {
+		return false, err
+	}
+
+	defer d.lockKey(key)()
+
+	meta, ok, err := d.idx.getValueMeta(ctx, key)
+	if err != nil || !ok || !meta.expired(timeNow()) {
+		return false, err
+	}
+
+	_, err = d.del(ctx, key)
+	return err == nil, err
+}
+
+// 读到已过期的 key 时调用，在后台删除，调用方需持有 d.mu 的读锁
+func (d *Diskv) reapLater(key string) {
+	if d.readOnly {
+		return
+	}
+
+	d.reapMu.Lock()
+	if d.reapKeys == nil {
+		d.reapKeys = map[string]bool{}
+	}
+	if len(d.reapKeys) < maxPendingReaps {
+		d.reapKeys[key] = true
+	}
+	start := !d.reaping
+	d.reaping = true
+	d.reapMu.Unlock()
+
+	if !start {
+		return
+	}
+
+	d.bg.Add(1)
+	go func() {
+		defer d.bg.Done()
+
+		for {
+			d.reapMu.Lock()
+			keys := d.reapKeys
+			d.reapKeys = nil
+			if len(keys) == 0 {
+				d.reaping = false
+				d.reapMu.Unlock()
+				return
+			}
+			d.reapMu.Unlock()
+
+			for key := range keys {
+				d.reapKey(context.Background(), key) // 失败时留到下次读到或 ReapExpired
+			}
+		}
+	}()
+}
+
+// ReapInterval 大于 0 时，后台定期删除已过期的 key
+func (d *Diskv) startReaper() {
+	if d.opts.ReapInterval <= 0 || d.readOnly {
+		return
+	}
+
+	if d.done == nil {
+		d.done = make(chan struct{})
+	}
+	done := d.done
+
+	d.bg.Add(1)
+	go func() {
+		defer d.bg.Done()
+
+		ticker := time.NewTicker(d.opts.ReapInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				d.ReapExpired(context.Background())
+			}
+		}
+	}()
+}
@@ -0,0 +1,352 @@
+package diskv
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 替换 timeNow，返回让时间前进的函数
+func fakeClock(t *testing.T) func(d time.Duration) {
+	var offset int64
+	timeNow = func() time.Time {
+		return time.Now().Add(time.Duration(atomic.LoadInt64(&offset)))
+	}
+	t.Cleanup(func() { timeNow = time.Now })
+
+	return func(d time.Duration) {
+		atomic.AddInt64(&offset, int64(d))
+	}
+}
+
+func TestTTL(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	advance := fakeClock(t)
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 48, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	if err := db.SetStringWithTTL(ctx, "session", "s1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetString(ctx, "user", "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetWithTTL(ctx, "bad", nil, 0); err == nil {
+		t.Fatal("should reject non-positive ttl")
+	}
+
+	if val, ok, err := db.GetString(ctx, "session"); err != nil || !ok || val != "s1" {
+		t.Fatalf("get session error: %q %v %v", val, ok, err)
+	}
+
+	// 过期时间持久化在记录和 idx 中
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	advance(2 * time.Minute)
+
+	if _, ok, err := db.Get(ctx, "session"); err != nil || ok {
+		t.Fatalf("session should be expired: %v %v", ok, err)
+	}
+	if has, err := db.Has(ctx, "session"); err != nil || has {
+		t.Fatalf("session should be expired: %v %v", has, err)
+	}
+	keys := []string{}
+	err = db.ForEach(ctx, func(ctx context.Context, key string, value []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil || fmt.Sprint(keys) != "[user]" {
+		t.Fatalf("unexpected keys: %v %v", keys, err)
+	}
+
+	// 读到过期的 key 后在后台写入 _del
+	db.bg.Wait()
+	if stats := db.Stats(); stats.Keys != 1 {
+		t.Fatalf("expired key should be reaped: %d", stats.Keys)
+	}
+	var last *logRecord
+	err = db.dbstore.scan(ctx, logPos{}, func(rec *logRecord) bool {
+		last = rec
+		return true
+	})
+	if err != nil || last.op != opDel || last.item.key != "session" {
+		t.Fatalf("expect _del of session at the end: %+v %v", last, err)
+	}
+
+	// 再次 Set 清除过期时间
+	if err := db.SetStringWithTTL(ctx, "session", "s2", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetString(ctx, "session", "s3"); err != nil {
+		t.Fatal(err)
+	}
+	advance(2 * time.Minute)
+	if val, ok, err := db.GetString(ctx, "session"); err != nil || !ok || val != "s3" {
+		t.Fatalf("session should not expire after Set: %q %v %v", val, ok, err)
+	}
+
+	// Batch 和 Tx 中的写入同样可以带过期时间
+	b := db.NewBatch()
+	b.SetWithTTL("b1", []byte("v"), time.Minute)
+	b.SetString("b2", "v")
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(ctx, func(tx *Tx) error {
+		return tx.SetWithTTL(ctx, "t1", []byte("v"), time.Minute)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	advance(2 * time.Minute)
+	for key, expect := range map[string]bool{"b1": false, "b2": true, "t1": false} {
+		if has, err := db.Has(ctx, key); err != nil || has != expect {
+			t.Fatalf("has %s: %v %v, expect %v", key, has, err, expect)
+		}
+	}
+
+	b.SetWithTTL("b3", []byte("v"), 0)
+	if err := b.Commit(ctx); err == nil {
+		t.Fatal("should reject non-positive ttl in batch")
+	}
+
+	t.Run("checksum", func(t *testing.T) {
+		data := encodeValueItem(currentFormatVersion, opSet, &valueItem{key: "k", value: []byte("v"), expire: 1700000000000})
+		_, item, err := decodeRecord(data)
+		if err != nil || item.expire != 1700000000000 {
+			t.Fatalf("decode error: %+v %v", item, err)
+		}
+
+		data = []byte(string(data[:len(data)-10]) + "9" + string(data[len(data)-9:]))
+		if _, _, err := decodeRecord(data); err == nil {
+			t.Fatal("should get checksum error")
+		}
+	})
+}
+
+// 过期时间占用 slot 的空间，放不下时不写入 db 文件
+func TestTTLSlotLen(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: dir, MaxLen: 32, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	dbFileSize := func() int64 {
+		fileInfo, err := os.Stat(filepath.Join(dir, "diskv.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fileInfo.Size()
+	}
+
+	key := "0123456789abcd"
+	if err := db.SetString(ctx, key, "v1"); err != nil {
+		t.Fatal(err)
+	}
+	size := dbFileSize()
+
+	if err := db.SetStringWithTTL(ctx, key, "v2", time.Minute); err == nil {
+		t.Fatal("should reject ttl that does not fit in the slot")
+	}
+	b := db.NewBatch()
+	b.SetString("b1", "v")
+	b.SetWithTTL(key, []byte("v3"), time.Minute)
+	if err := b.Commit(ctx); err == nil {
+		t.Fatal("should reject batch with ttl that does not fit in the slot")
+	}
+	if got := dbFileSize(); got != size {
+		t.Fatalf("db file should not be written: %d, expect %d", got, size)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenDB(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, ok, err := db.GetString(ctx, key); err != nil || !ok || val != "v1" {
+		t.Fatalf("get %s error: %q %v %v", key, val, ok, err)
+	}
+	if has, err := db.Has(ctx, "b1"); err != nil || has {
+		t.Fatalf("b1 should not be written: %v %v", has, err)
+	}
+}
+
+func TestReapExpired(t *testing.T) {
+	ctx := context.Background()
+
+	for _, c := range concurrentConfigs {
+		t.Run(c.name, func(t *testing.T) {
+			advance := fakeClock(t)
+
+			config := c.config
+			config.Dir = t.TempDir()
+
+			db, err := CreateDB(ctx, &config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { db.Close() }()
+
+			for i := 0; i < 20; i++ {
+				ttl := time.Minute
+				if i%2 == 0 {
+					ttl = time.Hour
+				}
+				if err := db.SetStringWithTTL(ctx, fmt.Sprintf("key%d", i), "v", ttl); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			advance(2 * time.Minute)
+			n, err := db.ReapExpired(ctx)
+			if err != nil || n != 10 {
+				t.Fatalf("unexpected reaped: %d %v", n, err)
+			}
+			if stats := db.Stats(); stats.Keys != 10 {
+				t.Fatalf("unexpected keys: %d", stats.Keys)
+			}
+
+			// 重新打开后仍然存在的 key 保留过期时间
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			db, err = OpenDB(ctx, config.Dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if has, err := db.Has(ctx, "key0"); err != nil || !has {
+				t.Fatalf("key0 should exist: %v %v", has, err)
+			}
+
+			advance(time.Hour)
+			if n, err := db.ReapExpired(ctx); err != nil || n != 10 {
+				t.Fatalf("unexpected reaped: %d %v", n, err)
+			}
+			if stats := db.Stats(); stats.Keys != 0 {
+				t.Fatalf("unexpected keys: %d", stats.Keys)
+			}
+		})
+	}
+
+	t.Run("background", func(t *testing.T) {
+		advance := fakeClock(t)
+
+		db, err := CreateDB(ctx, &CreateConfig{Dir: t.TempDir(), MaxLen: 48, KeysLen: 100, Options: Options{ReapInterval: 10 * time.Millisecond}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if err := db.SetStringWithTTL(ctx, "k", "v", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		advance(2 * time.Minute)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for db.Stats().Keys != 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("expired key should be reaped in background")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+// 迁移 value 文件时不再复制过期的 key，未过期的 key 保留过期时间
+func TestTTLCompaction(t *testing.T) {
+	ctx := context.Background()
+
+	check := func(t *testing.T, db *Diskv, advance func(time.Duration)) {
+		if has, err := db.Has(ctx, "live"); err != nil || !has {
+			t.Fatalf("live should exist: %v %v", has, err)
+		}
+
+		n := 0
+		err := db.dbstore.scan(ctx, logPos{}, func(rec *logRecord) bool {
+			if rec.err == nil && rec.op == opSet && rec.item.key == "dead" {
+				n++
+			}
+			return true
+		})
+		if err != nil || n != 0 {
+			t.Fatalf("expired records should be dropped: %d %v", n, err)
+		}
+
+		advance(time.Hour)
+		if has, err := db.Has(ctx, "live"); err != nil || has {
+			t.Fatalf("live should keep its ttl: %v %v", has, err)
+		}
+	}
+
+	prepare := func(t *testing.T, config *CreateConfig) (*Diskv, func(time.Duration)) {
+		advance := fakeClock(t)
+
+		db, err := CreateDB(ctx, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		if err := db.SetStringWithTTL(ctx, "dead", "v", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SetStringWithTTL(ctx, "live", "v", 30*time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		advance(2 * time.Minute)
+
+		return db, advance
+	}
+
+	t.Run("migrate", func(t *testing.T) {
+		db, advance := prepare(t, &CreateConfig{Dir: t.TempDir(), MaxLen: 48, KeysLen: 100})
+		if err := db.MigrateValue(ctx); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db, advance)
+	})
+
+	t.Run("online", func(t *testing.T) {
+		db, advance := prepare(t, &CreateConfig{Dir: t.TempDir(), MaxLen: 48, KeysLen: 100})
+		if err := db.MigrateValueOnline(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db, advance)
+	})
+
+	t.Run("segment", func(t *testing.T) {
+		db, advance := prepare(t, &CreateConfig{Dir: t.TempDir(), MaxLen: 48, KeysLen: 100, Options: Options{SegmentSize: 1}})
+		if err := db.SetString(ctx, "other", "v"); err != nil { // 切换到新的 segment
+			t.Fatal(err)
+		}
+
+		if err := db.CompactSegment(ctx, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CompactSegment(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db, advance)
+	})
+}
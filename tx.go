@@ -0,0 +1,287 @@
+package diskv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	ErrConflict   = errors.New("tx conflict") // 事务读过的 key 在提交前被其他写入修改，见 Update
+	ErrTxReadOnly = errors.New("tx is read only")
+	ErrTxDone     = errors.New("tx is done") // Update/View 返回后继续使用 tx
+)
+
+// Tx 是 Update/View 中的事务，读取时能读到本事务中之前的写入
+// 写入先保存在内存中，提交时作为一个 batch 写入；读过的 key 记录读到的位置，提交时位置变了说明有冲突
+// Tx 实现了 kvstore.KVStorer，可以直接交给 gkv 使用；Tx 不能并发使用
+type Tx struct {
+	d        *Diskv
+	writable bool
+	done     bool
+
+	files  uint64             // 第一次读取时的 d.files，之后迁移过文件则位置不可比较，视为冲突
+	reads  map[string]*txRead // key -> 第一次读到的位置
+	writes map[string]batchOp // key -> 最后一次写入
+	ops    []batchOp
+}
+
+type txRead struct {
+	key  string     // 文件中存储的 key
+	meta *valueMeta // 为 nil 时 key 不存在
+}
+
+// 在可写的事务中执行 fn，fn 返回 nil 时提交其中的写入，返回错误时不写入任何数据，原样返回该错误
+// 提交时 fn 读过的 key 已被其他写入修改，则重新执行 fn，重试 Options.TxRetries 次后仍冲突返回 ErrConflict
+// fn 可能被执行多次，不要在 fn 中修改外部的状态
+func (d *Diskv) Update(ctx context.Context, fn func(tx *Tx) error) error {
+	return d.runTx(ctx, true, fn)
+}
+
+// 在只读的事务中执行 fn，结束时 fn 读过的 key 被修改过则重新执行，保证 fn 读到的是同一时刻的值
+func (d *Diskv) View(ctx context.Context, fn func(tx *Tx) error) error {
+	return d.runTx(ctx, false, fn)
+}
+
+func (d *Diskv) runTx(ctx context.Context, writable bool, fn func(tx *Tx) error) error {
+	retries := d.opts.TxRetries
+	if retries == 0 {
+		retries = DefaultTxRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		tx := &Tx{d: d, writable: writable, reads: map[string]*txRead{}, writes: map[string]batchOp{}}
+
+		err := fn(tx)
+		tx.done = true
+		if err == nil {
+			err = d.commitBatch(ctx, tx.ops, tx)
+			if errors.Is(err, ErrIndexFull) && d.opts.MaxLoad >= 0 {
+				// 扩容后重新打开了文件，读到的位置不可比较，扩容不计入重试次数
+				err = d.growIdx(ctx)
+				if err != nil {
+					return fmt.Errorf("grow idx error: %w", err)
+				}
+
+				attempt--
+				continue
+			}
+		}
+
+		if !errors.Is(err, ErrConflict) || attempt >= retries {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+func (tx *Tx) Get(ctx context.Context, key string) (data []byte, ok bool, err error) {
+	if tx.done {
+		return nil, false, ErrTxDone
+	}
+
+	if op, ok := tx.writes[key]; ok {
+		if op.op == opDel {
+			return nil, false, nil
+		}
+		return op.value, true, nil
+	}
+
+	return tx.read(ctx, key, true)
+}
+
+func (tx *Tx) GetString(ctx context.Context, key string) (data string, ok bool, err error) {
+	val, ok, err := tx.Get(ctx, key)
+	if err != nil {
+		return "", false, err
+	}
+
+	return string(val), ok, nil
+}
+
+func (tx *Tx) Has(ctx context.Context, key string) (has bool, err error) {
+	if tx.done {
+		return false, ErrTxDone
+	}
+
+	if op, ok := tx.writes[key]; ok {
+		return op.op == opSet, nil
+	}
+
+	_, has, err = tx.read(ctx, key, false)
+	return has, err
+}
+
+// 写入在提交时生效，val 在提交前不能修改
+func (tx *Tx) Set(ctx context.Context, key string, val []byte) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+
+	tx.write(batchOp{op: opSet, key: key, value: val})
+	return nil
+}
+
+func (tx *Tx) SetString(ctx context.Context, key string, val string) error {
+	return tx.Set(ctx, key, []byte(val))
+}
+
+// 同 Diskv.SetWithTTL，过期时间从调用时开始计算
+func (tx *Tx) SetWithTTL(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("invalid ttl: %s", ttl)
+	}
+
+	tx.write(batchOp{op: opSet, key: key, value: val, expire: expireAt(ttl)})
+	return nil
+}
+
+// ok 为删除前 key 是否存在，与 Diskv.Del 一致，因此会读取 key 并参与冲突检查
+func (tx *Tx) Del(ctx context.Context, key string) (ok bool, err error) {
+	if err := tx.checkWritable(); err != nil {
+		return false, err
+	}
+
+	ok, err = tx.Has(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	tx.write(batchOp{op: opDel, key: key})
+	return ok, nil
+}
+
+// 遍历 db 中的 key，叠加本事务中的写入，本事务写入的 key 按字典序在最后遍历
+// 遍历读到的 key 不参与冲突检查，需要检查的 key 用 Get 读取
+func (tx *Tx) ForEach(ctx context.Context, f func(ctx context.Context, key string, value []byte) (ok bool)) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	stopped := false
+	err := tx.d.ForEach(ctx, func(ctx context.Context, key string, value []byte) bool {
+		if _, ok := tx.writes[key]; ok {
+			return true
+		}
+
+		stopped = !f(ctx, key, value)
+		return !stopped
+	})
+	if err != nil || stopped {
+		return err
+	}
+
+	keys := make([]string, 0, len(tx.writes))
+	for key, op := range tx.writes {
+		if op.op == opSet {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !f(ctx, key, tx.writes[key].value) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (tx *Tx) checkWritable() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+
+	return nil
+}
+
+func (tx *Tx) write(op batchOp) {
+	tx.ops = append(tx.ops, op)
+	tx.writes[op.key] = op
+}
+
+// 从 db 读取 key，记录第一次读到的位置；再次读取时位置变了直接返回 ErrConflict
+func (tx *Tx) read(ctx context.Context, key string, withValue bool) (value []byte, ok bool, err error) {
+	d := tx.d
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if err := d.checkClosed(); err != nil {
+		return nil, false, err
+	}
+
+	if len(tx.reads) == 0 {
+		tx.files = d.files
+	} else if tx.files != d.files {
+		return nil, false, ErrConflict
+	}
+
+	ekey, err := d.encodeKey(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	meta, value, ok, err := d.lookup(ctx, ekey, withValue)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if r, seen := tx.reads[key]; seen {
+		if !samePosition(r.meta, meta) {
+			return nil, false, ErrConflict
+		}
+	} else {
+		tx.reads[key] = &txRead{key: ekey, meta: meta}
+	}
+
+	return value, ok, nil
+}
+
+// 检查读过的 key 是否被修改过，调用方需持有 d.mu 的读锁和这些 key 的锁
+func (tx *Tx) validate(ctx context.Context) error {
+	if len(tx.reads) == 0 {
+		return nil
+	}
+
+	if tx.files != tx.d.files {
+		return ErrConflict
+	}
+
+	for _, r := range tx.reads {
+		meta, ok, err := tx.d.idx.getValueMeta(ctx, r.key)
+		if err != nil {
+			return err
+		}
+		if !ok || meta.expired(timeNow()) { // 已过期与读取时一样视为不存在
+			meta = nil
+		}
+
+		if !samePosition(r.meta, meta) {
+			return ErrConflict
+		}
+	}
+
+	return nil
+}
+
+// 两次读到的是否为同一条记录，db 文件只追加，写入过的 key 位置一定会变
+func samePosition(a, b *valueMeta) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.seg == b.seg && a.offset == b.offset
+}
@@ -0,0 +1,239 @@
+package diskv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/iamlongalong/diskv/kvstore"
+)
+
+var _ kvstore.KVStorer = (*Tx)(nil)
+
+func TestTx(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := CreateDB(ctx, &CreateConfig{Dir: t.TempDir(), MaxLen: 40, KeysLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.SetString(ctx, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetString(ctx, "b", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	var leaked *Tx
+	err = db.Update(ctx, func(tx *Tx) error {
+		leaked = tx
+
+		if err := tx.SetString(ctx, "a", "1-new"); err != nil {
+			return err
+		}
+		if val, ok, err := tx.GetString(ctx, "a"); err != nil || !ok || val != "1-new" {
+			return fmt.Errorf("should read own write: %q %v %v", val, ok, err)
+		}
+
+		if ok, err := tx.Del(ctx, "b"); err != nil || !ok {
+			return fmt.Errorf("del b: %v %v", ok, err)
+		}
+		if has, err := tx.Has(ctx, "b"); err != nil || has {
+			return fmt.Errorf("b should be deleted in tx: %v %v", has, err)
+		}
+
+		// 提交之前 db 中还是旧值
+		if val, _, err := db.GetString(ctx, "a"); err != nil || val != "1" {
+			return fmt.Errorf("a should not change before commit: %q %v", val, err)
+		}
+
+		if err := tx.SetString(ctx, "c", "3"); err != nil {
+			return err
+		}
+
+		keys := map[string]string{}
+		err := tx.ForEach(ctx, func(ctx context.Context, key string, value []byte) bool {
+			keys[key] = string(value)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if fmt.Sprint(keys) != "map[a:1-new c:3]" {
+			return fmt.Errorf("unexpected keys in tx: %v", keys)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kv := range [][2]string{{"a", "1-new"}, {"c", "3"}} {
+		val, ok, err := db.GetString(ctx, kv[0])
+		if err != nil || !ok || val != kv[1] {
+			t.Fatalf("get %s error: %q %v %v", kv[0], val, ok, err)
+		}
+	}
+	if has, err := db.Has(ctx, "b"); err != nil || has {
+		t.Fatalf("b should be deleted: %v %v", has, err)
+	}
+
+	if _, _, err := leaked.Get(ctx, "a"); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("expect ErrTxDone, got %v", err)
+	}
+
+	// fn 返回错误时不写入
+	errAbort := errors.New("abort")
+	err = db.Update(ctx, func(tx *Tx) error {
+		if err := tx.SetString(ctx, "a", "aborted"); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("expect errAbort, got %v", err)
+	}
+	if val, _, _ := db.GetString(ctx, "a"); val != "1-new" {
+		t.Fatalf("aborted tx should not write: %q", val)
+	}
+
+	err = db.View(ctx, func(tx *Tx) error {
+		return tx.SetString(ctx, "a", "x")
+	})
+	if !errors.Is(err, ErrTxReadOnly) {
+		t.Fatalf("expect ErrTxReadOnly, got %v", err)
+	}
+}
+
+// 读取之后、提交之前 key 被其他写入修改: 重新执行 fn，不重试时返回 ErrConflict
+func TestTxConflict(t *testing.T) {
+	ctx := context.Background()
+
+	for _, retries := range []int{0, -1} {
+		t.Run(fmt.Sprintf("retries-%d", retries), func(t *testing.T) {
+			db, err := CreateDB(ctx, &CreateConfig{Dir: t.TempDir(), MaxLen: 40, KeysLen: 100, Options: Options{TxRetries: retries}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			if err := db.SetString(ctx, "n", "0"); err != nil {
+				t.Fatal(err)
+			}
+
+			runs := 0
+			err = db.Update(ctx, func(tx *Tx) error {
+				runs++
+
+				val, _, err := tx.GetString(ctx, "n")
+				if err != nil {
+					return err
+				}
+				n, _ := strconv.Atoi(val)
+
+				if runs == 1 { // 其他写入
+					if err := db.SetString(ctx, "n", "10"); err != nil {
+						return err
+					}
+				}
+
+				return tx.SetString(ctx, "n", strconv.Itoa(n+1))
+			})
+
+			if retries < 0 {
+				if !errors.Is(err, ErrConflict) || runs != 1 {
+					t.Fatalf("expect ErrConflict after 1 run, got %v after %d", err, runs)
+				}
+				if val, _, _ := db.GetString(ctx, "n"); val != "10" {
+					t.Fatalf("conflicting tx should not write: %q", val)
+				}
+				return
+			}
+
+			if err != nil || runs != 2 {
+				t.Fatalf("expect retry once: %v %d", err, runs)
+			}
+			if val, _, _ := db.GetString(ctx, "n"); val != "11" {
+				t.Fatalf("unexpected n: %q", val)
+			}
+		})
+	}
+
+	// 两次读取之间 key 被修改，第二次读取直接冲突
+	t.Run("reread", func(t *testing.T) {
+		db, err := CreateDB(ctx, &CreateConfig{Dir: t.TempDir(), MaxLen: 40, KeysLen: 100, Options: Options{TxRetries: -1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		err = db.View(ctx, func(tx *Tx) error {
+			if _, err := tx.Has(ctx, "k"); err != nil {
+				return err
+			}
+			if err := db.SetString(ctx, "k", "v"); err != nil {
+				return err
+			}
+			_, _, err := tx.Get(ctx, "k")
+			return err
+		})
+		if !errors.Is(err, ErrConflict) {
+			t.Fatalf("expect ErrConflict, got %v", err)
+		}
+	})
+}
+
+// 并发地读取、加一、写回，不能丢失更新
+func TestTxConcurrent(t *testing.T) {
+	ctx := context.Background()
+
+	for _, c := range concurrentConfigs {
+		t.Run(c.name, func(t *testing.T) {
+			config := c.config
+			config.Dir = t.TempDir()
+			config.TxRetries = 1000
+
+			db, err := CreateDB(ctx, &config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			workers, incrs := 4, 50
+			wg := sync.WaitGroup{}
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					for i := 0; i < incrs; i++ {
+						err := db.Update(ctx, func(tx *Tx) error {
+							val, _, err := tx.GetString(ctx, "counter")
+							if err != nil {
+								return err
+							}
+							n, _ := strconv.Atoi(val)
+							return tx.SetString(ctx, "counter", strconv.Itoa(n+1))
+						})
+						if err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			val, _, err := db.GetString(ctx, "counter")
+			if err != nil || val != strconv.Itoa(workers*incrs) {
+				t.Fatalf("lost update: %q %v, expect %d", val, err, workers*incrs)
+			}
+		})
+	}
+}